@@ -0,0 +1,147 @@
+package accesslog
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// Entry 一条连接结束时输出的访问日志
+type Entry struct {
+	Downstream    string
+	OriginalDst   string
+	Direction     string // inbound或outbound
+	Mode          string
+	StartTime     time.Time
+	Duration      time.Duration
+	BytesReceived int64         // 下游 -> 上游
+	BytesSent     int64         // 上游 -> 下游
+	ConnectTime   time.Duration // 建立上游连接的耗时，连接失败时为失败前的耗时
+	Reason        string
+	Protocol      string // 识别出的应用层协议，连接在识别完成之前关闭时为空
+	SNI           string // TLS连接的SNI
+}
+
+// RequestEntry HTTP/1.1连接上每个请求结束时输出的访问日志
+type RequestEntry struct {
+	Downstream    string
+	OriginalDst   string
+	Direction     string
+	Mode          string
+	StartTime     time.Time
+	Duration      time.Duration // 从收到请求的第一个字节到响应结束
+	Method        string
+	Path          string
+	Host          string
+	Status        int   // 连接在收到响应之前关闭时为0
+	BytesReceived int64 // 请求的字节数
+	BytesSent     int64 // 响应的字节数
+}
+
+// Logger 独立于调试日志的访问日志流，总是以Info级别输出，不受全局日志级别影响
+type Logger struct {
+	l      *logrus.Logger
+	closer io.Closer
+}
+
+// New 创建访问日志，format为json或text(默认json)，path为空或"stdout"时输出到标准输出，否则追加写入文件
+func New(format, path string) (*Logger, error) {
+	l := logrus.New()
+	l.SetLevel(logrus.InfoLevel)
+	switch format {
+	case "", FormatJSON:
+		l.SetFormatter(&logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	case FormatText:
+		l.SetFormatter(&logrus.TextFormatter{DisableColors: true, FullTimestamp: true, TimestampFormat: time.RFC3339Nano})
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+
+	al := &Logger{l: l}
+	switch path {
+	case "", "stdout":
+		l.SetOutput(os.Stdout)
+	case "stderr":
+		l.SetOutput(os.Stderr)
+	default:
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		l.SetOutput(f)
+		al.closer = f
+	}
+	return al, nil
+}
+
+// NewWithWriter 输出到指定的writer，主要用于测试
+func NewWithWriter(format string, w io.Writer) (*Logger, error) {
+	al, err := New(format, "")
+	if err != nil {
+		return nil, err
+	}
+	al.l.SetOutput(w)
+	return al, nil
+}
+
+// Log 输出一条访问日志，l为nil时什么都不做
+func (l *Logger) Log(e Entry) {
+	if l == nil {
+		return
+	}
+	l.l.WithFields(logrus.Fields{
+		"downstream":     e.Downstream,
+		"original_dst":   e.OriginalDst,
+		"direction":      e.Direction,
+		"mode":           e.Mode,
+		"start_time":     e.StartTime.Format(time.RFC3339Nano),
+		"duration_ms":    millis(e.Duration),
+		"bytes_received": e.BytesReceived,
+		"bytes_sent":     e.BytesSent,
+		"connect_ms":     millis(e.ConnectTime),
+		"reason":         e.Reason,
+		"protocol":       e.Protocol,
+		"sni":            e.SNI,
+	}).Info("access")
+}
+
+// LogRequest 输出一条请求的访问日志，l为nil时什么都不做
+func (l *Logger) LogRequest(e RequestEntry) {
+	if l == nil {
+		return
+	}
+	l.l.WithFields(logrus.Fields{
+		"downstream":     e.Downstream,
+		"original_dst":   e.OriginalDst,
+		"direction":      e.Direction,
+		"mode":           e.Mode,
+		"start_time":     e.StartTime.Format(time.RFC3339Nano),
+		"duration_ms":    millis(e.Duration),
+		"method":         e.Method,
+		"path":           e.Path,
+		"host":           e.Host,
+		"status":         e.Status,
+		"bytes_received": e.BytesReceived,
+		"bytes_sent":     e.BytesSent,
+	}).Info("request")
+}
+
+func (l *Logger) Close() error {
+	if l == nil || l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+// millis 毫秒，保留到微秒精度
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
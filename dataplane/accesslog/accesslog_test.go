@@ -0,0 +1,94 @@
+package accesslog_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/SMALL-head/zmesh/dataplane/accesslog"
+	"github.com/stretchr/testify/require"
+)
+
+var entry = accesslog.Entry{
+	Downstream:    "10.0.0.1:50000",
+	OriginalDst:   "10.0.0.2:80",
+	Direction:     "outbound",
+	Mode:          "sidecar",
+	StartTime:     time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	Duration:      1500 * time.Millisecond,
+	BytesReceived: 10,
+	BytesSent:     20,
+	ConnectTime:   2 * time.Millisecond,
+	Reason:        "normal",
+	Protocol:      "tls",
+	SNI:           "reviews.default",
+}
+
+func TestJSONFormat(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := accesslog.NewWithWriter(accesslog.FormatJSON, &buf)
+	require.NoError(t, err)
+	l.Log(entry)
+
+	var m map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &m))
+	require.Equal(t, "10.0.0.1:50000", m["downstream"])
+	require.Equal(t, "10.0.0.2:80", m["original_dst"])
+	require.Equal(t, "outbound", m["direction"])
+	require.Equal(t, "sidecar", m["mode"])
+	require.Equal(t, "2024-01-01T00:00:00Z", m["start_time"])
+	require.Equal(t, 1500.0, m["duration_ms"])
+	require.Equal(t, 10.0, m["bytes_received"])
+	require.Equal(t, 20.0, m["bytes_sent"])
+	require.Equal(t, 2.0, m["connect_ms"])
+	require.Equal(t, "normal", m["reason"])
+	require.Equal(t, "tls", m["protocol"])
+	require.Equal(t, "reviews.default", m["sni"])
+}
+
+func TestLogRequest(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := accesslog.NewWithWriter(accesslog.FormatJSON, &buf)
+	require.NoError(t, err)
+	l.LogRequest(accesslog.RequestEntry{
+		Downstream:    "10.0.0.1:50000",
+		OriginalDst:   "10.0.0.2:80",
+		Direction:     "inbound",
+		Mode:          "sidecar",
+		StartTime:     time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Duration:      3 * time.Millisecond,
+		Method:        "GET",
+		Path:          "/reviews?id=1",
+		Host:          "reviews",
+		Status:        200,
+		BytesReceived: 40,
+		BytesSent:     120,
+	})
+
+	var m map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &m))
+	require.Equal(t, "request", m["msg"])
+	require.Equal(t, "GET", m["method"])
+	require.Equal(t, "/reviews?id=1", m["path"])
+	require.Equal(t, "reviews", m["host"])
+	require.Equal(t, 200.0, m["status"])
+	require.Equal(t, 3.0, m["duration_ms"])
+	require.Equal(t, 120.0, m["bytes_sent"])
+}
+
+func TestTextFormat(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := accesslog.NewWithWriter(accesslog.FormatText, &buf)
+	require.NoError(t, err)
+	l.Log(entry)
+	require.Contains(t, buf.String(), "original_dst=\"10.0.0.2:80\"")
+	require.Contains(t, buf.String(), "reason=normal")
+
+	_, err = accesslog.New("xml", "")
+	require.Error(t, err)
+
+	// nil Logger不输出
+	var nilLogger *accesslog.Logger
+	nilLogger.Log(entry)
+}
@@ -0,0 +1,165 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/SMALL-head/zmesh/dataplane/config"
+	"github.com/SMALL-head/zmesh/dataplane/metrics"
+	"github.com/SMALL-head/zmesh/dataplane/proxy"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Server dataplane的本地管理端口，类似envoy的admin listener
+type Server struct {
+	Host string
+	Port int
+
+	config  func() config.BootStrapConfig
+	proxies []*proxy.Proxy
+	drain   func()
+
+	srv *http.Server
+}
+
+type Option func(*Server)
+
+// WithConfig 设置/config_dump返回的配置，传入函数以便总是拿到当前生效的配置，token等敏感字段不会输出
+func WithConfig(f func() config.BootStrapConfig) Option {
+	return func(s *Server) {
+		s.config = f
+	}
+}
+
+func WithProxies(proxies ...*proxy.Proxy) Option {
+	return func(s *Server) {
+		s.proxies = append(s.proxies, proxies...)
+	}
+}
+
+// WithDrain 设置/drain触发的动作，不设置时对所有proxy调用Drain
+func WithDrain(f func()) Option {
+	return func(s *Server) {
+		s.drain = f
+	}
+}
+
+func New(host string, port int, opts ...Option) *Server {
+	s := &Server{Host: host, Port: port}
+	for _, opt := range opts {
+		opt(s)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/config_dump", s.handleConfigDump)
+	mux.HandleFunc("/connections", s.handleConnections)
+	mux.HandleFunc("/logging", s.handleLogging)
+	mux.HandleFunc("/ready", s.handleReady)
+	mux.HandleFunc("/drain", s.handleDrain)
+	s.srv = &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", host, port),
+		Handler: mux,
+	}
+	return s
+}
+
+// Handler 返回管理端口的路由，便于测试
+func (s *Server) Handler() http.Handler {
+	return s.srv.Handler
+}
+
+// Start 阻塞运行管理服务，Shutdown之后返回nil
+func (s *Server) Start() error {
+	logrus.Infof("starting admin server on %s", s.srv.Addr)
+	if err := s.srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+func (s *Server) handleConfigDump(w http.ResponseWriter, r *http.Request) {
+	if s.config == nil {
+		http.Error(w, "config not available", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(s.config().Redacted()); err != nil {
+		logrus.Errorf("[handleConfigDump] - error encoding config: %s", err)
+	}
+	_ = enc.Close()
+}
+
+func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
+	conns := make([]proxy.ConnInfo, 0)
+	for _, p := range s.proxies {
+		conns = append(conns, p.Connections()...)
+	}
+	writeJSON(w, http.StatusOK, conns)
+}
+
+// handleLogging GET查看当前日志级别，POST ?level=debug 修改日志级别
+func (s *Server) handleLogging(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		level, err := logrus.ParseLevel(r.URL.Query().Get("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logrus.SetLevel(level)
+		logrus.Infof("[handleLogging] - log level changed to %s", level)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"level": logrus.GetLevel().String()})
+}
+
+// handleReady 所有listener都已启动且未进入排空状态时返回200
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	for _, p := range s.proxies {
+		if !p.Ready() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.drain != nil {
+		s.drain()
+	} else {
+		for _, p := range s.proxies {
+			p.Drain()
+		}
+	}
+	active := 0
+	for _, p := range s.proxies {
+		active += p.ActiveConnections()
+	}
+	writeJSON(w, http.StatusAccepted, map[string]int{"active_connections": active})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Errorf("[writeJSON] - error encoding response: %s", err)
+	}
+}
@@ -0,0 +1,57 @@
+package admin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/SMALL-head/zmesh/dataplane/admin"
+	"github.com/SMALL-head/zmesh/dataplane/config"
+	"github.com/SMALL-head/zmesh/dataplane/proxy"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminEndpoints(t *testing.T) {
+	p := proxy.New(proxy.WithPort(18090))
+	s := admin.New("127.0.0.1", 0,
+		admin.WithConfig(func() config.BootStrapConfig {
+			cfg := config.DefaultBootStrapConfig()
+			cfg.CertAgent.Token = "s3cr3t-token"
+			return cfg
+		}),
+		admin.WithProxies(p),
+	)
+	h := s.Handler()
+	do := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec
+	}
+
+	rec := do(http.MethodGet, "/config_dump")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "port: 8090")
+	// token不出现在输出中
+	require.NotContains(t, rec.Body.String(), "s3cr3t-token")
+	require.Contains(t, rec.Body.String(), "token: <redacted>")
+
+	rec = do(http.MethodGet, "/connections")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "[]", strings.TrimSpace(rec.Body.String()))
+
+	// listener还没有启动
+	require.Equal(t, http.StatusServiceUnavailable, do(http.MethodGet, "/ready").Code)
+
+	old := logrus.GetLevel()
+	defer logrus.SetLevel(old)
+	require.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/logging?level=nope").Code)
+	rec = do(http.MethodPost, "/logging?level=debug")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, logrus.DebugLevel, logrus.GetLevel())
+
+	require.Equal(t, http.StatusMethodNotAllowed, do(http.MethodGet, "/drain").Code)
+	require.Equal(t, http.StatusAccepted, do(http.MethodPost, "/drain").Code)
+	require.True(t, p.Draining())
+}
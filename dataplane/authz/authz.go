@@ -0,0 +1,236 @@
+// Package authz inbound的授权策略：规则按对端的SPIFFE ID、来源网段、目的端口以及HTTP的方法和路径匹配，
+// 按顺序第一条命中的规则决定放行或拒绝，都不命中时使用默认动作
+package authz
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// 策略的工作模式
+const (
+	// ModeDisable 不做授权
+	ModeDisable = "disable"
+	// ModeEnforce 拒绝的连接被关闭
+	ModeEnforce = "enforce"
+	// ModeAudit 只记录决策，所有连接都放行
+	ModeAudit = "audit"
+)
+
+const (
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+)
+
+// DefaultRule 没有规则命中时Decision.Rule的值
+const DefaultRule = "default"
+
+// Rule 一条授权规则，所有非空的条件都满足时命中，同一个条件中的多个值之间是或的关系
+type Rule struct {
+	Name   string
+	Action string
+	// 对端证书中的SPIFFE ID，以*结尾时按前缀匹配，"*"匹配任意通过mTLS认证的对端；明文连接不会命中
+	Principals []string
+	Sources    []netip.Prefix
+	Ports      []int
+	// HTTP条件只对HTTP/1.x连接生效，连接上的每个请求都单独匹配，keep-alive和pipelining的请求被拒绝时关闭连接。
+	// 其余条件与连接匹配时连接必须是HTTP/1.x，见NeedsHTTPFor
+	Methods []string
+	Paths   []string // 以*结尾时按前缀匹配，否则精确匹配，匹配前请求的路径会去掉query并清理.和..
+}
+
+// Request 一个待授权的连接
+type Request struct {
+	Principal string // 对端的SPIFFE ID，没有经过mTLS认证时为空
+	Source    netip.Addr
+	Port      int // 目的端口
+	// HTTP为false时连接不是HTTP/1.x，带有HTTP条件的规则不会命中
+	HTTP   bool
+	Method string
+	Path   string
+}
+
+// Decision 授权的结果，Rule为命中的规则名，没有规则命中时为DefaultRule
+type Decision struct {
+	Allow bool
+	Rule  string
+}
+
+// Policy 一组按顺序匹配的规则，创建后只读，可以在多个连接之间共享
+type Policy struct {
+	mode          string
+	defaultAction string
+	rules         []Rule
+
+	needsPrincipal bool
+	needsHTTP      bool
+}
+
+// New 检查并创建策略，defaultAction为空时为allow
+func New(mode, defaultAction string, rules []Rule) (*Policy, error) {
+	var errs []error
+	switch mode {
+	case ModeEnforce, ModeAudit:
+	default:
+		errs = append(errs, fmt.Errorf("mode %q is not one of %s, %s", mode, ModeEnforce, ModeAudit))
+	}
+	if defaultAction == "" {
+		defaultAction = ActionAllow
+	}
+	if !validAction(defaultAction) {
+		errs = append(errs, fmt.Errorf("default action %q is not one of %s, %s", defaultAction, ActionAllow, ActionDeny))
+	}
+	p := &Policy{mode: mode, defaultAction: defaultAction}
+	for i, r := range rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if err := r.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("rule %s: %w", r.Name, err))
+		}
+		methods := make([]string, len(r.Methods))
+		for j, m := range r.Methods {
+			methods[j] = strings.ToUpper(m)
+		}
+		r.Methods = methods
+		p.needsPrincipal = p.needsPrincipal || len(r.Principals) > 0
+		p.needsHTTP = p.needsHTTP || r.hasHTTP()
+		p.rules = append(p.rules, r)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return p, nil
+}
+
+func validAction(a string) bool {
+	return a == ActionAllow || a == ActionDeny
+}
+
+func (r Rule) validate() error {
+	if !validAction(r.Action) {
+		return fmt.Errorf("action %q is not one of %s, %s", r.Action, ActionAllow, ActionDeny)
+	}
+	for _, port := range r.Ports {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("port %d out of range 1-65535", port)
+		}
+	}
+	for _, s := range r.Principals {
+		if s == "" {
+			return errors.New("empty principal")
+		}
+	}
+	for _, pattern := range r.Paths {
+		if !strings.HasPrefix(pattern, "/") && pattern != "*" {
+			return fmt.Errorf("path %q must start with /", pattern)
+		}
+	}
+	return nil
+}
+
+// Audit 是否只记录决策
+func (p *Policy) Audit() bool {
+	return p.mode == ModeAudit
+}
+
+// NeedsPrincipal 是否有规则需要对端身份，此时需要等mTLS握手完成后再授权
+func (p *Policy) NeedsPrincipal() bool {
+	return p.needsPrincipal
+}
+
+// NeedsHTTP 是否有规则需要HTTP的方法或路径，此时需要读到第一个请求后再授权，之后的请求也逐个授权
+func (p *Policy) NeedsHTTP() bool {
+	return p.needsHTTP
+}
+
+// NeedsHTTPFor 是否有带HTTP条件的规则的其余条件与req匹配。为true时只能在读到请求之后授权，
+// 调用方应拒绝不是HTTP/1.x的连接，否则这些规则不会命中
+func (p *Policy) NeedsHTTPFor(req Request) bool {
+	for _, r := range p.rules {
+		if r.hasHTTP() && r.matchesL4(req) {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate 返回第一条命中的规则的结果。audit模式下也按规则返回，由调用方决定是否放行
+func (p *Policy) Evaluate(req Request) Decision {
+	for _, r := range p.rules {
+		if r.matches(req) {
+			return Decision{Allow: r.Action == ActionAllow, Rule: r.Name}
+		}
+	}
+	return Decision{Allow: p.defaultAction == ActionAllow, Rule: DefaultRule}
+}
+
+func (r Rule) matches(req Request) bool {
+	if !r.matchesL4(req) {
+		return false
+	}
+	if r.hasHTTP() && !req.HTTP {
+		return false
+	}
+	if len(r.Methods) > 0 && !matchAny(r.Methods, req.Method, func(m, s string) bool { return m == s }) {
+		return false
+	}
+	if len(r.Paths) > 0 && !matchAny(r.Paths, normalizePath(req.Path), matchPattern) {
+		return false
+	}
+	return true
+}
+
+func (r Rule) hasHTTP() bool {
+	return len(r.Methods) > 0 || len(r.Paths) > 0
+}
+
+// matchesL4 HTTP以外的条件是否都满足
+func (r Rule) matchesL4(req Request) bool {
+	if len(r.Principals) > 0 && !matchAny(r.Principals, req.Principal, func(pattern, s string) bool {
+		return s != "" && matchPattern(pattern, s)
+	}) {
+		return false
+	}
+	if len(r.Sources) > 0 && !matchAny(r.Sources, req.Source, netip.Prefix.Contains) {
+		return false
+	}
+	return len(r.Ports) == 0 || matchAny(r.Ports, req.Port, func(a, b int) bool { return a == b })
+}
+
+// normalizePath 去掉query，解码并清理路径中的.和..，避免/api/../admin这类写法绕过规则，保留结尾的/
+func normalizePath(p string) string {
+	p, _, _ = strings.Cut(p, "?")
+	if unescaped, err := url.PathUnescape(p); err == nil {
+		p = unescaped
+	}
+	if p == "" || p[0] != '/' {
+		p = "/" + p
+	}
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+func matchAny[P, V any](patterns []P, v V, match func(P, V) bool) bool {
+	for _, p := range patterns {
+		if match(p, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern 以*结尾时按前缀匹配，否则精确匹配
+func matchPattern(pattern, s string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(s, prefix)
+	}
+	return pattern == s
+}
@@ -0,0 +1,74 @@
+package authz_test
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/SMALL-head/zmesh/dataplane/authz"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvaluate(t *testing.T) {
+	p, err := authz.New(authz.ModeEnforce, authz.ActionDeny, []authz.Rule{
+		{Name: "deny-admin", Action: authz.ActionDeny, Paths: []string{"/admin/*"}},
+		{Name: "frontend", Action: authz.ActionAllow, Principals: []string{"spiffe://cluster.local/ns/default/sa/frontend"}, Methods: []string{"get", "HEAD"}},
+		{Name: "monitoring", Action: authz.ActionAllow, Principals: []string{"spiffe://cluster.local/ns/monitoring/*"}, Ports: []int{9090}},
+		{Name: "node", Action: authz.ActionAllow, Sources: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}},
+	})
+	require.NoError(t, err)
+	require.True(t, p.NeedsPrincipal())
+	require.True(t, p.NeedsHTTP())
+	require.False(t, p.Audit())
+
+	frontend := "spiffe://cluster.local/ns/default/sa/frontend"
+	for _, c := range []struct {
+		name string
+		req  authz.Request
+		want authz.Decision
+	}{
+		{"method allowed", authz.Request{Principal: frontend, HTTP: true, Method: "GET", Path: "/api"}, authz.Decision{Allow: true, Rule: "frontend"}},
+		{"method not allowed", authz.Request{Principal: frontend, HTTP: true, Method: "POST", Path: "/api"}, authz.Decision{Rule: authz.DefaultRule}},
+		{"not http", authz.Request{Principal: frontend}, authz.Decision{Rule: authz.DefaultRule}},
+		{"deny first", authz.Request{Principal: frontend, HTTP: true, Method: "GET", Path: "/admin/users?id=1"}, authz.Decision{Rule: "deny-admin"}},
+		{"path traversal", authz.Request{Principal: frontend, HTTP: true, Method: "GET", Path: "/api/../admin/%75sers"}, authz.Decision{Rule: "deny-admin"}},
+		{"principal prefix", authz.Request{Principal: "spiffe://cluster.local/ns/monitoring/sa/prometheus", Port: 9090}, authz.Decision{Allow: true, Rule: "monitoring"}},
+		{"wrong port", authz.Request{Principal: "spiffe://cluster.local/ns/monitoring/sa/prometheus", Port: 8080}, authz.Decision{Rule: authz.DefaultRule}},
+		{"source", authz.Request{Source: netip.MustParseAddr("10.0.0.7")}, authz.Decision{Allow: true, Rule: "node"}},
+		{"plaintext", authz.Request{Source: netip.MustParseAddr("10.0.1.7"), Port: 9090}, authz.Decision{Rule: authz.DefaultRule}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			require.Equal(t, c.want, p.Evaluate(c.req))
+		})
+	}
+
+	// 带HTTP条件的规则的其余条件匹配时连接必须是HTTP
+	require.True(t, p.NeedsHTTPFor(authz.Request{Port: 22}))
+	scoped, err := authz.New(authz.ModeEnforce, "", []authz.Rule{
+		{Action: authz.ActionDeny, Ports: []int{8080}, Paths: []string{"/admin*"}},
+	})
+	require.NoError(t, err)
+	require.True(t, scoped.NeedsHTTPFor(authz.Request{Port: 8080}))
+	require.False(t, scoped.NeedsHTTPFor(authz.Request{Port: 5432}))
+
+	// 只有L4条件时不需要等待身份和HTTP请求
+	l4, err := authz.New(authz.ModeAudit, "", []authz.Rule{{Action: authz.ActionDeny, Ports: []int{22}}})
+	require.NoError(t, err)
+	require.False(t, l4.NeedsPrincipal())
+	require.False(t, l4.NeedsHTTP())
+	require.True(t, l4.Audit())
+	require.Equal(t, authz.Decision{Rule: "rule-0"}, l4.Evaluate(authz.Request{Port: 22}))
+	require.Equal(t, authz.Decision{Allow: true, Rule: authz.DefaultRule}, l4.Evaluate(authz.Request{Port: 80}))
+}
+
+func TestNewInvalid(t *testing.T) {
+	_, err := authz.New("dryrun", "reject", []authz.Rule{
+		{Name: "a", Action: "permit"},
+		{Name: "b", Action: authz.ActionAllow, Ports: []int{70000}},
+		{Name: "c", Action: authz.ActionAllow, Paths: []string{"api"}},
+	})
+	require.ErrorContains(t, err, `mode "dryrun"`)
+	require.ErrorContains(t, err, `default action "reject"`)
+	require.ErrorContains(t, err, `rule a: action "permit"`)
+	require.ErrorContains(t, err, "rule b: port 70000")
+	require.ErrorContains(t, err, `rule c: path "api"`)
+}
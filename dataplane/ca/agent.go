@@ -0,0 +1,311 @@
+package ca
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	agentRequestTimeout = 10 * time.Second
+	agentMinBackoff     = time.Second
+	agentMaxBackoff     = 30 * time.Second
+)
+
+// Files 证书、私钥和根证书的存放路径，与mtls配置的路径一致。
+// CA是事先分发的根证书(zmesh ca的root-cert.pem)，Agent只读取它作为信任锚，不会写入
+type Files struct {
+	Cert string
+	Key  string
+	CA   string
+}
+
+// Agent sidecar侧的证书代理：向CA申请证书写入文件，有效期过去2/3后轮换。
+// 签发的证书必须由Files.CA中的根签发，CA返回的内容不会改变信任锚。
+// proxy在文件变化后自动重新加载证书，轮换不需要重启
+type Agent struct {
+	address        string
+	namespace      string
+	serviceAccount string
+	files          Files
+	token          string
+	ttl            time.Duration
+	client         *http.Client
+
+	lock sync.Mutex
+	cert *x509.Certificate // 当前使用的证书
+}
+
+type AgentOption func(*Agent)
+
+// WithAgentToken 请求CA时携带的token，需要是CA上为该工作负载配置的token
+func WithAgentToken(token string) AgentOption {
+	return func(a *Agent) {
+		a.token = token
+	}
+}
+
+// WithTTL 申请的证书有效期，为0时由CA决定
+func WithTTL(ttl time.Duration) AgentOption {
+	return func(a *Agent) {
+		a.ttl = ttl
+	}
+}
+
+// NewAgent address为CA的HTTP地址，如http://127.0.0.1:15010
+func NewAgent(address, namespace, serviceAccount string, files Files, opts ...AgentOption) *Agent {
+	a := &Agent{
+		address:        strings.TrimSuffix(address, "/"),
+		namespace:      namespace,
+		serviceAccount: serviceAccount,
+		files:          files,
+		client:         &http.Client{Timeout: agentRequestTimeout},
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// Certificate 当前使用的证书，Ensure成功之前为nil
+func (a *Agent) Certificate() *x509.Certificate {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.cert
+}
+
+// Ensure 保证文件中有可用的证书：已有的证书属于该工作负载且未到轮换时间时直接使用，
+// 否则向CA申请，失败时重试直到ctx结束。根证书不存在时直接返回错误
+func (a *Agent) Ensure(ctx context.Context) error {
+	if _, err := a.trustAnchor(); err != nil {
+		return err
+	}
+	if cert, err := a.cached(); err == nil && time.Now().Before(renewAt(cert)) {
+		a.setCert(cert)
+		logrus.Infof("[Agent] - using cached certificate %s, expires at %s", cert.URIs[0], cert.NotAfter.Format(time.RFC3339))
+		return nil
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logrus.Infof("[Agent] - cached certificate is not usable: %s", err)
+	}
+	return a.fetchWithRetry(ctx)
+}
+
+// Run 在证书有效期过去2/3时轮换，失败后退避重试，ctx结束时返回。需要先调用Ensure
+func (a *Agent) Run(ctx context.Context) error {
+	for {
+		cert := a.Certificate()
+		if cert == nil {
+			return errors.New("no certificate, Ensure must succeed before Run")
+		}
+		timer := time.NewTimer(time.Until(renewAt(cert)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+		if err := a.fetchWithRetry(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (a *Agent) fetchWithRetry(ctx context.Context) error {
+	backoff := agentMinBackoff
+	for {
+		err := a.fetch(ctx)
+		if err == nil {
+			return nil
+		}
+		logrus.Errorf("[Agent] - error requesting certificate from %s, retrying in %s: %s", a.address, backoff, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w, last error: %w", ctx.Err(), err)
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, agentMaxBackoff)
+	}
+}
+
+// fetch 生成新的私钥和CSR，向CA申请证书，校验后写入文件
+func (a *Agent) fetch(ctx context.Context) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		return err
+	}
+	req := SignRequest{
+		Namespace:      a.namespace,
+		ServiceAccount: a.serviceAccount,
+		CSR:            string(pemBlock("CERTIFICATE REQUEST", csrDER)),
+	}
+	if a.ttl > 0 {
+		req.TTL = a.ttl.String()
+	}
+	resp, err := a.post(ctx, req)
+	if err != nil {
+		return err
+	}
+	caPEM, err := a.trustAnchor()
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pemBlock("PRIVATE KEY", keyDER)
+	cert, err := verify([]byte(resp.Certificate), keyPEM, caPEM)
+	if err != nil {
+		return fmt.Errorf("ca returned an invalid certificate: %w", err)
+	}
+	// 私钥和证书分别替换，proxy读到不匹配的一对时会继续使用旧证书并在稍后重试
+	for _, f := range []struct {
+		path string
+		data []byte
+		perm os.FileMode
+	}{
+		{a.files.Key, keyPEM, 0o600},
+		{a.files.Cert, []byte(resp.Certificate), 0o644},
+	} {
+		if err := writeFile(f.path, f.data, f.perm); err != nil {
+			return err
+		}
+	}
+	a.setCert(cert)
+	logrus.Infof("[Agent] - certificate %s issued, expires at %s", resp.SpiffeID, cert.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+func (a *Agent) post(ctx context.Context, sr SignRequest) (SignResponse, error) {
+	body, err := json.Marshal(sr)
+	if err != nil {
+		return SignResponse{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.address+"/v1/certificates", bytes.NewReader(body))
+	if err != nil {
+		return SignResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return SignResponse{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return SignResponse{}, fmt.Errorf("ca responded %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var res SignResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return SignResponse{}, err
+	}
+	return res, nil
+}
+
+// trustAnchor 事先分发的根证书
+func (a *Agent) trustAnchor() ([]byte, error) {
+	data, err := os.ReadFile(a.files.CA)
+	if err != nil {
+		return nil, fmt.Errorf("error reading trust anchor, the ca root certificate must be provisioned before requesting certificates: %w", err)
+	}
+	return data, nil
+}
+
+// cached 读取文件中已有的证书，检查其与私钥匹配、由根证书签发并且属于该工作负载
+func (a *Agent) cached() (*x509.Certificate, error) {
+	certPEM, err := os.ReadFile(a.files.Cert)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(a.files.Key)
+	if err != nil {
+		return nil, err
+	}
+	caPEM, err := a.trustAnchor()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := verify(certPEM, keyPEM, caPEM)
+	if err != nil {
+		return nil, err
+	}
+	id, err := ParseID(cert.URIs[0].String())
+	if err != nil {
+		return nil, err
+	}
+	if id.Namespace != a.namespace || id.ServiceAccount != a.serviceAccount {
+		return nil, fmt.Errorf("certificate belongs to %s", id)
+	}
+	return cert, nil
+}
+
+func (a *Agent) setCert(cert *x509.Certificate) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.cert = cert
+}
+
+// verify 检查证书与私钥匹配、由caPEM中的根签发、处于有效期内并且带有SPIFFE ID
+func verify(certPEM, keyPEM, caPEM []byte) (*x509.Certificate, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("no root certificate")
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		return nil, err
+	}
+	if len(cert.URIs) == 0 {
+		return nil, errors.New("certificate has no spiffe id")
+	}
+	return cert, nil
+}
+
+// renewAt 有效期过去2/3的时间
+func renewAt(cert *x509.Certificate) time.Time {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotBefore.Add(lifetime * 2 / 3)
+}
+
+// decodeCertificate 解析PEM中的第一张证书
+func decodeCertificate(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,280 @@
+// Package ca 本地的证书颁发机构：生成并保存根证书，为工作负载签发短期的SPIFFE证书，
+// 以及sidecar侧申请、缓存并在过期前轮换证书的Agent
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultTrustDomain = "cluster.local"
+	// DefaultTTL 工作负载证书默认的有效期
+	DefaultTTL = 24 * time.Hour
+	// DefaultMaxTTL 工作负载可以申请的最长有效期
+	DefaultMaxTTL = 7 * 24 * time.Hour
+
+	rootValidity = 10 * 365 * 24 * time.Hour
+	// clockSkew 签发的证书提前生效的时间，避免节点之间的时钟误差导致证书尚未生效
+	clockSkew = time.Minute
+
+	rootCertFile = "root-cert.pem"
+	rootKeyFile  = "root-key.pem"
+)
+
+// ID 工作负载的SPIFFE ID：spiffe://<trust-domain>/ns/<namespace>/sa/<service-account>
+type ID struct {
+	TrustDomain    string
+	Namespace      string
+	ServiceAccount string
+}
+
+var (
+	trustDomainPattern = regexp.MustCompile(`^[a-z0-9._-]+$`)
+	segmentPattern     = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+)
+
+func (id ID) String() string {
+	return fmt.Sprintf("spiffe://%s/ns/%s/sa/%s", id.TrustDomain, id.Namespace, id.ServiceAccount)
+}
+
+func (id ID) URL() *url.URL {
+	return &url.URL{Scheme: "spiffe", Host: id.TrustDomain, Path: fmt.Sprintf("/ns/%s/sa/%s", id.Namespace, id.ServiceAccount)}
+}
+
+func (id ID) Validate() error {
+	if !trustDomainPattern.MatchString(id.TrustDomain) {
+		return fmt.Errorf("invalid trust domain %q", id.TrustDomain)
+	}
+	if !segmentPattern.MatchString(id.Namespace) {
+		return fmt.Errorf("invalid namespace %q", id.Namespace)
+	}
+	if !segmentPattern.MatchString(id.ServiceAccount) {
+		return fmt.Errorf("invalid service account %q", id.ServiceAccount)
+	}
+	return nil
+}
+
+// ParseID 解析spiffe://<trust-domain>/ns/<namespace>/sa/<service-account>形式的ID
+func ParseID(s string) (ID, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return ID{}, err
+	}
+	parts := strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
+	if u.Scheme != "spiffe" || len(parts) != 4 || parts[0] != "ns" || parts[2] != "sa" {
+		return ID{}, fmt.Errorf("%q is not a spiffe://<trust-domain>/ns/<ns>/sa/<sa> id", s)
+	}
+	id := ID{TrustDomain: u.Host, Namespace: parts[1], ServiceAccount: parts[3]}
+	return id, id.Validate()
+}
+
+// CA 持有根证书和私钥，为同一个trust domain下的工作负载签发证书
+type CA struct {
+	TrustDomain string
+	MaxTTL      time.Duration
+
+	cert    *x509.Certificate
+	certPEM []byte
+	key     crypto.Signer
+}
+
+// LoadOrCreate 从dir中加载根证书和私钥，不存在时生成新的根并写入dir
+func LoadOrCreate(dir, trustDomain string) (*CA, error) {
+	if !trustDomainPattern.MatchString(trustDomain) {
+		return nil, fmt.Errorf("invalid trust domain %q", trustDomain)
+	}
+	certPath, keyPath := filepath.Join(dir, rootCertFile), filepath.Join(dir, rootKeyFile)
+	certPEM, err := os.ReadFile(certPath)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := createRoot(dir, trustDomain); err != nil {
+			return nil, fmt.Errorf("error creating root: %w", err)
+		}
+		certPEM, err = os.ReadFile(certPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, fmt.Errorf("no certificate found in %s", certPath)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, fmt.Errorf("no private key found in %s", keyPath)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported root key type %T", key)
+	}
+	return &CA{TrustDomain: trustDomain, MaxTTL: DefaultMaxTTL, cert: cert, certPEM: certPEM, key: signer}, nil
+}
+
+func createRoot(dir, trustDomain string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"zmesh"}, CommonName: "zmesh root ca"},
+		NotBefore:             now.Add(-clockSkew),
+		NotAfter:              now.Add(rootValidity),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		URIs:                  []*url.URL{{Scheme: "spiffe", Host: trustDomain}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	// 先写私钥，证书文件存在即表示根已经完整生成
+	if err := writeFile(filepath.Join(dir, rootKeyFile), pemBlock("PRIVATE KEY", keyDER), 0o600); err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(dir, rootCertFile), pemBlock("CERTIFICATE", der), 0o644)
+}
+
+// RootPEM 根证书，工作负载用它校验对端
+func (ca *CA) RootPEM() []byte {
+	return ca.certPEM
+}
+
+// Sign 按CSR中的公钥为id签发证书。CSR中的主题和SAN都会被忽略，证书只包含id，
+// ttl为0时使用DefaultTTL，超过MaxTTL或根证书有效期的部分会被截断
+func (ca *CA) Sign(csr *x509.CertificateRequest, id ID, ttl time.Duration) ([]byte, error) {
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid csr signature: %w", err)
+	}
+	if err := id.Validate(); err != nil {
+		return nil, err
+	}
+	if id.TrustDomain != ca.TrustDomain {
+		return nil, fmt.Errorf("trust domain %q is not served by this ca", id.TrustDomain)
+	}
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	if ca.MaxTTL > 0 && ttl > ca.MaxTTL {
+		ttl = ca.MaxTTL
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	notAfter := now.Add(ttl)
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+	// 有效期很短时少提前一些，否则提前的部分占了大半有效期，Agent会立即轮换
+	skew := min(clockSkew, ttl/4)
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"zmesh"}},
+		NotBefore:    now.Add(-skew),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		URIs:         []*url.URL{id.URL()},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	return pemBlock("CERTIFICATE", der), nil
+}
+
+// Issue 为id生成新的私钥并签发证书，用于离线签发，返回PEM格式的证书和PKCS8私钥
+func (ca *CA) Issue(id ID, ttl time.Duration) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM, err = ca.Sign(csr, id, ttl)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, pemBlock("PRIVATE KEY", keyDER), nil
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func pemBlock(typ string, der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+}
+
+// writeFile 先写临时文件再rename，读取方不会看到写了一半的文件
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
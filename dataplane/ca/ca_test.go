@@ -0,0 +1,237 @@
+package ca_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SMALL-head/zmesh/dataplane/ca"
+	"github.com/SMALL-head/zmesh/dataplane/mtls"
+	"github.com/stretchr/testify/require"
+)
+
+func parseCert(t *testing.T, data []byte) *x509.Certificate {
+	block, _ := pem.Decode(data)
+	require.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	return cert
+}
+
+func newCSR(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+}
+
+func TestIssue(t *testing.T) {
+	dir := t.TempDir()
+	c, err := ca.LoadOrCreate(dir, "cluster.local")
+	require.NoError(t, err)
+	// 再次加载使用同一个根
+	again, err := ca.LoadOrCreate(dir, "cluster.local")
+	require.NoError(t, err)
+	require.Equal(t, c.RootPEM(), again.RootPEM())
+
+	id := ca.ID{TrustDomain: "cluster.local", Namespace: "default", ServiceAccount: "reviews"}
+	certPEM, _, err := c.Issue(id, 10*24*time.Hour)
+	require.NoError(t, err)
+	cert := parseCert(t, certPEM)
+	require.Equal(t, "spiffe://cluster.local/ns/default/sa/reviews", cert.URIs[0].String())
+	// 超过MaxTTL的部分被截断
+	require.WithinDuration(t, time.Now().Add(ca.DefaultMaxTTL), cert.NotAfter, time.Minute)
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(c.RootPEM())
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	require.NoError(t, err)
+
+	_, _, err = c.Issue(ca.ID{TrustDomain: "other.local", Namespace: "default", ServiceAccount: "reviews"}, 0)
+	require.ErrorContains(t, err, "not served by this ca")
+	_, _, err = c.Issue(ca.ID{TrustDomain: "cluster.local", Namespace: "default", ServiceAccount: "a/b"}, 0)
+	require.ErrorContains(t, err, "invalid service account")
+}
+
+func TestParseID(t *testing.T) {
+	id, err := ca.ParseID("spiffe://cluster.local/ns/default/sa/reviews")
+	require.NoError(t, err)
+	require.Equal(t, ca.ID{TrustDomain: "cluster.local", Namespace: "default", ServiceAccount: "reviews"}, id)
+
+	for _, s := range []string{
+		"https://cluster.local/ns/default/sa/reviews",
+		"spiffe://cluster.local/ns/default",
+		"spiffe://cluster.local/sa/reviews/ns/default",
+		"spiffe://Cluster.Local/ns/default/sa/reviews",
+	} {
+		_, err := ca.ParseID(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestParseTokens(t *testing.T) {
+	tokens, err := ca.ParseTokens(strings.NewReader("# reviews\nsecret default/reviews\n\n  ns-token  prod/*\n"))
+	require.NoError(t, err)
+	require.Equal(t, map[string]ca.Grant{
+		"secret":   {Namespace: "default", ServiceAccount: "reviews"},
+		"ns-token": {Namespace: "prod", ServiceAccount: "*"},
+	}, tokens)
+
+	for data, msg := range map[string]string{
+		"":                                     "no token",
+		"secret\n":                             "line 1",
+		"secret default\n":                     `invalid identity "default"`,
+		"secret */reviews\n":                   `invalid identity "*/reviews"`,
+		"a default/reviews\na default/ratings": "line 2: duplicate token",
+	} {
+		_, err := ca.ParseTokens(strings.NewReader(data))
+		require.ErrorContains(t, err, msg, data)
+	}
+}
+
+func TestServer(t *testing.T) {
+	c, err := ca.LoadOrCreate(t.TempDir(), "cluster.local")
+	require.NoError(t, err)
+	srv := httptest.NewServer(ca.NewServer(c, "", ca.WithTokens(map[string]ca.Grant{
+		"secret":   {Namespace: "default", ServiceAccount: "reviews"},
+		"ns-token": {Namespace: "prod", ServiceAccount: "*"},
+	})).Handler())
+	defer srv.Close()
+
+	post := func(token string, req ca.SignRequest) *http.Response {
+		body, err := json.Marshal(req)
+		require.NoError(t, err)
+		r, err := http.NewRequest(http.MethodPost, srv.URL+"/v1/certificates", bytes.NewReader(body))
+		require.NoError(t, err)
+		r.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(r)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	req := ca.SignRequest{Namespace: "default", ServiceAccount: "reviews", CSR: newCSR(t), TTL: "1h"}
+	require.Equal(t, http.StatusUnauthorized, post("wrong", req).StatusCode)
+	require.Equal(t, http.StatusUnauthorized, post("", req).StatusCode)
+	// token只能申请对应的身份
+	require.Equal(t, http.StatusForbidden, post("ns-token", req).StatusCode)
+	require.Equal(t, http.StatusForbidden, post("secret", ca.SignRequest{Namespace: "default", ServiceAccount: "ratings", CSR: newCSR(t)}).StatusCode)
+	require.Equal(t, http.StatusOK, post("ns-token", ca.SignRequest{Namespace: "prod", ServiceAccount: "ratings", CSR: newCSR(t)}).StatusCode)
+
+	resp := post("secret", req)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var sr ca.SignResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&sr))
+	require.Equal(t, "spiffe://cluster.local/ns/default/sa/reviews", sr.SpiffeID)
+	require.WithinDuration(t, time.Now().Add(time.Hour), sr.ExpiresAt, time.Minute)
+	require.Equal(t, sr.ExpiresAt.Unix(), parseCert(t, []byte(sr.Certificate)).NotAfter.Unix())
+
+	req.CSR = "not a csr"
+	require.Equal(t, http.StatusBadRequest, post("secret", req).StatusCode)
+
+	root, err := http.Get(srv.URL + "/v1/root")
+	require.NoError(t, err)
+	defer root.Body.Close()
+	require.Equal(t, http.StatusOK, root.StatusCode)
+
+	// 没有配置token时拒绝所有签发请求
+	open := httptest.NewServer(ca.NewServer(c, "").Handler())
+	defer open.Close()
+	body, err := json.Marshal(req)
+	require.NoError(t, err)
+	resp, err = http.Post(open.URL+"/v1/certificates", "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+// startCA 启动签发API，token default-token可以申请default下的任意身份
+func startCA(t *testing.T, c *ca.CA, requests *atomic.Int32) string {
+	handler := ca.NewServer(c, "", ca.WithTokens(map[string]ca.Grant{"default-token": {Namespace: "default", ServiceAccount: "*"}})).Handler()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestAgent(t *testing.T) {
+	c, err := ca.LoadOrCreate(t.TempDir(), "cluster.local")
+	require.NoError(t, err)
+	var requests atomic.Int32
+	addr := startCA(t, c, &requests)
+	token := ca.WithAgentToken("default-token")
+
+	dir := t.TempDir()
+	files := ca.Files{Cert: filepath.Join(dir, "cert.pem"), Key: filepath.Join(dir, "key.pem"), CA: filepath.Join(dir, "ca.pem")}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// 根证书需要事先分发
+	a := ca.NewAgent(addr, "default", "reviews", files, token, ca.WithTTL(3*time.Second))
+	require.ErrorContains(t, a.Ensure(ctx), "trust anchor")
+	require.Zero(t, requests.Load())
+	require.NoError(t, os.WriteFile(files.CA, c.RootPEM(), 0o644))
+
+	require.NoError(t, a.Ensure(ctx))
+	require.EqualValues(t, 1, requests.Load())
+	first := a.Certificate()
+	require.Equal(t, "spiffe://cluster.local/ns/default/sa/reviews", first.URIs[0].String())
+	creds, err := mtls.Load(files.Cert, files.Key, files.CA)
+	require.NoError(t, err)
+	require.NotNil(t, creds)
+	info, err := os.Stat(files.Key)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	// 重启后直接使用文件中未到轮换时间的证书
+	restarted := ca.NewAgent(addr, "default", "reviews", files, token, ca.WithTTL(3*time.Second))
+	require.NoError(t, restarted.Ensure(ctx))
+	require.EqualValues(t, 1, requests.Load())
+	require.Equal(t, first.SerialNumber, restarted.Certificate().SerialNumber)
+
+	// 其他工作负载的证书不会被复用
+	other := ca.NewAgent(addr, "default", "ratings", files, token)
+	require.NoError(t, other.Ensure(ctx))
+	require.EqualValues(t, 2, requests.Load())
+
+	// 其他根签发的证书不被接受，根证书也不会被替换
+	rogue, err := ca.LoadOrCreate(t.TempDir(), "cluster.local")
+	require.NoError(t, err)
+	var rogueRequests atomic.Int32
+	rogueCtx, rogueCancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer rogueCancel()
+	require.NoError(t, os.Remove(files.Cert))
+	err = ca.NewAgent(startCA(t, rogue, &rogueRequests), "default", "reviews", files, token).Ensure(rogueCtx)
+	require.ErrorContains(t, err, "invalid certificate")
+	require.Positive(t, rogueRequests.Load())
+	root, err := os.ReadFile(files.CA)
+	require.NoError(t, err)
+	require.Equal(t, c.RootPEM(), root)
+
+	// 有效期过去2/3后轮换
+	done := make(chan error, 1)
+	go func() { done <- a.Run(ctx) }()
+	require.Eventually(t, func() bool {
+		data, err := os.ReadFile(files.Cert)
+		return err == nil && parseCert(t, data).URIs[0].String() == "spiffe://cluster.local/ns/default/sa/reviews" &&
+			a.Certificate().SerialNumber.Cmp(first.SerialNumber) != 0
+	}, 5*time.Second, 50*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+}
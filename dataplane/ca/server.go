@@ -0,0 +1,232 @@
+package ca
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxRequestSize 签发请求的最大长度，CSR通常只有几百字节
+const maxRequestSize = 64 << 10
+
+// SignRequest POST /v1/certificates的请求，trust domain由CA决定
+type SignRequest struct {
+	Namespace      string `json:"namespace"`
+	ServiceAccount string `json:"service_account"`
+	CSR            string `json:"csr"`           // PEM格式的CSR
+	TTL            string `json:"ttl,omitempty"` // 如"24h"，为空时使用CA的默认值
+}
+
+// SignResponse 签发的PEM格式证书。不包含根证书，Agent只用事先配置的根校验签发的证书
+type SignResponse struct {
+	SpiffeID    string    `json:"spiffe_id"`
+	Certificate string    `json:"certificate"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// Grant 一个token可以申请的身份，ServiceAccount为*时可以申请namespace下任意的service account
+type Grant struct {
+	Namespace      string
+	ServiceAccount string
+}
+
+func (g Grant) String() string {
+	return g.Namespace + "/" + g.ServiceAccount
+}
+
+func (g Grant) allows(namespace, serviceAccount string) bool {
+	return g.Namespace == namespace && (g.ServiceAccount == "*" || g.ServiceAccount == serviceAccount)
+}
+
+// Server CA的HTTP API。签发请求需要带上Authorization: Bearer <token>，并且只能申请该token对应的身份
+type Server struct {
+	ca     *CA
+	tokens map[string]Grant
+	srv    *http.Server
+}
+
+type ServerOption func(*Server)
+
+// WithTokens 可以使用的token以及各自能申请的身份，没有配置时拒绝所有签发请求
+func WithTokens(tokens map[string]Grant) ServerOption {
+	return func(s *Server) {
+		s.tokens = tokens
+	}
+}
+
+// LoadTokens 读取token文件，每行为"<token> <namespace>/<service-account>"，空行和#开头的行被忽略
+func LoadTokens(path string) (map[string]Grant, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tokens, err := ParseTokens(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return tokens, nil
+}
+
+// ParseTokens 解析LoadTokens的文件格式
+func ParseTokens(r io.Reader) (map[string]Grant, error) {
+	tokens := make(map[string]Grant)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want \"<token> <namespace>/<service-account>\"", n)
+		}
+		ns, sa, _ := strings.Cut(fields[1], "/")
+		if !segmentPattern.MatchString(ns) || (sa != "*" && !segmentPattern.MatchString(sa)) {
+			return nil, fmt.Errorf("line %d: invalid identity %q", n, fields[1])
+		}
+		if _, ok := tokens[fields[0]]; ok {
+			return nil, fmt.Errorf("line %d: duplicate token", n)
+		}
+		tokens[fields[0]] = Grant{Namespace: ns, ServiceAccount: sa}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("no token")
+	}
+	return tokens, nil
+}
+
+func NewServer(ca *CA, addr string, opts ...ServerOption) *Server {
+	s := &Server{ca: ca}
+	for _, opt := range opts {
+		opt(s)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/certificates", s.handleSign)
+	mux.HandleFunc("/v1/root", s.handleRoot)
+	s.srv = &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s
+}
+
+// Handler 返回API的路由，便于测试
+func (s *Server) Handler() http.Handler {
+	return s.srv.Handler
+}
+
+// Start 阻塞运行API，Shutdown之后返回nil
+func (s *Server) Start() error {
+	logrus.Infof("starting ca server for %s on %s", s.ca.TrustDomain, s.srv.Addr)
+	if err := s.srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+// grant 请求携带的token对应的身份
+func (s *Server) grant(r *http.Request) (Grant, bool) {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || got == "" {
+		return Grant{}, false
+	}
+	var grant Grant
+	found := false
+	// 逐个比较所有token，耗时与token是否存在无关
+	for token, g := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+			grant, found = g, true
+		}
+	}
+	return grant, found
+}
+
+func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	_, _ = w.Write(s.ca.RootPEM())
+}
+
+func (s *Server) handleSign(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	grant, ok := s.grant(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req SignRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %s", err), http.StatusBadRequest)
+		return
+	}
+	if !grant.allows(req.Namespace, req.ServiceAccount) {
+		logrus.Warnf("[handleSign] - rejecting request for %s/%s from %s: token is granted %s", req.Namespace, req.ServiceAccount, r.RemoteAddr, grant)
+		http.Error(w, "token is not allowed to request this identity", http.StatusForbidden)
+		return
+	}
+	resp, err := s.sign(req)
+	if err != nil {
+		logrus.Warnf("[handleSign] - rejecting request for %s/%s from %s: %s", req.Namespace, req.ServiceAccount, r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logrus.Infof("[handleSign] - issued %s to %s, expires at %s", resp.SpiffeID, r.RemoteAddr, resp.ExpiresAt.Format(time.RFC3339))
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) sign(req SignRequest) (SignResponse, error) {
+	id := ID{TrustDomain: s.ca.TrustDomain, Namespace: req.Namespace, ServiceAccount: req.ServiceAccount}
+	var ttl time.Duration
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			return SignResponse{}, fmt.Errorf("invalid ttl: %w", err)
+		}
+		ttl = d
+	}
+	block, _ := pem.Decode([]byte(req.CSR))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return SignResponse{}, errors.New("csr is not a PEM encoded certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return SignResponse{}, err
+	}
+	certPEM, err := s.ca.Sign(csr, id, ttl)
+	if err != nil {
+		return SignResponse{}, err
+	}
+	cert, err := decodeCertificate(certPEM)
+	if err != nil {
+		return SignResponse{}, err
+	}
+	return SignResponse{
+		SpiffeID:    id.String(),
+		Certificate: string(certPEM),
+		ExpiresAt:   cert.NotAfter,
+	}, nil
+}
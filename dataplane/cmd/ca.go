@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/SMALL-head/zmesh/dataplane/ca"
+	"github.com/spf13/cobra"
+)
+
+// newCACommand 本地CA：serve提供签发证书的HTTP API，issue离线为工作负载签发证书
+func newCACommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:   "ca",
+		Short: "本地证书颁发机构，为工作负载签发SPIFFE证书",
+	}
+
+	var dir, trustDomain string
+	command.PersistentFlags().StringVar(&dir, "dir", "/var/lib/zmesh/ca", "根证书和私钥的目录，不存在时自动生成")
+	command.PersistentFlags().StringVar(&trustDomain, "trust-domain", ca.DefaultTrustDomain, "签发的SPIFFE ID使用的trust domain")
+
+	var listen, tokensFile string
+	var maxTTL time.Duration
+	serve := &cobra.Command{
+		Use:   "serve",
+		Short: "启动签发证书的HTTP API",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			tokens, err := ca.LoadTokens(tokensFile)
+			if err != nil {
+				return err
+			}
+			c, err := ca.LoadOrCreate(dir, trustDomain)
+			if err != nil {
+				return err
+			}
+			c.MaxTTL = maxTTL
+			s := ca.NewServer(c, listen, ca.WithTokens(tokens))
+
+			ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer stop()
+			go func() {
+				<-ctx.Done()
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+				defer cancel()
+				_ = s.Shutdown(shutdownCtx)
+			}()
+			return s.Start()
+		},
+	}
+	serve.Flags().StringVar(&listen, "listen", "127.0.0.1:15010", "API监听地址")
+	serve.Flags().StringVar(&tokensFile, "tokens-file", "", "token文件，每行为\"<token> <namespace>/<service-account>\"，token只能申请对应的身份")
+	serve.Flags().DurationVar(&maxTTL, "max-ttl", ca.DefaultMaxTTL, "工作负载可以申请的最长有效期")
+	_ = serve.MarkFlagRequired("tokens-file")
+	command.AddCommand(serve)
+
+	var namespace, serviceAccount, out string
+	var ttl time.Duration
+	issue := &cobra.Command{
+		Use:   "issue",
+		Short: "离线签发一张工作负载证书，写入cert.pem、key.pem和ca.pem",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			c, err := ca.LoadOrCreate(dir, trustDomain)
+			if err != nil {
+				return err
+			}
+			id := ca.ID{TrustDomain: trustDomain, Namespace: namespace, ServiceAccount: serviceAccount}
+			certPEM, keyPEM, err := c.Issue(id, ttl)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(out, 0o755); err != nil {
+				return err
+			}
+			for _, f := range []struct {
+				name string
+				data []byte
+				perm os.FileMode
+			}{
+				{"key.pem", keyPEM, 0o600},
+				{"cert.pem", certPEM, 0o644},
+				{"ca.pem", c.RootPEM(), 0o644},
+			} {
+				if err := os.WriteFile(filepath.Join(out, f.name), f.data, f.perm); err != nil {
+					return err
+				}
+			}
+			cmd.Printf("issued %s to %s\n", id, out)
+			return nil
+		},
+	}
+	issue.Flags().StringVar(&namespace, "namespace", "default", "工作负载所在的namespace")
+	issue.Flags().StringVar(&serviceAccount, "service-account", "", "工作负载的service account")
+	issue.Flags().DurationVar(&ttl, "ttl", ca.DefaultTTL, "证书有效期")
+	issue.Flags().StringVar(&out, "out", ".", "证书的输出目录")
+	_ = issue.MarkFlagRequired("service-account")
+	command.AddCommand(issue)
+
+	return command
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/SMALL-head/zmesh/dataplane/config"
+	"github.com/spf13/cobra"
+)
+
+func newConfigCommand(configPath *string) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "config",
+		Short: "配置文件相关操作",
+	}
+	command.AddCommand(&cobra.Command{
+		Use:   "validate [file]",
+		Short: "离线检查配置，列出所有问题",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := *configPath
+			if len(args) == 1 {
+				path = args[0]
+			}
+			cmd.SilenceUsage = true
+			return validateConfig(cmd, path)
+		},
+	})
+	return command
+}
+
+// validateConfig 与启动时一样合并命令行参数、环境变量和配置文件后再检查，path为空时只检查默认值与覆盖项
+func validateConfig(cmd *cobra.Command, path string) error {
+	name := path
+	if name == "" {
+		name = "config"
+	}
+	var problems []error
+	cfg, err := config.Load(path, cmd.Flags())
+	var unknown *config.UnknownFieldsError
+	if errors.As(err, &unknown) {
+		for _, f := range unknown.Fields {
+			problems = append(problems, fmt.Errorf("%s: unknown field", f))
+		}
+	} else if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		problems = append(problems, unwrapJoined(err)...)
+	}
+	if len(problems) > 0 {
+		for _, e := range problems {
+			cmd.PrintErrf("  - %s\n", e)
+		}
+		return fmt.Errorf("%s: %d problems found", name, len(problems))
+	}
+	cmd.Printf("%s: ok\n", name)
+	return nil
+}
+
+// unwrapJoined 展开errors.Join合并的错误
+func unwrapJoined(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
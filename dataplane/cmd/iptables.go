@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/SMALL-head/zmesh/dataplane/config"
+	"github.com/SMALL-head/zmesh/dataplane/interception"
+	"github.com/SMALL-head/zmesh/dataplane/iptables"
+	"github.com/SMALL-head/zmesh/dataplane/nftables"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// newIptablesCommand 安装/删除流量拦截规则，setup用作k8s的init container，cleanup用作pre-stop。
+// 实际使用iptables还是nftables由interception.backend决定
+func newIptablesCommand(configPath *string) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "iptables",
+		Short: "安装或删除流量拦截规则(iptables或nftables)",
+	}
+
+	var dryRun bool
+	setup := &cobra.Command{
+		Use:   "setup",
+		Short: "按配置原子地安装sidecar拦截规则",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			cfg, err := loadValidConfig(*configPath, cmd)
+			if err != nil {
+				return err
+			}
+			spec := interceptionSpec(cfg)
+			name := resolveBackend(cfg.Interception.Backend)
+			if dryRun {
+				return printRules(cmd, name, spec)
+			}
+			b, err := newBackend(name)
+			if err != nil {
+				return err
+			}
+			if err := b.Apply(spec); err != nil {
+				return err
+			}
+			logrus.Infof("interception rules installed by %s, outbound -> %d, inbound -> %d",
+				b.Name(), cfg.OutBoundConfig.Port, cfg.InBoundConfig.Port)
+			return nil
+		},
+	}
+	setup.Flags().BoolVar(&dryRun, "dry-run", false, "只打印渲染出的规则(iptables-restore或nft -f的输入)，不实际安装")
+	command.AddCommand(setup)
+
+	var reportOnly bool
+	reconcile := &cobra.Command{
+		Use:   "reconcile",
+		Short: "比较当前规则与配置，只修复不一致的部分",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			cfg, err := loadValidConfig(*configPath, cmd)
+			if err != nil {
+				return err
+			}
+			b, err := newBackend(resolveBackend(cfg.Interception.Backend))
+			if err != nil {
+				return err
+			}
+			var drifts []interception.Drift
+			if reportOnly {
+				drifts, err = b.Diff(interceptionSpec(cfg))
+			} else {
+				drifts, err = b.Reconcile(interceptionSpec(cfg))
+			}
+			for _, d := range drifts {
+				cmd.Println(d)
+			}
+			if err != nil {
+				return err
+			}
+			if len(drifts) == 0 {
+				cmd.Println("no drift")
+			}
+			return nil
+		},
+	}
+	reconcile.Flags().BoolVar(&reportOnly, "dry-run", false, "只报告不一致的规则，不做修改")
+	command.AddCommand(reconcile)
+
+	command.AddCommand(&cobra.Command{
+		Use:   "cleanup",
+		Short: "删除zmesh安装的拦截规则",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			cfg, err := config.Load(*configPath, cmd.Flags())
+			if err != nil {
+				return err
+			}
+			b, err := newBackend(resolveBackend(cfg.Interception.Backend))
+			if err != nil {
+				return err
+			}
+			if err := b.Cleanup(interceptionSpec(cfg)); err != nil {
+				return err
+			}
+			logrus.Infof("interception rules removed by %s", b.Name())
+			return nil
+		},
+	})
+	return command
+}
+
+// loadValidConfig 按启动时相同的优先级加载配置并检查
+func loadValidConfig(path string, cmd *cobra.Command) (config.BootStrapConfig, error) {
+	cfg, err := config.Load(path, cmd.Flags())
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.Validate()
+}
+
+func interceptionSpec(cfg config.BootStrapConfig) interception.Spec {
+	ic := cfg.Interception
+	var cidrs []string
+	for _, c := range []string{ic.PodCIDR, ic.PodCIDR6} {
+		if c != "" {
+			cidrs = append(cidrs, c)
+		}
+	}
+	return interception.Spec{
+		OutboundPort:         cfg.OutBoundConfig.Port,
+		InboundPort:          cfg.InBoundConfig.Port,
+		InboundMode:          ic.InboundMode,
+		TProxyMark:           ic.TProxyMark,
+		TProxyTable:          ic.TProxyTable,
+		ProxyMark:            ic.ProxyMark,
+		ProxyUID:             ic.ProxyUID,
+		ProxyGID:             ic.ProxyGID,
+		ExemptUIDs:           ic.ExemptUIDs,
+		ExemptGIDs:           ic.ExemptGIDs,
+		CaptureCIDRs:         append(cidrs, ic.IncludeOutboundCIDRs...),
+		ExcludeOutboundCIDRs: ic.ExcludeOutboundCIDRs,
+		IncludeInboundPorts:  ic.IncludeInboundPorts,
+		IncludeOutboundPorts: ic.IncludeOutboundPorts,
+		ExcludeInboundPorts:  ic.ExcludeInboundPorts,
+		ExcludeOutboundPorts: ic.ExcludeOutboundPorts,
+	}
+}
+
+// resolveBackend 把auto解析为实际使用的后端：iptables命令存在且能读取nat表时使用iptables，
+// 否则(如镜像中没有iptables，或内核只支持nftables)在能读取nftables规则时使用nftables
+func resolveBackend(name string) string {
+	if name != "" && name != "auto" {
+		return name
+	}
+	m, err := iptables.New("zmesh")
+	if err == nil {
+		if _, err = m.Ipt.ListChains("nat"); err == nil {
+			return "iptables"
+		}
+	}
+	if nft, nftErr := nftables.New(); nftErr == nil && nft.Available() {
+		logrus.Infof("iptables is not usable, falling back to nftables: %s", err)
+		return "nftables"
+	}
+	// 两者都不可用时使用iptables，报告iptables的错误
+	logrus.Warnf("neither iptables nor nftables is usable: %s", err)
+	return "iptables"
+}
+
+func newBackend(name string) (interception.Backend, error) {
+	switch name {
+	case "iptables":
+		m, err := iptables.New("zmesh")
+		if err != nil {
+			return nil, err
+		}
+		return &m, nil
+	case "nftables":
+		m, err := nftables.New()
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("unknown interception backend %q", name)
+	}
+}
+
+// printRules 打印ipv4和ipv6两个地址族的规则
+func printRules(cmd *cobra.Command, backend string, spec interception.Spec) error {
+	for _, ipv6 := range []bool{false, true} {
+		switch backend {
+		case "iptables":
+			rs, err := iptables.Render(spec, ipv6)
+			if err != nil {
+				return err
+			}
+			bin := "iptables"
+			if ipv6 {
+				bin = "ip6tables"
+			}
+			cmd.Printf("# %s-restore --noflush\n%s", bin, rs)
+		case "nftables":
+			rs, err := nftables.Render(spec, ipv6)
+			if err != nil {
+				return err
+			}
+			cmd.Printf("# nft -f\n%s", rs)
+		default:
+			return fmt.Errorf("unknown interception backend %q", backend)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/SMALL-head/zmesh/dataplane/admin"
+	"github.com/SMALL-head/zmesh/dataplane/config"
+	"github.com/SMALL-head/zmesh/dataplane/proxy"
+	"github.com/sirupsen/logrus"
+)
+
+// adminShutdownTimeout 关闭admin服务时等待正在处理的请求的时间
+const adminShutdownTimeout = 5 * time.Second
+
+// lifecycle 统一处理退出信号，协调inbound/outbound两个引擎以及admin服务的关闭
+type lifecycle struct {
+	drainTimeout time.Duration
+	proxies      []*proxy.Proxy
+	admin        *admin.Server
+
+	drainOnce sync.Once
+}
+
+func newLifecycle(drainTimeout time.Duration, proxies ...*proxy.Proxy) *lifecycle {
+	if drainTimeout <= 0 {
+		drainTimeout = config.DefaultDrainTimeout
+	}
+	return &lifecycle{
+		drainTimeout: drainTimeout,
+		proxies:      proxies,
+	}
+}
+
+// Drain 所有listener进入排空状态，readiness随之失败
+func (l *lifecycle) Drain() {
+	for _, p := range l.proxies {
+		p.Drain()
+	}
+}
+
+// Run 阻塞直到收到SIGINT/SIGTERM，然后执行优雅关闭；ctx结束(例如某个listener启动失败)时也会关闭其余组件
+func (l *lifecycle) Run(ctx context.Context) error {
+	stopCh := make(chan os.Signal, 1)
+	signal.Notify(stopCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stopCh)
+	select {
+	case sig := <-stopCh:
+		logrus.Infof("[lifecycle] - received %s, draining for up to %s", sig, l.drainTimeout)
+	case <-ctx.Done():
+		logrus.Warnf("[lifecycle] - %s, shutting down", context.Cause(ctx))
+	}
+	l.Shutdown()
+	return nil
+}
+
+// Shutdown 先让所有listener停止接受新连接，在drainTimeout内等待已有连接结束，最后强制关闭引擎
+func (l *lifecycle) Shutdown() {
+	l.drainOnce.Do(func() {
+		l.Drain()
+		ctx, cancel := context.WithTimeout(context.Background(), l.drainTimeout)
+		defer cancel()
+
+		var wg sync.WaitGroup
+		for _, p := range l.proxies {
+			wg.Add(1)
+			go func(p *proxy.Proxy) {
+				defer wg.Done()
+				if err := p.Shutdown(ctx); err != nil {
+					logrus.Errorf("[lifecycle] - error stopping proxy: %s", err)
+				}
+			}(p)
+		}
+		wg.Wait()
+
+		if l.admin != nil {
+			actx, acancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+			defer acancel()
+			if err := l.admin.Shutdown(actx); err != nil {
+				logrus.Errorf("[lifecycle] - error stopping admin server: %s", err)
+			}
+		}
+		logrus.Info("[lifecycle] - shutdown complete")
+	})
+}
@@ -1,15 +1,32 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/SMALL-head/zmesh/dataplane/accesslog"
+	"github.com/SMALL-head/zmesh/dataplane/admin"
+	"github.com/SMALL-head/zmesh/dataplane/authz"
+	"github.com/SMALL-head/zmesh/dataplane/ca"
 	"github.com/SMALL-head/zmesh/dataplane/config"
+	"github.com/SMALL-head/zmesh/dataplane/interception"
+	"github.com/SMALL-head/zmesh/dataplane/mtls"
 	"github.com/SMALL-head/zmesh/dataplane/proxy"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"golang.org/x/sync/errgroup"
 )
 
+// certAgentTimeout 启动时等待CA签发证书的最长时间
+const certAgentTimeout = time.Minute
+
 func main() {
-	_ = newCobraCommand().Execute()
+	if err := newCobraCommand().Execute(); err != nil {
+		os.Exit(1)
+	}
 }
 
 func newCobraCommand() *cobra.Command {
@@ -22,45 +39,88 @@ func newCobraCommand() *cobra.Command {
 		},
 	}
 
-	command.Flags().StringVarP(&configPath, "config", "c", "", "指定配置文件路径")
+	command.PersistentFlags().StringVarP(&configPath, "config", "c", "", "指定配置文件路径")
+	config.RegisterFlags(command.PersistentFlags())
+	command.AddCommand(newConfigCommand(&configPath))
+	command.AddCommand(newIptablesCommand(&configPath))
+	command.AddCommand(newCACommand())
 
 	return command
 }
 
 func run(cmd *cobra.Command, args []string, configPath string) {
-	eg := errgroup.Group{}
-	vCfg, err := config.ParseConfig(configPath)
+	eg, ctx := errgroup.WithContext(context.Background())
+	vCfg, err := config.Load(configPath, cmd.Flags())
 	if err != nil {
 		logrus.Fatal("error parsing config: ", err)
 	}
-	var oMode, iMode proxy.Mode
-	switch vCfg.OutBoundConfig.Mode {
-	case "sidecar":
-		oMode = proxy.SidecarMode
-	case "proxy":
-		oMode = proxy.ProxyMode
-	default:
-		logrus.Fatalf("invalid outbound mode: %s", vCfg.OutBoundConfig.Mode)
+	if err := vCfg.Validate(); err != nil {
+		logrus.Fatal("invalid config: ", err)
 	}
-	switch vCfg.InBoundConfig.Mode {
-	case "sidecar":
-		iMode = proxy.SidecarMode
-	case "proxy":
-		iMode = proxy.ProxyMode
-	default:
-		logrus.Fatalf("invalid inbound mode: %s", vCfg.InBoundConfig.Mode)
+	setLogLevel(vCfg.LogLevel)
+
+	oOpts, err := listenerOptions(vCfg.OutBoundConfig)
+	if err != nil {
+		logrus.Fatalf("invalid outbound config: %s", err)
+	}
+	iOpts, err := listenerOptions(vCfg.InBoundConfig)
+	if err != nil {
+		logrus.Fatalf("invalid inbound config: %s", err)
+	}
+	policy, err := buildAuthz(vCfg.Authz)
+	if err != nil {
+		logrus.Fatalf("invalid authz config: %s", err)
+	}
+	if policy != nil {
+		iOpts = append(iOpts, proxy.WithAuthz(policy))
+		logrus.Infof("inbound authorization enabled in %s mode with %d rules", vCfg.Authz.Mode, len(vCfg.Authz.Rules))
+	}
+	if mark := vCfg.Interception.ProxyMark; mark > 0 {
+		oOpts = append(oOpts, proxy.WithSocketMark(mark))
+		iOpts = append(iOpts, proxy.WithSocketMark(mark))
 	}
+	agentCtx, stopAgent := context.WithCancel(ctx)
+	defer stopAgent()
+	if ac := vCfg.CertAgent; ac.CAAddress != "" {
+		agent := ca.NewAgent(ac.CAAddress, ac.Namespace, ac.ServiceAccount,
+			ca.Files{Cert: vCfg.MTLS.CertFile, Key: vCfg.MTLS.KeyFile, CA: vCfg.MTLS.CAFile},
+			ca.WithAgentToken(ac.Token), ca.WithTTL(ac.TTL))
+		// 启动前必须拿到证书，之后在后台轮换
+		ensureCtx, cancel := context.WithTimeout(ctx, certAgentTimeout)
+		err := agent.Ensure(ensureCtx)
+		cancel()
+		if err != nil {
+			logrus.Fatalf("error requesting certificate from %s: %s", ac.CAAddress, err)
+		}
+		eg.Go(func() error {
+			return agent.Run(agentCtx)
+		})
+	}
+	if mc := vCfg.MTLS; mc.Mode != "" && mc.Mode != mtls.ModeDisable {
+		creds, err := mtls.Load(mc.CertFile, mc.KeyFile, mc.CAFile)
+		if err != nil {
+			logrus.Fatalf("error loading mtls certificates: %s", err)
+		}
+		oOpts = append(oOpts, proxy.WithMTLS(mc.Mode, creds), proxy.WithMeshCIDRs(vCfg.MeshCIDRs()...))
+		iOpts = append(iOpts, proxy.WithMTLS(mc.Mode, creds))
+		logrus.Infof("mtls between sidecars enabled in %s mode", mc.Mode)
+	}
+	if vCfg.Interception.InboundMode == interception.ModeTProxy {
+		iOpts = append(iOpts, proxy.WithTransparent(vCfg.Interception.TProxyMark))
+	}
+	if !vCfg.AccessLog.Disabled {
+		al, err := accesslog.New(vCfg.AccessLog.Format, vCfg.AccessLog.Path)
+		if err != nil {
+			logrus.Fatalf("error creating access log: %s", err)
+		}
+		defer al.Close()
+		oOpts = append(oOpts, proxy.WithAccessLog(al))
+		iOpts = append(iOpts, proxy.WithAccessLog(al))
+	}
+
 	// 启动转发代理服务器
-	po := proxy.NewProxyOutBound(
-		proxy.WithHost(vCfg.OutBoundConfig.Host),
-		proxy.WithPort(vCfg.OutBoundConfig.Port),
-		proxy.WithMode(oMode),
-	)
-	pi := proxy.NewProxyInBound(
-		proxy.WithHost(vCfg.InBoundConfig.Host),
-		proxy.WithPort(vCfg.InBoundConfig.Port),
-		proxy.WithMode(iMode),
-	)
+	po := proxy.NewProxyOutBound(oOpts...)
+	pi := proxy.NewProxyInBound(iOpts...)
 	eg.Go(func() error {
 		if err := po.Start(); err != nil {
 			return err
@@ -75,8 +135,137 @@ func run(cmd *cobra.Command, args []string, configPath string) {
 		return nil
 	})
 
+	rl := newReloader(configPath, vCfg, po.Proxy, pi.Proxy)
+	if configPath != "" {
+		if err := config.WatchConfig(configPath, cmd.Flags(), rl.OnChange); err != nil {
+			logrus.Errorf("error watching config %s, hot reload disabled: %s", configPath, err)
+		}
+	}
+
+	lc := newLifecycle(vCfg.DrainTimeout, po.Proxy, pi.Proxy)
+	if vCfg.Admin.Port > 0 {
+		lc.admin = admin.New(vCfg.Admin.Host, vCfg.Admin.Port,
+			admin.WithConfig(rl.Config),
+			admin.WithProxies(po.Proxy, pi.Proxy),
+			admin.WithDrain(lc.Drain),
+		)
+		eg.Go(lc.admin.Start)
+	}
+	eg.Go(func() error {
+		err := lc.Run(ctx)
+		stopAgent()
+		return err
+	})
+
 	if err := eg.Wait(); err != nil {
 		logrus.Fatal("error running proxy: ", err)
 	}
 
 }
+
+func parseMode(mode string) (proxy.Mode, error) {
+	switch mode {
+	case "sidecar":
+		return proxy.SidecarMode, nil
+	case "proxy":
+		return proxy.ProxyMode, nil
+	default:
+		return "", fmt.Errorf("invalid mode: %s", mode)
+	}
+}
+
+// listenerOptions 根据listener配置生成启动proxy所需的Option
+func listenerOptions(cfg config.ServerConfig) ([]proxy.Option, error) {
+	mode, err := parseMode(cfg.Mode)
+	if err != nil {
+		return nil, err
+	}
+	opts := []proxy.Option{
+		proxy.WithHost(cfg.Host),
+		proxy.WithPort(cfg.Port),
+		proxy.WithMode(mode),
+	}
+	reloadable, err := reloadableOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return append(opts, reloadable...), nil
+}
+
+// reloadableOptions 可以通过Proxy.Reload热更新的部分：上游、水位、超时以及HTTP端口
+func reloadableOptions(cfg config.ServerConfig) ([]proxy.Option, error) {
+	opts := []proxy.Option{
+		proxy.WithWatermarks(cfg.HighWatermark, cfg.LowWatermark),
+		proxy.WithConnectTimeout(cfg.ConnectTimeout),
+		proxy.WithIdleTimeout(cfg.IdleTimeout),
+		proxy.WithMaxConnectionDuration(cfg.MaxConnectionDuration),
+		proxy.WithSniffTimeout(cfg.SniffTimeout),
+		proxy.WithHTTPPorts(cfg.HTTPPorts...),
+	}
+	if cfg.Mode == string(proxy.ProxyMode) {
+		u, err := buildUpstream(cfg)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, proxy.WithUpstream(u))
+	}
+	return opts, nil
+}
+
+func setLogLevel(level string) {
+	if level == "" {
+		level = "info"
+	}
+	l, err := logrus.ParseLevel(level)
+	if err != nil {
+		logrus.Errorf("invalid log level %q: %s", level, err)
+		return
+	}
+	if l != logrus.GetLevel() {
+		logrus.SetLevel(l)
+		logrus.Infof("log level set to %s", l)
+	}
+}
+
+// buildUpstream 将配置中的上游集群转换为proxy.Upstream
+func buildUpstream(cfg config.ServerConfig) (*proxy.Upstream, error) {
+	cluster, ok := cfg.ActiveUpstream()
+	if !ok {
+		return nil, fmt.Errorf("upstream %q not found", cfg.Upstream)
+	}
+	if len(cluster.Endpoints) == 0 {
+		return nil, fmt.Errorf("upstream %q has no endpoint", cluster.Name)
+	}
+	endpoints := make([]proxy.Endpoint, 0, len(cluster.Endpoints))
+	for _, e := range cluster.Endpoints {
+		endpoints = append(endpoints, proxy.Endpoint{Addr: e.Address, Weight: e.Weight})
+	}
+	return proxy.NewUpstream(cluster.Name, cluster.ConnectTimeout, endpoints...), nil
+}
+
+// buildAuthz 将配置中的授权策略转换为authz.Policy，未开启时返回nil
+func buildAuthz(cfg config.AuthzConfig) (*authz.Policy, error) {
+	if cfg.Mode == "" || cfg.Mode == authz.ModeDisable {
+		return nil, nil
+	}
+	rules := make([]authz.Rule, 0, len(cfg.Rules))
+	for _, r := range cfg.Rules {
+		rule := authz.Rule{
+			Name:       r.Name,
+			Action:     r.Action,
+			Principals: r.Principals,
+			Ports:      r.Ports,
+			Methods:    r.Methods,
+			Paths:      r.Paths,
+		}
+		for _, c := range r.SourceCIDRs {
+			prefix, err := netip.ParsePrefix(c)
+			if err != nil {
+				return nil, err
+			}
+			rule.Sources = append(rule.Sources, prefix.Masked())
+		}
+		rules = append(rules, rule)
+	}
+	return authz.New(cfg.Mode, cfg.DefaultAction, rules)
+}
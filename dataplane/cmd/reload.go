@@ -0,0 +1,110 @@
+package main
+
+import (
+	"reflect"
+	"sync/atomic"
+
+	"github.com/SMALL-head/zmesh/dataplane/config"
+	"github.com/SMALL-head/zmesh/dataplane/proxy"
+	"github.com/sirupsen/logrus"
+)
+
+// reloader 处理配置文件的热更新，维护当前生效的配置
+type reloader struct {
+	path     string
+	current  atomic.Pointer[config.BootStrapConfig]
+	outbound *proxy.Proxy
+	inbound  *proxy.Proxy
+}
+
+func newReloader(path string, cfg config.BootStrapConfig, outbound, inbound *proxy.Proxy) *reloader {
+	r := &reloader{path: path, outbound: outbound, inbound: inbound}
+	r.current.Store(&cfg)
+	return r
+}
+
+// Config 当前生效的配置
+func (r *reloader) Config() config.BootStrapConfig {
+	return *r.current.Load()
+}
+
+// OnChange 配置文件变化时回调。新配置无效时记录日志并保留旧配置；
+// 监听地址、模式、admin、访问日志、drain_timeout、拦截、mtls和cert_agent配置需要重启才能生效，这些字段沿用旧值
+func (r *reloader) OnChange(cfg config.BootStrapConfig, err error) {
+	if err != nil {
+		logrus.Errorf("[reload] - error parsing %s, keeping current config: %s", r.path, err)
+		return
+	}
+	old := r.Config()
+	pinRestartOnly(old, &cfg)
+	if reflect.DeepEqual(old, cfg) {
+		return
+	}
+	if err := cfg.Validate(); err != nil {
+		logrus.Errorf("[reload] - invalid config in %s, keeping current config: %s", r.path, err)
+		return
+	}
+	oOpts, err := reloadableOptions(cfg.OutBoundConfig)
+	if err != nil {
+		logrus.Errorf("[reload] - invalid outbound config, keeping current config: %s", err)
+		return
+	}
+	iOpts, err := reloadableOptions(cfg.InBoundConfig)
+	if err != nil {
+		logrus.Errorf("[reload] - invalid inbound config, keeping current config: %s", err)
+		return
+	}
+	policy, err := buildAuthz(cfg.Authz)
+	if err != nil {
+		logrus.Errorf("[reload] - invalid authz config, keeping current config: %s", err)
+		return
+	}
+	iOpts = append(iOpts, proxy.WithAuthz(policy))
+	if err := r.outbound.Reload(oOpts...); err != nil {
+		logrus.Errorf("[reload] - error reloading outbound, keeping current config: %s", err)
+		return
+	}
+	if err := r.inbound.Reload(iOpts...); err != nil {
+		// outbound已经更新，回滚到旧配置
+		logrus.Errorf("[reload] - error reloading inbound, keeping current config: %s", err)
+		if rollback, rerr := reloadableOptions(old.OutBoundConfig); rerr == nil {
+			_ = r.outbound.Reload(rollback...)
+		}
+		return
+	}
+	setLogLevel(cfg.LogLevel)
+	r.current.Store(&cfg)
+	logrus.Infof("[reload] - applied config from %s", r.path)
+}
+
+// pinRestartOnly 把不支持热更新的字段恢复为旧值，有变化时给出提示
+func pinRestartOnly(old config.BootStrapConfig, cfg *config.BootStrapConfig) {
+	warn := func(field string, changed bool) {
+		if changed {
+			logrus.Warnf("[reload] - %s changed, restart required to take effect", field)
+		}
+	}
+	for _, l := range []struct {
+		name     string
+		old, new *config.ServerConfig
+	}{
+		{"outbound", &old.OutBoundConfig, &cfg.OutBoundConfig},
+		{"inbound", &old.InBoundConfig, &cfg.InBoundConfig},
+	} {
+		warn(l.name+".host", l.old.Host != l.new.Host)
+		warn(l.name+".port", l.old.Port != l.new.Port)
+		warn(l.name+".mode", l.old.Mode != l.new.Mode)
+		l.new.Host, l.new.Port, l.new.Mode = l.old.Host, l.old.Port, l.old.Mode
+	}
+	warn("admin", old.Admin != cfg.Admin)
+	warn("access_log", old.AccessLog != cfg.AccessLog)
+	warn("drain_timeout", old.DrainTimeout != cfg.DrainTimeout)
+	// 拦截规则由zmesh iptables安装，inbound的透明模式也只能在启动时设置
+	warn("interception", !reflect.DeepEqual(old.Interception, cfg.Interception))
+	cfg.Admin, cfg.AccessLog, cfg.DrainTimeout = old.Admin, old.AccessLog, old.DrainTimeout
+	cfg.Interception = old.Interception
+	// 证书文件由proxy自动重新加载，模式和文件路径需要重启
+	warn("mtls", !reflect.DeepEqual(old.MTLS, cfg.MTLS))
+	warn("cert_agent", old.CertAgent != cfg.CertAgent)
+	cfg.MTLS, cfg.CertAgent = old.MTLS, old.CertAgent
+}
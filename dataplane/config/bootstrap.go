@@ -1,14 +1,200 @@
 package config
 
+import (
+	"net/netip"
+	"time"
+)
+
 type BootStrapConfig struct {
-	InBoundConfig  ServerConfig `yaml:"inbound"`
-	OutBoundConfig ServerConfig `yaml:"outbound"`
+	InBoundConfig  ServerConfig       `yaml:"inbound"`
+	OutBoundConfig ServerConfig       `yaml:"outbound"`
+	Admin          AdminConfig        `yaml:"admin"`
+	AccessLog      AccessLogConfig    `yaml:"access_log"`
+	Interception   InterceptionConfig `yaml:"interception"`
+	MTLS           MTLSConfig         `yaml:"mtls"`
+	CertAgent      CertAgentConfig    `yaml:"cert_agent"`
+	Authz          AuthzConfig        `yaml:"authz"`
+
+	// 日志级别，为空时使用info，可热更新
+	LogLevel string `yaml:"log_level"`
+
+	// 收到SIGTERM后等待已有连接结束的最长时间，超时后强制关闭，不填使用默认值
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+}
+
+const DefaultDrainTimeout = 30 * time.Second
+
+// AdminConfig 本地管理端口，/metrics以prometheus格式暴露指标。
+// 默认只监听127.0.0.1，需要被集群内的prometheus抓取时把host改为0.0.0.0
+type AdminConfig struct {
+	Host string `yaml:"host"`
+	Port int    `yaml:"port"` // 为0时不启动
+}
+
+// AccessLogConfig 连接结束时输出的访问日志，与调试日志相互独立
+type AccessLogConfig struct {
+	Disabled bool   `yaml:"disabled"`
+	Format   string `yaml:"format"` // json或text，默认json
+	Path     string `yaml:"path"`   // 为空或stdout时输出到标准输出，否则写入该文件
+}
+
+// MTLSConfig sidecar之间的双向TLS：outbound发起mTLS，inbound终结后以明文转发给应用。
+// 证书文件变化后自动重新加载，其余字段修改后需要重启
+type MTLSConfig struct {
+	// disable、permissive或strict。permissive下outbound在对端不支持时退回明文，inbound同时接受明文；
+	// strict下只使用mTLS，inbound拒绝明文连接
+	Mode     string `yaml:"mode"`
+	CertFile string `yaml:"cert_file"` // 本sidecar的证书，需要同时可用于serverAuth和clientAuth
+	KeyFile  string `yaml:"key_file"`
+	CAFile   string `yaml:"ca_file"` // 校验对端证书的CA
+	// outbound只对目的地址在这些网段内的连接发起mTLS，其余目的地址(如集群外的服务)直接使用明文。
+	// 为空时使用interception的pod_cidr和pod_cidr6
+	MeshCIDRs []string `yaml:"mesh_cidrs"`
+}
+
+// CertAgentConfig 从zmesh ca申请工作负载证书，写入mtls配置的cert_file和key_file，并在过期前自动轮换。
+// mtls.ca_file需要事先放入CA的根证书，签发的证书只用它校验，不会被CA的响应替换。修改后需要重启
+type CertAgentConfig struct {
+	CAAddress      string        `yaml:"ca_address"` // 如http://127.0.0.1:15010，为空时不启用，直接使用已有的证书文件
+	Token          string        `yaml:"token"`      // zmesh ca serve --tokens-file中为namespace/service_account配置的token
+	Namespace      string        `yaml:"namespace"`
+	ServiceAccount string        `yaml:"service_account"`
+	TTL            time.Duration `yaml:"ttl"` // 申请的证书有效期，为0时由CA决定
+}
+
+// AuthzConfig inbound的授权策略，在连接应用之前按顺序匹配rules，第一条命中的规则决定放行或拒绝，可热更新
+type AuthzConfig struct {
+	// disable、enforce或audit。enforce下拒绝的连接被关闭，audit下只记录决策
+	Mode string `yaml:"mode"`
+	// 没有规则命中时的动作，allow或deny
+	DefaultAction string      `yaml:"default_action"`
+	Rules         []AuthzRule `yaml:"rules"`
+}
+
+// AuthzRule 所有填写的条件都满足时命中，同一个条件中的多个值满足任意一个即可
+type AuthzRule struct {
+	Name   string `yaml:"name"`
+	Action string `yaml:"action"` // allow或deny
+	// 对端证书中的SPIFFE ID，以*结尾时按前缀匹配，需要开启mtls，明文连接不会命中
+	Principals  []string `yaml:"principals"`
+	SourceCIDRs []string `yaml:"source_cidrs"`
+	Ports       []int    `yaml:"ports"` // 应用的端口
+	// HTTP/1.x的方法和路径，连接上的每个请求都单独匹配，路径以*结尾时按前缀匹配。
+	// 其余条件与连接匹配时，不是HTTP/1.x的连接被拒绝
+	Methods []string `yaml:"methods"`
+	Paths   []string `yaml:"paths"`
+}
+
+// InterceptionConfig zmesh iptables setup/cleanup使用的流量拦截配置，
+// 重定向的目标端口取自outbound.port和inbound.port
+type InterceptionConfig struct {
+	// 安装规则使用的后端：iptables、nftables或auto。auto在iptables可用时使用iptables，否则使用nftables
+	Backend string `yaml:"backend"`
+	// 入站流量的拦截方式：redirect或tproxy。tproxy模式下应用能看到真实的客户端地址，
+	// inbound监听需要CAP_NET_ADMIN，修改后需要重新安装规则并重启
+	InboundMode string `yaml:"inbound_mode"`
+	// tproxy模式下标记流量的mark和策略路由使用的路由表
+	TProxyMark  int `yaml:"tproxy_mark"`
+	TProxyTable int `yaml:"tproxy_table"`
+	// proxy发起的连接都带上该SO_MARK，拦截规则跳过带mark的流量，proxy可以运行在任意uid下。
+	// 需要CAP_NET_ADMIN，为0时不设置，只按proxy_uid排除
+	ProxyMark int    `yaml:"proxy_mark"`
+	ProxyUID  int    `yaml:"proxy_uid"` // proxy进程的uid，由它发出的流量不再重定向，为0时不按uid排除，需要设置proxy_mark
+	ProxyGID  int    `yaml:"proxy_gid"` // proxy进程的gid，为0时不按gid排除
+	PodCIDR   string `yaml:"pod_cidr"`  // 只拦截目的地址在该网段内的出站流量，为空时不限制
+	PodCIDR6  string `yaml:"pod_cidr6"` // ipv6下的pod_cidr
+	// 除pod_cidr外还需要拦截的出站网段，与pod_cidr合并
+	IncludeOutboundCIDRs []string `yaml:"include_outbound_cidrs"`
+	// 不拦截的出站网段，如集群外的数据库，优先于include
+	ExcludeOutboundCIDRs []string `yaml:"exclude_outbound_cidrs"`
+	// 只拦截这些目的端口的流量，为空时拦截所有端口
+	IncludeInboundPorts  []int `yaml:"include_inbound_ports"`
+	IncludeOutboundPorts []int `yaml:"include_outbound_ports"`
+	// 不拦截的目的端口，如健康检查端口，优先于include
+	ExcludeInboundPorts  []int `yaml:"exclude_inbound_ports"`
+	ExcludeOutboundPorts []int `yaml:"exclude_outbound_ports"`
+	// 除proxy_uid/proxy_gid外，其他发出的流量不经过mesh的uid和gid，不能为0(root)
+	ExemptUIDs []int `yaml:"exempt_uids"`
+	ExemptGIDs []int `yaml:"exempt_gids"`
 }
 
 type ServerConfig struct {
 	Host string `yaml:"host"`
 	Port int    `yaml:"port"`
 	Mode string `yaml:"mode"` // 代理模式，sidecar或proxy
+
+	// proxy模式下可转发的上游集群，Upstream指定使用哪一个，为空时使用第一个
+	Upstream  string            `yaml:"upstream"`
+	Upstreams []UpstreamCluster `yaml:"upstreams"`
+
+	// 每个连接写往上游的缓冲水位(字节)，超过高水位暂停读取下游，低于低水位后恢复，不填使用默认值
+	HighWatermark int `yaml:"high_watermark"`
+	LowWatermark  int `yaml:"low_watermark"`
+
+	// 连接上游的超时时间，集群自身配置了connect_timeout时以集群为准
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	// 两个方向都没有数据超过该时间后关闭连接，0表示不限制
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// 连接最长存活时间，0表示不限制
+	MaxConnectionDuration time.Duration `yaml:"max_connection_duration"`
+	// 识别应用层协议时等待下游数据的时间，服务端先发送数据的协议在超时后按unknown处理，0表示使用默认值(100ms)
+	SniffTimeout time.Duration `yaml:"sniff_timeout"`
+	// 总是按HTTP/1.1解析的目的端口，其余连接在识别出HTTP/1.x之后解析
+	HTTPPorts []int `yaml:"http_ports"`
+}
+
+// UpstreamCluster 一组具名的上游地址
+type UpstreamCluster struct {
+	Name           string        `yaml:"name"`
+	Endpoints      []Endpoint    `yaml:"endpoints"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+}
+
+type Endpoint struct {
+	Address string `yaml:"address"`
+	Weight  int    `yaml:"weight"` // 不填或<=0时视为1
+}
+
+// ActiveUpstream 返回当前listener实际使用的上游集群
+func (s ServerConfig) ActiveUpstream() (UpstreamCluster, bool) {
+	if len(s.Upstreams) == 0 {
+		return UpstreamCluster{}, false
+	}
+	if s.Upstream == "" {
+		return s.Upstreams[0], true
+	}
+	for _, u := range s.Upstreams {
+		if u.Name == s.Upstream {
+			return u, true
+		}
+	}
+	return UpstreamCluster{}, false
+}
+
+// MeshCIDRs outbound发起mTLS的目的网段，mtls.mesh_cidrs为空时使用interception的pod_cidr和pod_cidr6，需要先通过Validate
+func (c BootStrapConfig) MeshCIDRs() []netip.Prefix {
+	cidrs := c.MTLS.MeshCIDRs
+	if len(cidrs) == 0 {
+		cidrs = []string{c.Interception.PodCIDR, c.Interception.PodCIDR6}
+	}
+	var prefixes []netip.Prefix
+	for _, cidr := range cidrs {
+		if prefix, err := netip.ParsePrefix(cidr); err == nil {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// redacted 替换敏感字段的占位符
+const redacted = "<redacted>"
+
+// Redacted 返回去掉token等敏感字段的副本，用于/config_dump等对外展示的场景
+func (c BootStrapConfig) Redacted() BootStrapConfig {
+	if c.CertAgent.Token != "" {
+		c.CertAgent.Token = redacted
+	}
+	return c
 }
 
 func DefaultBootStrapConfig() BootStrapConfig {
@@ -23,5 +209,30 @@ func DefaultBootStrapConfig() BootStrapConfig {
 			Port: 8090,
 			Mode: "sidecar",
 		},
+		Admin: AdminConfig{
+			Host: "127.0.0.1",
+			Port: 15000,
+		},
+		AccessLog: AccessLogConfig{
+			Format: "json",
+			Path:   "stdout",
+		},
+		Interception: InterceptionConfig{
+			Backend:     "auto",
+			InboundMode: "redirect",
+			TProxyMark:  1337,
+			TProxyTable: 133,
+			ProxyUID:    1337,
+			PodCIDR:     "10.10.0.0/16",
+		},
+		MTLS: MTLSConfig{
+			Mode: "disable",
+		},
+		Authz: AuthzConfig{
+			Mode:          "disable",
+			DefaultAction: "allow",
+		},
+		LogLevel:     "info",
+		DrainTimeout: DefaultDrainTimeout,
 	}
 }
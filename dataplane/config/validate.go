@@ -0,0 +1,346 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SMALL-head/zmesh/dataplane/authz"
+	"github.com/SMALL-head/zmesh/dataplane/mtls"
+	"github.com/SMALL-head/zmesh/dataplane/proxy"
+	"github.com/sirupsen/logrus"
+)
+
+// Validate 检查配置是否可以被应用，一次性返回所有发现的问题，每条错误都带有出错字段的路径。
+// 默认值由Load合并，Validate不再合并：admin.port为0等零值本身有含义，无法区分是否填写过。
+// 因此c应来自Load，或者在DefaultBootStrapConfig的基础上修改，直接构造的配置中未填写的字段按零值检查
+func (c BootStrapConfig) Validate() error {
+	var errs []error
+	errs = append(errs, c.InBoundConfig.validate("inbound")...)
+	errs = append(errs, c.OutBoundConfig.validate("outbound")...)
+
+	// 端口冲突
+	if validPort(c.InBoundConfig.Port) && c.InBoundConfig.Port == c.OutBoundConfig.Port {
+		errs = append(errs, fmt.Errorf("inbound.port and outbound.port are both %d", c.InBoundConfig.Port))
+	}
+	if c.Admin.Port != 0 {
+		if c.Admin.Host == "" {
+			errs = append(errs, errors.New("admin.host: must not be empty"))
+		}
+		if !validPort(c.Admin.Port) {
+			errs = append(errs, fmt.Errorf("admin.port: %d out of range 1-65535 (0 disables admin)", c.Admin.Port))
+		}
+		for _, l := range []struct {
+			name string
+			port int
+		}{{"inbound", c.InBoundConfig.Port}, {"outbound", c.OutBoundConfig.Port}} {
+			if c.Admin.Port == l.port {
+				errs = append(errs, fmt.Errorf("admin.port conflicts with %s.port %d", l.name, l.port))
+			}
+		}
+	}
+
+	errs = append(errs, c.Interception.validate()...)
+	errs = append(errs, c.MTLS.validate()...)
+	errs = append(errs, c.CertAgent.validate(c.MTLS)...)
+	errs = append(errs, c.Authz.validate(c.MTLS)...)
+
+	if c.LogLevel != "" {
+		if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+			errs = append(errs, fmt.Errorf("log_level: %w", err))
+		}
+	}
+	switch c.AccessLog.Format {
+	case "", "json", "text":
+	default:
+		errs = append(errs, fmt.Errorf("access_log.format: unknown format %q, only support json and text", c.AccessLog.Format))
+	}
+	if c.DrainTimeout < 0 {
+		errs = append(errs, fmt.Errorf("drain_timeout: must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+func (s ServerConfig) validate(name string) []error {
+	var errs []error
+	if s.Host == "" {
+		errs = append(errs, fmt.Errorf("%s.host: must not be empty", name))
+	}
+	if !validPort(s.Port) {
+		errs = append(errs, fmt.Errorf("%s.port: %d out of range 1-65535", name, s.Port))
+	}
+	for i, p := range s.HTTPPorts {
+		if !validPort(p) {
+			errs = append(errs, fmt.Errorf("%s.http_ports[%d]: %d out of range 1-65535", name, i, p))
+		}
+	}
+
+	switch proxy.Mode(s.Mode) {
+	case proxy.SidecarMode:
+	case proxy.ProxyMode:
+		if u, ok := s.ActiveUpstream(); !ok {
+			if len(s.Upstreams) == 0 {
+				errs = append(errs, fmt.Errorf("%s.upstreams: %s mode requires at least one upstream", name, proxy.ProxyMode))
+			} else {
+				errs = append(errs, fmt.Errorf("%s.upstream: upstream %q not found", name, s.Upstream))
+			}
+		} else if len(u.Endpoints) == 0 {
+			errs = append(errs, fmt.Errorf("%s.upstreams: upstream %q has no endpoint", name, u.Name))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("%s.mode: invalid mode %q, only support %s and %s",
+			name, s.Mode, proxy.SidecarMode, proxy.ProxyMode))
+	}
+
+	names := make(map[string]bool)
+	for i, u := range s.Upstreams {
+		path := fmt.Sprintf("%s.upstreams[%d]", name, i)
+		if u.Name == "" {
+			errs = append(errs, fmt.Errorf("%s.name: must not be empty", path))
+		} else if names[u.Name] {
+			errs = append(errs, fmt.Errorf("%s.name: duplicate upstream %q", path, u.Name))
+		}
+		names[u.Name] = true
+		if u.ConnectTimeout < 0 {
+			errs = append(errs, fmt.Errorf("%s.connect_timeout: must not be negative", path))
+		}
+		for j, e := range u.Endpoints {
+			if err := validateAddress(e.Address); err != nil {
+				errs = append(errs, fmt.Errorf("%s.endpoints[%d].address: %w", path, j, err))
+			}
+		}
+	}
+
+	if s.HighWatermark < 0 || s.LowWatermark < 0 {
+		errs = append(errs, fmt.Errorf("%s: watermarks must not be negative", name))
+	} else if s.HighWatermark > 0 && s.LowWatermark > s.HighWatermark {
+		errs = append(errs, fmt.Errorf("%s: low_watermark %d is greater than high_watermark %d", name, s.LowWatermark, s.HighWatermark))
+	}
+	for _, d := range []struct {
+		field string
+		value time.Duration
+	}{
+		{"connect_timeout", s.ConnectTimeout},
+		{"idle_timeout", s.IdleTimeout},
+		{"max_connection_duration", s.MaxConnectionDuration},
+		{"sniff_timeout", s.SniffTimeout},
+	} {
+		if d.value < 0 {
+			errs = append(errs, fmt.Errorf("%s.%s: must not be negative", name, d.field))
+		}
+	}
+	return errs
+}
+
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+// validateAddress 检查host:port格式的上游地址
+func validateAddress(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("%q has no host", addr)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || !validPort(p) {
+		return fmt.Errorf("%q has invalid port", addr)
+	}
+	return nil
+}
+
+func (mc MTLSConfig) validate() []error {
+	switch mc.Mode {
+	case "", mtls.ModeDisable:
+		return nil
+	case mtls.ModePermissive, mtls.ModeStrict:
+	default:
+		return []error{fmt.Errorf("mtls.mode: %q is not one of disable, permissive, strict", mc.Mode)}
+	}
+	var errs []error
+	for _, f := range []struct{ field, path string }{
+		{"cert_file", mc.CertFile}, {"key_file", mc.KeyFile}, {"ca_file", mc.CAFile},
+	} {
+		if f.path == "" {
+			errs = append(errs, fmt.Errorf("mtls.%s: required when mtls is enabled", f.field))
+		}
+	}
+	for i, c := range mc.MeshCIDRs {
+		if _, err := netip.ParsePrefix(c); err != nil {
+			errs = append(errs, fmt.Errorf("mtls.mesh_cidrs[%d]: %w", i, err))
+		}
+	}
+	return errs
+}
+
+func (ac CertAgentConfig) validate(mc MTLSConfig) []error {
+	if ac.CAAddress == "" {
+		return nil
+	}
+	var errs []error
+	if u, err := url.Parse(ac.CAAddress); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("cert_agent.ca_address: %q is not a http(s) url", ac.CAAddress))
+	}
+	if ac.Token == "" {
+		errs = append(errs, fmt.Errorf("cert_agent.token: required when cert_agent is enabled"))
+	}
+	if ac.Namespace == "" {
+		errs = append(errs, fmt.Errorf("cert_agent.namespace: required when cert_agent is enabled"))
+	}
+	if ac.ServiceAccount == "" {
+		errs = append(errs, fmt.Errorf("cert_agent.service_account: required when cert_agent is enabled"))
+	}
+	if ac.TTL < 0 {
+		errs = append(errs, fmt.Errorf("cert_agent.ttl: must not be negative"))
+	}
+	// 证书写入mtls配置的文件路径
+	if mc.CertFile == "" || mc.KeyFile == "" || mc.CAFile == "" {
+		errs = append(errs, fmt.Errorf("cert_agent: mtls.cert_file, mtls.key_file and mtls.ca_file are required"))
+	}
+	return errs
+}
+
+func (ac AuthzConfig) validate(mc MTLSConfig) []error {
+	switch ac.Mode {
+	case "", authz.ModeDisable:
+		return nil
+	case authz.ModeEnforce, authz.ModeAudit:
+	default:
+		return []error{fmt.Errorf("authz.mode: %q is not one of disable, enforce, audit", ac.Mode)}
+	}
+	var errs []error
+	switch ac.DefaultAction {
+	case "", authz.ActionAllow, authz.ActionDeny:
+	default:
+		errs = append(errs, fmt.Errorf("authz.default_action: %q is not one of allow, deny", ac.DefaultAction))
+	}
+	mtlsEnabled := mc.Mode == mtls.ModePermissive || mc.Mode == mtls.ModeStrict
+	for i, r := range ac.Rules {
+		field := fmt.Sprintf("authz.rules[%d]", i)
+		if r.Action != authz.ActionAllow && r.Action != authz.ActionDeny {
+			errs = append(errs, fmt.Errorf("%s.action: %q is not one of allow, deny", field, r.Action))
+		}
+		if len(r.Principals) > 0 && !mtlsEnabled {
+			errs = append(errs, fmt.Errorf("%s.principals: requires mtls to be enabled", field))
+		}
+		for _, c := range r.SourceCIDRs {
+			if _, err := netip.ParsePrefix(c); err != nil {
+				errs = append(errs, fmt.Errorf("%s.source_cidrs: %w", field, err))
+			}
+		}
+		for _, port := range r.Ports {
+			if !validPort(port) {
+				errs = append(errs, fmt.Errorf("%s.ports: %d out of range 1-65535", field, port))
+			}
+		}
+		for _, path := range r.Paths {
+			if !strings.HasPrefix(path, "/") && path != "*" {
+				errs = append(errs, fmt.Errorf("%s.paths: %q must start with /", field, path))
+			}
+		}
+	}
+	return errs
+}
+
+func (ic InterceptionConfig) validate() []error {
+	var errs []error
+	switch ic.Backend {
+	case "", "auto", "iptables", "nftables":
+	default:
+		errs = append(errs, fmt.Errorf("interception.backend: %q is not one of auto, iptables, nftables", ic.Backend))
+	}
+	switch ic.InboundMode {
+	case "", "redirect":
+	case "tproxy":
+		if ic.TProxyMark <= 0 {
+			errs = append(errs, fmt.Errorf("interception.tproxy_mark: must be positive"))
+		}
+		if ic.TProxyTable <= 0 || ic.TProxyTable >= 253 {
+			// 253-255是default/main/local表
+			errs = append(errs, fmt.Errorf("interception.tproxy_table: %d out of range 1-252", ic.TProxyTable))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("interception.inbound_mode: %q is not one of redirect, tproxy", ic.InboundMode))
+	}
+	if ic.ProxyMark < 0 {
+		errs = append(errs, fmt.Errorf("interception.proxy_mark: must not be negative"))
+	} else if ic.InboundMode == "tproxy" && ic.ProxyMark != 0 && ic.ProxyMark == ic.TProxyMark {
+		// tproxy的mark会让应用的回包经策略路由回到本机，不能与普通连接共用
+		errs = append(errs, fmt.Errorf("interception.proxy_mark: must differ from tproxy_mark"))
+	}
+	if ic.ProxyUID < 0 {
+		errs = append(errs, fmt.Errorf("interception.proxy_uid: must not be negative"))
+	} else if ic.ProxyUID == 0 && ic.ProxyMark == 0 {
+		// 按uid 0排除会让所有root进程的流量绕过mesh
+		errs = append(errs, fmt.Errorf("interception.proxy_uid: 0 would exempt all root traffic, set proxy_mark instead"))
+	}
+	if ic.ProxyGID < 0 {
+		errs = append(errs, fmt.Errorf("interception.proxy_gid: must not be negative"))
+	}
+	for _, c := range []struct {
+		field  string
+		cidr   string
+		ipv6   bool
+		family string
+	}{{"pod_cidr", ic.PodCIDR, false, "ipv4"}, {"pod_cidr6", ic.PodCIDR6, true, "ipv6"}} {
+		if c.cidr == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(c.cidr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("interception.%s: %w", c.field, err))
+		} else if prefix.Addr().Is6() != c.ipv6 {
+			errs = append(errs, fmt.Errorf("interception.%s: %s is not an %s cidr", c.field, c.cidr, c.family))
+		}
+	}
+	for _, l := range []struct {
+		field string
+		cidrs []string
+	}{
+		{"include_outbound_cidrs", ic.IncludeOutboundCIDRs},
+		{"exclude_outbound_cidrs", ic.ExcludeOutboundCIDRs},
+	} {
+		for i, c := range l.cidrs {
+			if _, err := netip.ParsePrefix(c); err != nil {
+				errs = append(errs, fmt.Errorf("interception.%s[%d]: %w", l.field, i, err))
+			}
+		}
+	}
+	for _, l := range []struct {
+		field string
+		ids   []int
+	}{{"exempt_uids", ic.ExemptUIDs}, {"exempt_gids", ic.ExemptGIDs}} {
+		for i, id := range l.ids {
+			switch {
+			case id < 0:
+				errs = append(errs, fmt.Errorf("interception.%s[%d]: must not be negative", l.field, i))
+			case id == 0:
+				errs = append(errs, fmt.Errorf("interception.%s[%d]: 0 would exempt all root traffic", l.field, i))
+			}
+		}
+	}
+	for _, l := range []struct {
+		field string
+		ports []int
+	}{
+		{"include_inbound_ports", ic.IncludeInboundPorts},
+		{"include_outbound_ports", ic.IncludeOutboundPorts},
+		{"exclude_inbound_ports", ic.ExcludeInboundPorts},
+		{"exclude_outbound_ports", ic.ExcludeOutboundPorts},
+	} {
+		for i, p := range l.ports {
+			if !validPort(p) {
+				errs = append(errs, fmt.Errorf("interception.%s[%d]: %d out of range 1-65535", l.field, i, p))
+			}
+		}
+	}
+	return errs
+}
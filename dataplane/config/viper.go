@@ -1,27 +1,190 @@
 package config
 
 import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
 	"github.com/go-viper/mapstructure/v2"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
 )
 
+// EnvPrefix 环境变量前缀，如outbound.idle_timeout对应ZMESH_OUTBOUND_IDLE_TIMEOUT
+const EnvPrefix = "ZMESH"
+
+// ParseConfig 解析配置文件，等价于Load(configPath, nil)
 func ParseConfig(configPath string) (BootStrapConfig, error) {
-	// 解析配置文件
+	return Load(configPath, nil)
+}
+
+// Load 加载配置，优先级从高到低为：命令行参数 > ZMESH_环境变量 > 配置文件 > DefaultBootStrapConfig。
+// configPath为空时不读取文件；flags中只有显式设置过的参数才会生效。
+// 配置文件中出现未知字段时返回UnknownFieldsError。返回的配置还需要调用Validate检查
+func Load(configPath string, flags *pflag.FlagSet) (BootStrapConfig, error) {
 	config := BootStrapConfig{}
-	// 这里可以添加实际的配置解析逻辑
 	v := viper.New()
-	// v.AddConfigPath(".")
-	// v.AddConfigPath("./config")
-	// v.SetConfigName("application")
-	// v.SetConfigType("yaml")
-	v.SetConfigFile(configPath)
-	if err := v.ReadInConfig(); err != nil {
-		return config, err
+	for _, f := range fields() {
+		v.SetDefault(f.key, f.def)
+		if err := v.BindEnv(f.key, EnvName(f.key)); err != nil {
+			return config, err
+		}
+		if flags == nil {
+			continue
+		}
+		if fl := flags.Lookup(FlagName(f.key)); fl != nil {
+			if err := v.BindPFlag(f.key, fl); err != nil {
+				return config, err
+			}
+		}
+	}
+	if configPath != "" {
+		v.SetConfigFile(configPath)
+		if err := v.ReadInConfig(); err != nil {
+			return config, err
+		}
 	}
+	var md mapstructure.Metadata
 	if err := v.Unmarshal(&config, func(config *mapstructure.DecoderConfig) {
 		config.TagName = "yaml"
+		config.Metadata = &md
+		config.DecodeHook = mapstructure.ComposeDecodeHookFunc(
+			stringToStructSliceHook,
+			stringToSliceHook,
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		)
 	}); err != nil {
 		return config, err
 	}
+	if len(md.Unused) > 0 {
+		sort.Strings(md.Unused)
+		return config, &UnknownFieldsError{Fields: md.Unused}
+	}
 	return config, nil
 }
+
+// UnknownFieldsError 配置文件中出现了未知字段，此时ParseConfig仍会返回解析出的配置，便于一次性报告所有问题
+type UnknownFieldsError struct {
+	Fields []string
+}
+
+func (e *UnknownFieldsError) Error() string {
+	return fmt.Sprintf("unknown fields: %s", strings.Join(e.Fields, ", "))
+}
+
+// WatchConfig 监听配置文件，文件每次被修改(包括k8s ConfigMap的符号链接替换)后按Load的优先级重新加载并回调onChange，
+// 解析失败时err不为nil，由调用方决定是否保留旧配置
+func WatchConfig(configPath string, flags *pflag.FlagSet, onChange func(cfg BootStrapConfig, err error)) error {
+	v := viper.New()
+	v.SetConfigFile(configPath)
+	if err := v.ReadInConfig(); err != nil {
+		return err
+	}
+	v.OnConfigChange(func(fsnotify.Event) {
+		// viper在重新读取失败时仍会回调，这里重新解析一次以拿到错误
+		onChange(Load(configPath, flags))
+	})
+	v.WatchConfig()
+	return nil
+}
+
+// RegisterFlags 为每个配置字段注册一个命令行参数，如outbound.idle_timeout对应--outbound-idle-timeout。
+// 上游集群、授权规则这类列表字段以yaml字符串的形式传入
+func RegisterFlags(fs *pflag.FlagSet) {
+	for _, f := range fields() {
+		name := FlagName(f.key)
+		usage := fmt.Sprintf("覆盖配置项%s，对应环境变量%s", f.key, EnvName(f.key))
+		switch def := f.def.(type) {
+		case time.Duration:
+			fs.Duration(name, def, usage)
+		case int:
+			fs.Int(name, def, usage)
+		case bool:
+			fs.Bool(name, def, usage)
+		case string:
+			fs.String(name, def, usage)
+		case []int:
+			fs.IntSlice(name, def, usage)
+		case []string:
+			fs.StringSlice(name, def, usage)
+		default:
+			fs.String(name, "", usage+"，yaml格式")
+		}
+	}
+}
+
+func FlagName(key string) string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(key)
+}
+
+func EnvName(key string) string {
+	return EnvPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// field 配置中的一个叶子字段
+type field struct {
+	key string // viper中的key，如outbound.idle_timeout
+	def any    // DefaultBootStrapConfig中的值
+}
+
+// fields 按yaml tag展开BootStrapConfig的所有叶子字段
+func fields() []field {
+	var res []field
+	collectFields(reflect.ValueOf(DefaultBootStrapConfig()), "", &res)
+	return res
+}
+
+func collectFields(v reflect.Value, prefix string, res *[]field) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		key := prefix + tag
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct {
+			collectFields(fv, key+".", res)
+			continue
+		}
+		*res = append(*res, field{key: key, def: fv.Interface()})
+	}
+}
+
+// stringToStructSliceHook 环境变量和命令行参数中的上游集群、授权规则这类列表以yaml字符串传入
+func stringToStructSliceHook(from, to reflect.Type, data any) (any, error) {
+	if from.Kind() != reflect.String || to.Kind() != reflect.Slice || to.Elem().Kind() != reflect.Struct {
+		return data, nil
+	}
+	v := reflect.New(to)
+	if s := data.(string); s != "" {
+		if err := yaml.Unmarshal([]byte(s), v.Interface()); err != nil {
+			return nil, fmt.Errorf("decoding %s: %w", to, err)
+		}
+	}
+	return v.Elem().Interface(), nil
+}
+
+// stringToSliceHook 环境变量中的端口、网段列表以逗号分隔，如"15020, 15021"，元素两边的空格会被去掉
+func stringToSliceHook(from, to reflect.Type, data any) (any, error) {
+	if from.Kind() != reflect.String || to.Kind() != reflect.Slice {
+		return data, nil
+	}
+	if k := to.Elem().Kind(); k != reflect.Int && k != reflect.String {
+		return data, nil
+	}
+	s := strings.TrimSpace(data.(string))
+	if s == "" {
+		return []string{}, nil
+	}
+	parts := strings.Split(s, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	return parts, nil
+}
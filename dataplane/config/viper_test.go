@@ -2,10 +2,14 @@ package config_test
 
 import (
 	"fmt"
+	"net/netip"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/SMALL-head/zmesh/dataplane/config"
+	"github.com/spf13/pflag"
 	"github.com/stretchr/testify/require"
 )
 
@@ -19,3 +23,311 @@ func TestParseConfig(t *testing.T) {
 	fmt.Println(cfg.InBoundConfig.Mode)
 	fmt.Println(cfg.OutBoundConfig.Mode)
 }
+
+func TestParseConfigUpstreams(t *testing.T) {
+	cfg, err := config.ParseConfig("application.yaml")
+	require.NoError(t, err)
+	u, ok := cfg.OutBoundConfig.ActiveUpstream()
+	require.True(t, ok)
+	require.Equal(t, "test-server", u.Name)
+	require.Equal(t, 3*time.Second, u.ConnectTimeout)
+	require.Len(t, u.Endpoints, 1)
+	require.Equal(t, "127.0.0.1:8888", u.Endpoints[0].Address)
+}
+
+func TestWatchConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "application.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("outbound:\n  mode: sidecar\n  idle_timeout: 1s\n"), 0o644))
+
+	type result struct {
+		cfg config.BootStrapConfig
+		err error
+	}
+	changes := make(chan result, 16)
+	require.NoError(t, config.WatchConfig(path, nil, func(cfg config.BootStrapConfig, err error) {
+		changes <- result{cfg, err}
+	}))
+
+	require.NoError(t, os.WriteFile(path, []byte("outbound:\n  mode: sidecar\n  idle_timeout: 2s\n"), 0o644))
+	require.Eventually(t, func() bool {
+		select {
+		case r := <-changes:
+			return r.err == nil && r.cfg.OutBoundConfig.IdleTimeout == 2*time.Second
+		default:
+			return false
+		}
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestValidate(t *testing.T) {
+	require.NoError(t, config.DefaultBootStrapConfig().Validate())
+
+	cfg := config.DefaultBootStrapConfig()
+	cfg.OutBoundConfig.Mode = "bogus"
+	cfg.InBoundConfig.Mode = "proxy"
+	cfg.InBoundConfig.IdleTimeout = -time.Second
+	cfg.LogLevel = "loud"
+	err := cfg.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "outbound.mode")
+	require.Contains(t, err.Error(), "inbound.upstream")
+	require.Contains(t, err.Error(), "inbound.idle_timeout")
+	require.Contains(t, err.Error(), "log_level")
+}
+
+func TestParseConfigDefaultsAndUnknownFields(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "application.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("outbound:\n  port: 9000\n"), 0o644))
+	cfg, err := config.ParseConfig(path)
+	require.NoError(t, err)
+	def := config.DefaultBootStrapConfig()
+	require.Equal(t, 9000, cfg.OutBoundConfig.Port)
+	require.Equal(t, def.OutBoundConfig.Host, cfg.OutBoundConfig.Host)
+	require.Equal(t, def.OutBoundConfig.Mode, cfg.OutBoundConfig.Mode)
+	require.Equal(t, def.InBoundConfig, cfg.InBoundConfig)
+	require.Equal(t, def.Admin, cfg.Admin)
+	require.NoError(t, cfg.Validate())
+
+	require.NoError(t, os.WriteFile(path, []byte("outbound:\n  mdoe: proxy\nextra: 1\n"), 0o644))
+	_, err = config.ParseConfig(path)
+	var unknown *config.UnknownFieldsError
+	require.ErrorAs(t, err, &unknown)
+	require.Equal(t, []string{"extra", "outbound.mdoe"}, unknown.Fields)
+}
+
+func TestValidatePorts(t *testing.T) {
+	cfg := config.DefaultBootStrapConfig()
+	cfg.InBoundConfig.Port = cfg.OutBoundConfig.Port
+	cfg.Admin.Port = cfg.OutBoundConfig.Port
+	cfg.OutBoundConfig.Host = ""
+	err := cfg.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "inbound.port and outbound.port are both")
+	require.Contains(t, err.Error(), "admin.port conflicts with outbound.port")
+	require.Contains(t, err.Error(), "outbound.host: must not be empty")
+
+	cfg = config.DefaultBootStrapConfig()
+	cfg.InBoundConfig.Port = 0
+	cfg.OutBoundConfig.Port = 65536
+	cfg.Admin.Port = 0 // 0表示不启动admin，不算错误
+	cfg.InBoundConfig.HTTPPorts = []int{8080, 70000}
+	err = cfg.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "inbound.port: 0 out of range")
+	require.Contains(t, err.Error(), "inbound.http_ports[1]: 70000 out of range")
+	require.Contains(t, err.Error(), "outbound.port: 65536 out of range")
+	require.NotContains(t, err.Error(), "admin")
+
+	cfg = config.DefaultBootStrapConfig()
+	cfg.OutBoundConfig.Mode = "proxy"
+	cfg.OutBoundConfig.Upstreams = []config.UpstreamCluster{
+		{Name: "a", Endpoints: []config.Endpoint{{Address: "127.0.0.1"}}},
+		{Name: "a", Endpoints: []config.Endpoint{{Address: "127.0.0.1:80"}}},
+	}
+	err = cfg.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "outbound.upstreams[0].endpoints[0].address")
+	require.Contains(t, err.Error(), `outbound.upstreams[1].name: duplicate upstream "a"`)
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "application.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(
+		"outbound:\n  port: 9000\n  idle_timeout: 1s\ninbound:\n  port: 9001\n  mode: proxy\n"), 0o644))
+
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	config.RegisterFlags(flags)
+	require.NoError(t, flags.Parse([]string{"--outbound-port", "9100"}))
+
+	t.Setenv("ZMESH_OUTBOUND_PORT", "9200")
+	t.Setenv("ZMESH_OUTBOUND_IDLE_TIMEOUT", "2s")
+	t.Setenv("ZMESH_INBOUND_HTTP_PORTS", "8080,9080")
+	t.Setenv("ZMESH_INBOUND_UPSTREAMS", `[{name: a, connect_timeout: 1s, endpoints: [{address: "127.0.0.1:80", weight: 2}]}]`)
+
+	cfg, err := config.Load(path, flags)
+	require.NoError(t, err)
+	// flags > env > file > defaults
+	require.Equal(t, 9100, cfg.OutBoundConfig.Port)
+	require.Equal(t, 2*time.Second, cfg.OutBoundConfig.IdleTimeout)
+	require.Equal(t, 9001, cfg.InBoundConfig.Port)
+	require.Equal(t, []int{8080, 9080}, cfg.InBoundConfig.HTTPPorts)
+	require.Equal(t, config.DefaultBootStrapConfig().OutBoundConfig.Host, cfg.OutBoundConfig.Host)
+	require.Equal(t, []config.UpstreamCluster{{
+		Name:           "a",
+		ConnectTimeout: time.Second,
+		Endpoints:      []config.Endpoint{{Address: "127.0.0.1:80", Weight: 2}},
+	}}, cfg.InBoundConfig.Upstreams)
+	require.NoError(t, cfg.Validate())
+
+	// 不指定配置文件时只使用默认值和覆盖项
+	cfg, err = config.Load("", nil)
+	require.NoError(t, err)
+	require.Equal(t, 9200, cfg.OutBoundConfig.Port)
+}
+
+func TestInterceptionConfig(t *testing.T) {
+	t.Setenv("ZMESH_INTERCEPTION_EXCLUDE_INBOUND_PORTS", "15020,15021")
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	config.RegisterFlags(flags)
+	t.Setenv("ZMESH_INTERCEPTION_EXCLUDE_OUTBOUND_CIDRS", "10.96.0.10/32, 192.168.0.0/16")
+	require.NoError(t, flags.Parse([]string{
+		"--interception-exclude-outbound-ports", "22,53",
+		"--interception-exempt-uids", "1000,1001",
+		"--interception-include-outbound-cidrs", "172.16.0.0/12",
+	}))
+
+	cfg, err := config.Load("", flags)
+	require.NoError(t, err)
+	require.Equal(t, []int{15020, 15021}, cfg.Interception.ExcludeInboundPorts)
+	require.Equal(t, []int{22, 53}, cfg.Interception.ExcludeOutboundPorts)
+	require.Equal(t, 1337, cfg.Interception.ProxyUID)
+	require.Equal(t, []string{"10.96.0.10/32", "192.168.0.0/16"}, cfg.Interception.ExcludeOutboundCIDRs)
+	require.Equal(t, []string{"172.16.0.0/12"}, cfg.Interception.IncludeOutboundCIDRs)
+	require.Equal(t, []int{1000, 1001}, cfg.Interception.ExemptUIDs)
+	require.NoError(t, cfg.Validate())
+
+	require.Equal(t, "auto", cfg.Interception.Backend)
+
+	cfg.Interception.Backend = "ipfw"
+	cfg.Interception.PodCIDR = "fd00::/64"
+	cfg.Interception.PodCIDR6 = "not-a-cidr"
+	cfg.Interception.ExcludeInboundPorts = []int{0}
+	cfg.Interception.ExcludeOutboundCIDRs = []string{"10.0.0.1"}
+	cfg.Interception.ExemptUIDs = []int{1000, 0}
+	cfg.Interception.ExemptGIDs = []int{-1}
+	cfg.Interception.ProxyUID = 0
+	err = cfg.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "interception.pod_cidr: fd00::/64 is not an ipv4 cidr")
+	require.Contains(t, err.Error(), "interception.pod_cidr6")
+	require.Contains(t, err.Error(), "interception.exclude_inbound_ports[0]")
+	require.Contains(t, err.Error(), "interception.backend")
+	require.Contains(t, err.Error(), "interception.exclude_outbound_cidrs[0]")
+	require.Contains(t, err.Error(), "interception.exempt_gids[0]: must not be negative")
+	require.Contains(t, err.Error(), "interception.exempt_uids[1]: 0 would exempt all root traffic")
+	require.Contains(t, err.Error(), "interception.proxy_uid: 0 would exempt all root traffic")
+}
+
+func TestInterceptionTProxyConfig(t *testing.T) {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	config.RegisterFlags(flags)
+	require.NoError(t, flags.Parse([]string{"--interception-inbound-mode", "tproxy"}))
+
+	cfg, err := config.Load("", flags)
+	require.NoError(t, err)
+	require.Equal(t, "tproxy", cfg.Interception.InboundMode)
+	require.Equal(t, 1337, cfg.Interception.TProxyMark)
+	require.Equal(t, 133, cfg.Interception.TProxyTable)
+	require.NoError(t, cfg.Validate())
+
+	cfg.Interception.TProxyMark = 0
+	cfg.Interception.TProxyTable = 254
+	err = cfg.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "interception.tproxy_mark: must be positive")
+	require.Contains(t, err.Error(), "interception.tproxy_table: 254 out of range 1-252")
+
+	cfg.Interception.InboundMode = "divert"
+	require.ErrorContains(t, cfg.Validate(), "interception.inbound_mode")
+
+	// proxy的mark不能与tproxy的mark相同
+	cfg.Interception.InboundMode = "tproxy"
+	cfg.Interception.TProxyMark, cfg.Interception.TProxyTable = 1337, 133
+	cfg.Interception.ProxyMark = 1337
+	require.ErrorContains(t, cfg.Validate(), "interception.proxy_mark: must differ from tproxy_mark")
+	cfg.Interception.ProxyMark = 0x83
+	require.NoError(t, cfg.Validate())
+
+	// proxy以root运行时只能按mark排除
+	cfg.Interception.ProxyUID = 0
+	require.NoError(t, cfg.Validate())
+	cfg.Interception.ProxyMark = 0
+	require.ErrorContains(t, cfg.Validate(), "interception.proxy_uid: 0 would exempt all root traffic")
+}
+
+func TestMTLSConfig(t *testing.T) {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	config.RegisterFlags(flags)
+	t.Setenv("ZMESH_MTLS_CA_FILE", "/etc/zmesh/certs/ca.pem")
+	require.NoError(t, flags.Parse([]string{"--mtls-mode", "strict", "--mtls-cert-file", "/etc/zmesh/certs/cert.pem"}))
+
+	cfg, err := config.Load("", flags)
+	require.NoError(t, err)
+	require.Equal(t, "strict", cfg.MTLS.Mode)
+	require.Equal(t, "/etc/zmesh/certs/ca.pem", cfg.MTLS.CAFile)
+	// 缺少私钥
+	require.ErrorContains(t, cfg.Validate(), "mtls.key_file: required when mtls is enabled")
+
+	cfg.MTLS.KeyFile = "/etc/zmesh/certs/key.pem"
+	require.NoError(t, cfg.Validate())
+	// 没有配置mesh_cidrs时使用pod_cidr
+	require.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.10.0.0/16")}, cfg.MeshCIDRs())
+	cfg.MTLS.MeshCIDRs = []string{"10.0.0.0/8", "fd00::/8"}
+	require.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8")}, cfg.MeshCIDRs())
+	cfg.MTLS.MeshCIDRs = []string{"10.0.0.0"}
+	require.ErrorContains(t, cfg.Validate(), "mtls.mesh_cidrs[0]")
+	cfg.MTLS.Mode = "optional"
+	require.ErrorContains(t, cfg.Validate(), "mtls.mode")
+
+	require.Equal(t, "disable", config.DefaultBootStrapConfig().MTLS.Mode)
+	require.NoError(t, config.DefaultBootStrapConfig().Validate())
+}
+
+func TestCertAgentConfig(t *testing.T) {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	config.RegisterFlags(flags)
+	t.Setenv("ZMESH_CERT_AGENT_SERVICE_ACCOUNT", "reviews")
+	require.NoError(t, flags.Parse([]string{"--cert-agent-ca-address", "http://127.0.0.1:15010", "--cert-agent-ttl", "12h"}))
+
+	cfg, err := config.Load("", flags)
+	require.NoError(t, err)
+	require.Equal(t, "reviews", cfg.CertAgent.ServiceAccount)
+	require.Equal(t, 12*time.Hour, cfg.CertAgent.TTL)
+	// 缺少token、namespace以及证书的存放路径
+	err = cfg.Validate()
+	require.ErrorContains(t, err, "cert_agent.token: required")
+	require.ErrorContains(t, err, "cert_agent.namespace: required")
+	require.ErrorContains(t, err, "cert_agent: mtls.cert_file, mtls.key_file and mtls.ca_file are required")
+
+	cfg.CertAgent.Token, cfg.CertAgent.Namespace = "s3cr3t", "default"
+	cfg.MTLS.CertFile, cfg.MTLS.KeyFile, cfg.MTLS.CAFile = "/etc/zmesh/certs/cert.pem", "/etc/zmesh/certs/key.pem", "/etc/zmesh/certs/ca.pem"
+	require.NoError(t, cfg.Validate())
+	cfg.CertAgent.CAAddress = "127.0.0.1:15010"
+	require.ErrorContains(t, cfg.Validate(), "cert_agent.ca_address")
+}
+
+func TestAuthzConfig(t *testing.T) {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	config.RegisterFlags(flags)
+	t.Setenv("ZMESH_AUTHZ_RULES", `
+- name: frontend
+  action: allow
+  principals: ["spiffe://cluster.local/ns/default/sa/frontend"]
+  methods: [GET]
+  paths: ["/api/*"]
+- action: deny
+  source_cidrs: ["10.0.0.0/8"]
+  ports: [8080]
+`)
+	require.NoError(t, flags.Parse([]string{"--authz-mode", "audit", "--authz-default-action", "deny"}))
+
+	cfg, err := config.Load("", flags)
+	require.NoError(t, err)
+	require.Equal(t, "audit", cfg.Authz.Mode)
+	require.Len(t, cfg.Authz.Rules, 2)
+	require.Equal(t, []string{"/api/*"}, cfg.Authz.Rules[0].Paths)
+	require.Equal(t, []int{8080}, cfg.Authz.Rules[1].Ports)
+	// 按身份授权需要mtls
+	require.ErrorContains(t, cfg.Validate(), "authz.rules[0].principals: requires mtls to be enabled")
+
+	cfg.MTLS = config.MTLSConfig{Mode: "strict", CertFile: "cert.pem", KeyFile: "key.pem", CAFile: "ca.pem"}
+	require.NoError(t, cfg.Validate())
+	cfg.Authz.Rules[1].SourceCIDRs = []string{"10.0.0.0/33"}
+	cfg.Authz.Rules[1].Action = "reject"
+	err = cfg.Validate()
+	require.ErrorContains(t, err, "authz.rules[1].source_cidrs")
+	require.ErrorContains(t, err, `authz.rules[1].action: "reject" is not one of allow, deny`)
+
+	require.Equal(t, "disable", config.DefaultBootStrapConfig().Authz.Mode)
+}
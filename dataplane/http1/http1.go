@@ -0,0 +1,442 @@
+// Package http1 HTTP/1.1的增量解析。只观察连接两个方向的数据而不修改：从字节流中找出每个请求和响应的边界，
+// 支持Content-Length、chunked、直到连接关闭的响应体、keep-alive以及pipelining，
+// 响应按顺序与请求对应，每个请求结束时回调一次
+package http1
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxLineSize = 8 << 10
+	maxHeadSize = 64 << 10
+	maxPending  = 100 // pipelining时最多等待响应的请求数
+)
+
+// Exchange 一个请求及其响应
+type Exchange struct {
+	Method string
+	Path   string
+	Host   string
+	// Status 最终响应的状态码，连接在收到响应之前关闭时为0
+	Status        int
+	Start         time.Time     // 收到请求第一个字节的时间
+	Duration      time.Duration // 从收到请求第一个字节到响应结束
+	RequestBytes  int64         // 请求的字节数，包括起始行和头部
+	ResponseBytes int64         // 响应的字节数，包括1xx的中间响应
+}
+
+// Codec 一个连接上的解析状态。Request和Response可以在不同的协程中调用，但每个方向的数据需要按顺序传入
+type Codec struct {
+	lock    sync.Mutex
+	req     parser
+	resp    parser
+	pending []*Exchange // 已经收到请求头、还没有收到完整响应的请求
+	done    []Exchange
+	onDone  func(Exchange)
+	onHead  func(Exchange) error
+	err     error
+	closed  bool
+
+	interim bool // 当前响应是1xx的中间响应
+}
+
+// New onDone在请求结束时调用，不会在持有Codec内部锁时调用
+func New(onDone func(Exchange)) *Codec {
+	c := &Codec{onDone: onDone}
+	c.req.onHead, c.req.onEnd = c.requestHead, c.requestEnd
+	c.req.startLine = func(line string) bool {
+		_, _, ok := parseRequestLine(line)
+		return ok
+	}
+	c.resp.onHead, c.resp.onEnd = c.responseHead, c.responseEnd
+	c.resp.startLine = func(line string) bool {
+		_, ok := parseStatusLine(line)
+		return ok
+	}
+	return c
+}
+
+// OnRequest 设置收到每个请求头时的回调，Exchange中只有请求的字段。回调返回错误时Request返回该错误，之后不再解析。
+// 回调在持有Codec内部锁时调用，不能再调用Codec的方法
+func (c *Codec) OnRequest(f func(Exchange) error) {
+	c.lock.Lock()
+	c.onHead = f
+	c.lock.Unlock()
+}
+
+// Err 任一方向解析出错时返回第一个错误
+func (c *Codec) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// Request 传入下游 -> 上游方向的数据，需要在转发之前调用。
+// 数据不是合法的HTTP/1.x时返回错误，之后不再解析这个连接，只在第一次出错时返回
+func (c *Codec) Request(b []byte) error {
+	return c.write(&c.req, b)
+}
+
+// Response 传入上游 -> 下游方向的数据，需要在转发之前调用，返回值同Request
+func (c *Codec) Response(b []byte) error {
+	return c.write(&c.resp, b)
+}
+
+func (c *Codec) write(p *parser, b []byte) error {
+	c.lock.Lock()
+	var err error
+	if c.err == nil && !c.closed {
+		if err = p.write(b); err != nil {
+			c.err = err
+			c.pending = nil
+		}
+	}
+	done := c.done
+	c.done = nil
+	c.lock.Unlock()
+	c.report(done)
+	return err
+}
+
+// Close 连接结束。直到连接关闭才结束的响应在这里完成，还没有收到响应的请求以状态码0回调
+func (c *Codec) Close() {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return
+	}
+	c.closed = true
+	if c.err == nil {
+		if c.resp.state == stateUntilClose {
+			c.resp.end()
+		}
+		now := time.Now()
+		for _, ex := range c.pending {
+			ex.Duration = now.Sub(ex.Start)
+			c.done = append(c.done, *ex)
+		}
+		c.pending = nil
+	}
+	done := c.done
+	c.done = nil
+	c.lock.Unlock()
+	c.report(done)
+}
+
+func (c *Codec) report(done []Exchange) {
+	for _, ex := range done {
+		c.onDone(ex)
+	}
+}
+
+// tunnel 协议升级或CONNECT成功之后，两个方向都不再是HTTP
+func (c *Codec) tunnel() {
+	c.req.upgrade, c.resp.upgrade = true, true
+	if c.req.state == stateHead && c.req.n == 0 {
+		c.req.state = stateOpaque
+	}
+}
+
+func (c *Codec) requestHead(lines []string) (state, int64, error) {
+	method, target, _ := parseRequestLine(lines[0])
+	if len(c.pending) >= maxPending {
+		return 0, 0, errors.New("too many pipelined requests")
+	}
+	h := parseHeader(lines[1:])
+	ex := &Exchange{Method: method, Path: target, Host: h.get("host"), Start: c.req.start}
+	if c.onHead != nil {
+		if err := c.onHead(*ex); err != nil {
+			return 0, 0, err
+		}
+	}
+	c.pending = append(c.pending, ex)
+	c.req.cur = ex
+	if method == "CONNECT" {
+		// 没有消息体。收到2xx响应之后才是隧道，在这之前后面的数据仍按请求解析，见responseHead
+		return stateBody, 0, nil
+	}
+	switch length, chunked, err := h.framing(); {
+	case err != nil:
+		return 0, 0, err
+	case chunked:
+		return stateChunkSize, 0, nil
+	case len(h["transfer-encoding"]) > 0:
+		return 0, 0, errors.New("request body must be chunked when transfer-encoding is present")
+	case length < 0:
+		// 请求没有Content-Length时没有消息体
+		return stateBody, 0, nil
+	default:
+		return stateBody, length, nil
+	}
+}
+
+func (c *Codec) requestEnd(n int64) {
+	if ex := c.req.cur; ex != nil {
+		ex.RequestBytes = n
+	}
+	c.req.cur = nil
+}
+
+func (c *Codec) responseHead(lines []string) (state, int64, error) {
+	status, _ := parseStatusLine(lines[0])
+	if len(c.pending) == 0 {
+		return 0, 0, errors.New("response without request")
+	}
+	ex := c.pending[0]
+	c.interim = status >= 100 && status < 200 && status != 101
+	if c.interim {
+		return stateBody, 0, nil
+	}
+	ex.Status = status
+	if status == 101 || (ex.Method == "CONNECT" && status/100 == 2) {
+		c.tunnel()
+		return stateBody, 0, nil
+	}
+	if ex.Method == "HEAD" || status == 204 || status == 304 {
+		return stateBody, 0, nil
+	}
+	switch length, chunked, err := parseHeader(lines[1:]).framing(); {
+	case err != nil:
+		return 0, 0, err
+	case chunked:
+		return stateChunkSize, 0, nil
+	case length < 0:
+		return stateUntilClose, 0, nil
+	default:
+		return stateBody, length, nil
+	}
+}
+
+func (c *Codec) responseEnd(n int64) {
+	ex := c.pending[0]
+	ex.ResponseBytes += n
+	if c.interim {
+		c.interim = false
+		return
+	}
+	ex.Duration = time.Since(ex.Start)
+	c.pending = c.pending[1:]
+	c.done = append(c.done, *ex)
+}
+
+type state int
+
+const (
+	stateHead       state = iota // 起始行和头部
+	stateBody                    // 长度已知的消息体，remaining为剩余字节数
+	stateChunkSize               // chunk的长度行
+	stateChunkData               // chunk的数据
+	stateChunkEnd                // chunk数据之后的CRLF
+	stateTrailer                 // 最后一个chunk之后的trailer
+	stateUntilClose              // 直到连接关闭才结束的响应体
+	stateOpaque                  // 不再是HTTP，不再解析
+)
+
+// parser 一个方向的解析状态
+type parser struct {
+	state     state
+	line      []byte   // 还不完整的一行
+	lines     []string // 当前消息已经读到的起始行和头部
+	remaining int64
+	n         int64     // 当前消息已经读到的字节数
+	start     time.Time // 当前消息第一个字节到达的时间
+	upgrade   bool      // 当前消息结束之后不再是HTTP
+	cur       *Exchange // 请求方向正在读取的请求
+
+	// startLine 检查起始行，不是HTTP/1.x时不再等待头部
+	startLine func(line string) bool
+	onHead    func(lines []string) (state, int64, error)
+	onEnd     func(n int64)
+}
+
+func (p *parser) write(b []byte) error {
+	for len(b) > 0 {
+		switch p.state {
+		case stateOpaque:
+			return nil
+		case stateUntilClose:
+			p.n += int64(len(b))
+			return nil
+		case stateBody, stateChunkData:
+			k := min(int64(len(b)), p.remaining)
+			p.remaining -= k
+			p.n += k
+			b = b[k:]
+			if p.remaining == 0 {
+				if p.state == stateBody {
+					p.end()
+				} else {
+					p.state = stateChunkEnd
+				}
+			}
+		default:
+			if p.state == stateHead && p.n == 0 {
+				p.start = time.Now()
+			}
+			i := bytes.IndexByte(b, '\n')
+			if i < 0 {
+				if len(p.line)+len(b) > maxLineSize {
+					return errors.New("line too long")
+				}
+				p.line = append(p.line, b...)
+				p.n += int64(len(b))
+				return nil
+			}
+			line := append(p.line, b[:i]...)
+			p.line = line[:0]
+			p.n += int64(i + 1)
+			b = b[i+1:]
+			if err := p.lineDone(string(bytes.TrimSuffix(line, []byte("\r")))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *parser) lineDone(line string) error {
+	switch p.state {
+	case stateHead:
+		if line != "" {
+			if p.n > maxHeadSize {
+				return errors.New("header too large")
+			}
+			if len(p.lines) == 0 && !p.startLine(line) {
+				return fmt.Errorf("malformed start line %q", line)
+			}
+			p.lines = append(p.lines, line)
+			return nil
+		}
+		if len(p.lines) == 0 {
+			// 消息之间多余的空行
+			p.n = 0
+			return nil
+		}
+		next, length, err := p.onHead(p.lines)
+		if err != nil {
+			return err
+		}
+		p.lines = nil
+		p.state, p.remaining = next, length
+		if next == stateBody && length == 0 {
+			p.end()
+		}
+	case stateChunkSize:
+		size, _, _ := strings.Cut(line, ";")
+		n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("malformed chunk size %q", line)
+		}
+		if n == 0 {
+			p.state = stateTrailer
+		} else {
+			p.state, p.remaining = stateChunkData, n
+		}
+	case stateChunkEnd:
+		if line != "" {
+			return errors.New("missing CRLF after chunk data")
+		}
+		p.state = stateChunkSize
+	case stateTrailer:
+		if line == "" {
+			p.end()
+		}
+	}
+	return nil
+}
+
+// end 当前消息结束
+func (p *parser) end() {
+	p.onEnd(p.n)
+	p.n = 0
+	p.state = stateHead
+	if p.upgrade {
+		p.state = stateOpaque
+	}
+}
+
+// parseRequestLine 解析"GET /path HTTP/1.1"，absolute-form的请求只取路径部分
+func parseRequestLine(line string) (method, target string, ok bool) {
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 || parts[0] == "" || !strings.HasPrefix(parts[2], "HTTP/1.") {
+		return "", "", false
+	}
+	method, target = parts[0], parts[1]
+	if method == "CONNECT" || target == "*" || strings.HasPrefix(target, "/") {
+		return method, target, true
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return "", "", false
+	}
+	return method, u.RequestURI(), true
+}
+
+// parseStatusLine 解析"HTTP/1.1 200 OK"
+func parseStatusLine(line string) (int, bool) {
+	version, rest, _ := strings.Cut(line, " ")
+	code, _, _ := strings.Cut(rest, " ")
+	status, err := strconv.Atoi(code)
+	if !strings.HasPrefix(version, "HTTP/1.") || len(code) != 3 || err != nil || status < 100 {
+		return 0, false
+	}
+	return status, true
+}
+
+// header 只保留确定消息边界需要的头部，名称为小写
+type header map[string][]string
+
+func parseHeader(lines []string) header {
+	h := header{}
+	for _, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		name = strings.ToLower(name)
+		switch name {
+		case "host", "content-length", "transfer-encoding":
+			h[name] = append(h[name], strings.TrimSpace(value))
+		}
+	}
+	return h
+}
+
+func (h header) get(name string) string {
+	if v := h[name]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// framing 消息体的长度，chunked为true时按chunk读取，都没有时length为-1。
+// 同时存在Transfer-Encoding和Content-Length时以Transfer-Encoding为准
+func (h header) framing() (length int64, chunked bool, err error) {
+	if te := h["transfer-encoding"]; len(te) > 0 {
+		codings := strings.Split(strings.Join(te, ","), ",")
+		if strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			return 0, true, nil
+		}
+		// 最后一个编码不是chunked的消息体直到连接关闭才结束
+		return -1, false, nil
+	}
+	length = -1
+	for _, v := range h["content-length"] {
+		for _, s := range strings.Split(v, ",") {
+			n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+			if err != nil || n < 0 || (length >= 0 && n != length) {
+				return 0, false, fmt.Errorf("invalid content-length %q", v)
+			}
+			length = n
+		}
+	}
+	return length, false, nil
+}
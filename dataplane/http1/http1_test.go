@@ -0,0 +1,185 @@
+package http1_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/SMALL-head/zmesh/dataplane/http1"
+	"github.com/stretchr/testify/require"
+)
+
+// exchange 只比较与时间无关的字段
+type exchange struct {
+	Method, Path, Host string
+	Status             int
+	Request, Response  int64
+}
+
+func collect(c *[]exchange) func(http1.Exchange) {
+	return func(ex http1.Exchange) {
+		*c = append(*c, exchange{ex.Method, ex.Path, ex.Host, ex.Status, ex.RequestBytes, ex.ResponseBytes})
+	}
+}
+
+// feed 按顺序把每一段数据交给对应的方向，byByte为true时逐字节传入
+func feed(t *testing.T, c *http1.Codec, byByte bool, steps ...[2]string) {
+	for _, s := range steps {
+		write := c.Request
+		if s[0] == "resp" {
+			write = c.Response
+		}
+		data := []byte(s[1])
+		if !byByte {
+			require.NoError(t, write(data))
+			continue
+		}
+		for i := range data {
+			require.NoError(t, write(data[i:i+1]))
+		}
+	}
+}
+
+func TestCodec(t *testing.T) {
+	get := "GET /reviews?id=1 HTTP/1.1\r\nHost: reviews\r\n\r\n"
+	post := "POST http://ratings:8080/rate HTTP/1.1\r\nHost: ratings\r\nContent-Length: 5\r\n\r\nhello"
+	chunkedReq := "PUT /upload HTTP/1.1\r\nHost: up\r\nTransfer-Encoding: gzip, chunked\r\n\r\n3\r\nabc\r\n0\r\nX-Sum: 1\r\n\r\n"
+	ok := "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+	chunked := "HTTP/1.1 201 Created\r\nTransfer-Encoding: chunked\r\n\r\n4;ext=1\r\nrate\r\n2\r\nd!\r\n0\r\n\r\n"
+
+	notFound := "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n"
+	head, headResp := "HEAD / HTTP/1.1\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n"
+	del, noContent := "DELETE /r/1 HTTP/1.1\r\n\r\n", "HTTP/1.1 204 No Content\r\n\r\n"
+	notModified := "HTTP/1.1 304 Not Modified\r\nContent-Length: 100\r\n\r\n"
+	expect, interim := "POST /big HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 3\r\n\r\n", "HTTP/1.1 100 Continue\r\n\r\n"
+	upgrade := "GET /ws HTTP/1.1\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"
+	switching := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n"
+	connect := "CONNECT ratings:443 HTTP/1.1\r\nHost: ratings:443\r\n\r\n"
+	established, forbidden := "HTTP/1.1 200 Connection Established\r\n\r\n", "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"
+	n := func(s ...string) int64 {
+		var total int
+		for _, v := range s {
+			total += len(v)
+		}
+		return int64(total)
+	}
+
+	for _, c := range []struct {
+		name  string
+		steps [][2]string
+		want  []exchange
+	}{
+		{"keep-alive", [][2]string{{"req", get}, {"resp", ok}, {"req", post}, {"resp", chunked}, {"req", chunkedReq}, {"resp", ok}}, []exchange{
+			{"GET", "/reviews?id=1", "reviews", 200, n(get), n(ok)},
+			{"POST", "/rate", "ratings", 201, n(post), n(chunked)},
+			{"PUT", "/upload", "up", 200, n(chunkedReq), n(ok)},
+		}},
+		// 请求之间多余的空行不计入请求
+		{"pipelining", [][2]string{{"req", get + post + "\r\n" + get}, {"resp", ok + chunked}, {"resp", notFound}}, []exchange{
+			{"GET", "/reviews?id=1", "reviews", 200, n(get), n(ok)},
+			{"POST", "/rate", "ratings", 201, n(post), n(chunked)},
+			{"GET", "/reviews?id=1", "reviews", 404, n(get), n(notFound)},
+		}},
+		{"no body", [][2]string{{"req", head}, {"resp", headResp}, {"req", del}, {"resp", noContent}, {"req", get}, {"resp", notModified}}, []exchange{
+			{"HEAD", "/", "", 200, n(head), n(headResp)},
+			{"DELETE", "/r/1", "", 204, n(del), n(noContent)},
+			{"GET", "/reviews?id=1", "reviews", 304, n(get), n(notModified)},
+		}},
+		{"100-continue", [][2]string{{"req", expect}, {"resp", interim}, {"req", "abc"}, {"resp", ok}}, []exchange{
+			{"POST", "/big", "", 200, n(expect, "abc"), n(interim, ok)},
+		}},
+		// 升级之后的数据不再解析
+		{"upgrade", [][2]string{{"req", upgrade}, {"resp", switching}, {"req", "\x81\x05hello"}, {"resp", "\x81\x02hi"}}, []exchange{
+			{"GET", "/ws", "", 101, n(upgrade), n(switching)},
+		}},
+		{"connect", [][2]string{{"req", connect}, {"resp", established}, {"req", "\x16\x03\x01"}, {"resp", "\x16\x03\x03"}}, []exchange{
+			{"CONNECT", "ratings:443", "ratings:443", 200, n(connect), n(established)},
+		}},
+		// CONNECT被拒绝时后面的数据仍是请求
+		{"connect refused", [][2]string{{"req", connect + get}, {"resp", forbidden + ok}}, []exchange{
+			{"CONNECT", "ratings:443", "ratings:443", 403, n(connect), n(forbidden)},
+			{"GET", "/reviews?id=1", "reviews", 200, n(get), n(ok)},
+		}},
+	} {
+		for _, byByte := range []bool{false, true} {
+			t.Run(c.name, func(t *testing.T) {
+				var got []exchange
+				codec := http1.New(collect(&got))
+				feed(t, codec, byByte, c.steps...)
+				codec.Close()
+				require.Equal(t, c.want, got)
+			})
+		}
+	}
+}
+
+func TestCodecClose(t *testing.T) {
+	var got []exchange
+	codec := http1.New(collect(&got))
+	// 没有长度的响应直到连接关闭才结束，之后pipelining的请求没有响应
+	feed(t, codec, false,
+		[2]string{"req", "GET /a HTTP/1.0\r\n\r\nGET /b HTTP/1.0\r\n\r\n"},
+		[2]string{"resp", "HTTP/1.0 200 OK\r\n\r\nbody"})
+	require.Empty(t, got)
+	codec.Close()
+	require.Equal(t, []exchange{{"GET", "/a", "", 200, 19, 23}, {"GET", "/b", "", 0, 19, 0}}, got)
+	// 关闭之后的数据被忽略
+	require.NoError(t, codec.Request([]byte("GET /c HTTP/1.1\r\n\r\n")))
+	codec.Close()
+	require.Len(t, got, 2)
+}
+
+func TestCodecInvalid(t *testing.T) {
+	for name, steps := range map[string][][2]string{
+		"not http":            {{"req", "\x16\x03\x01\x00\x05hello\n"}},
+		"response first":      {{"resp", "HTTP/1.1 200 OK\r\n\r\n"}},
+		"bad chunk":           {{"req", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n"}},
+		"conflicting lengths": {{"req", "POST / HTTP/1.1\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\n"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var got []exchange
+			codec := http1.New(collect(&got))
+			s := steps[0]
+			write := codec.Request
+			if s[0] == "resp" {
+				write = codec.Response
+			}
+			require.Error(t, write([]byte(s[1])))
+			// 出错之后不再解析，也不回调
+			require.NoError(t, codec.Request([]byte("GET / HTTP/1.1\r\n\r\n")))
+			require.Error(t, codec.Err())
+			codec.Close()
+			require.Empty(t, got)
+		})
+	}
+}
+
+func TestCodecOnRequest(t *testing.T) {
+	var got []exchange
+	var heads []string
+	codec := http1.New(collect(&got))
+	codec.OnRequest(func(ex http1.Exchange) error {
+		heads = append(heads, ex.Method+" "+ex.Path)
+		if ex.Path == "/admin" {
+			return errors.New("denied")
+		}
+		return nil
+	})
+	// 回调在请求头结束时调用，不等待响应
+	require.NoError(t, codec.Request([]byte("GET /a HTTP/1.1\r\n\r\nPOST /b HTTP/1.1\r\nContent-Length: 1\r\n\r\nx")))
+	require.Equal(t, []string{"GET /a", "POST /b"}, heads)
+	require.EqualError(t, codec.Request([]byte("GET /admin HTTP/1.1\r\n\r\n")), "denied")
+	require.NoError(t, codec.Request([]byte("GET /c HTTP/1.1\r\n\r\n")))
+	require.Equal(t, []string{"GET /a", "POST /b", "GET /admin"}, heads)
+	codec.Close()
+	require.Empty(t, got)
+
+	// CONNECT的响应到达之前，后面的数据仍按请求回调
+	heads = nil
+	codec = http1.New(collect(&got))
+	codec.OnRequest(func(ex http1.Exchange) error {
+		heads = append(heads, ex.Method+" "+ex.Path)
+		return nil
+	})
+	require.NoError(t, codec.Request([]byte("CONNECT ratings:443 HTTP/1.1\r\n\r\nGET /admin HTTP/1.1\r\n\r\n")))
+	require.Equal(t, []string{"CONNECT ratings:443", "GET /admin"}, heads)
+}
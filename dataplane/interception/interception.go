@@ -0,0 +1,147 @@
+// Package interception 定义流量拦截规则的声明式配置以及拦截后端的公共接口，
+// iptables和nftables两个后端分别实现
+package interception
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// 入站流量的拦截方式
+const (
+	// ModeRedirect nat表REDIRECT，目的地址被改写，应用看到的客户端地址是proxy
+	ModeRedirect = "redirect"
+	// ModeTProxy mangle表TPROXY，不修改数据包，配合透明监听的proxy保留客户端源地址
+	ModeTProxy = "tproxy"
+
+	DefaultTProxyMark  = 1337
+	DefaultTProxyTable = 133
+)
+
+// Spec 声明式的流量拦截配置，由各后端渲染成完整的规则集
+type Spec struct {
+	OutboundPort int // 本地进程发出的流量重定向到该端口
+	InboundPort  int // 进入pod的流量重定向到该端口
+
+	// 入站流量的拦截方式，为空时使用ModeRedirect，出站流量总是使用REDIRECT
+	InboundMode string
+	// tproxy模式下标记流量的mark以及策略路由使用的路由表，为0时使用默认值
+	TProxyMark  int
+	TProxyTable int
+
+	// proxy发起的连接带有该SO_MARK，带mark的流量不再重定向，proxy可以运行在任意uid下。为0时只按uid排除
+	ProxyMark int
+	ProxyUID  int // proxy进程的uid，由它发出的流量不再重定向，设置了ProxyMark时为0表示不按uid排除
+	ProxyGID  int // proxy进程的gid，为0时不按gid排除
+
+	// 其他不经过mesh的进程，由它们发出的流量不重定向
+	ExemptUIDs []int
+	ExemptGIDs []int
+
+	// 只拦截目的地址在这些网段内的出站流量，ipv4与ipv6分别生效，某个地址族没有配置时该地址族不限制
+	CaptureCIDRs []string
+	// 不拦截的出站目的网段，优先于CaptureCIDRs
+	ExcludeOutboundCIDRs []string
+
+	// 只拦截这些目的端口的流量，为空时拦截所有端口
+	IncludeInboundPorts  []int
+	IncludeOutboundPorts []int
+	// 不拦截的目的端口，优先于Include
+	ExcludeInboundPorts  []int
+	ExcludeOutboundPorts []int
+}
+
+// TProxy 入站是否使用tproxy模式
+func (s Spec) TProxy() bool {
+	return s.InboundMode == ModeTProxy
+}
+
+// TProxyRoute 返回tproxy模式在指定地址族下所需的策略路由
+func (s Spec) TProxyRoute(ipv6 bool) TProxyRoute {
+	r := TProxyRoute{Mark: s.TProxyMark, Table: s.TProxyTable, IPv6: ipv6}
+	if r.Mark == 0 {
+		r.Mark = DefaultTProxyMark
+	}
+	if r.Table == 0 {
+		r.Table = DefaultTProxyTable
+	}
+	return r
+}
+
+// ExemptMarks 不重定向的流量所带的mark：proxy的SO_MARK，以及tproxy模式下inbound连接应用时使用的mark
+func (s Spec) ExemptMarks() []int {
+	var marks []int
+	if s.ProxyMark > 0 {
+		marks = append(marks, s.ProxyMark)
+	}
+	if s.TProxy() {
+		marks = append(marks, s.TProxyRoute(false).Mark)
+	}
+	return marks
+}
+
+// ExemptIDs 不重定向的uid和gid。其中的0总是被忽略，否则root发出的流量都不经过mesh，
+// proxy以root运行时需要设置ProxyMark
+func (s Spec) ExemptIDs() (uids, gids []int) {
+	return nonRoot(append([]int{s.ProxyUID}, s.ExemptUIDs...)), nonRoot(append([]int{s.ProxyGID}, s.ExemptGIDs...))
+}
+
+func nonRoot(ids []int) []int {
+	var res []int
+	for _, id := range ids {
+		if id > 0 {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// FamilyCIDRs 返回cidrs中属于指定地址族的网段，按掩码规整
+func FamilyCIDRs(cidrs []string, ipv6 bool) ([]netip.Prefix, error) {
+	var res []netip.Prefix
+	for _, c := range cidrs {
+		prefix, err := netip.ParsePrefix(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q: %w", c, err)
+		}
+		if prefix.Addr().Is6() == ipv6 {
+			res = append(res, prefix.Masked())
+		}
+	}
+	return res, nil
+}
+
+// Backend 拦截规则的安装方式，setup/reconcile/cleanup的语义在各后端之间保持一致
+type Backend interface {
+	// Name 后端名称，iptables或nftables
+	Name() string
+	// Apply 按Spec原子地安装规则，可以重复执行
+	Apply(spec Spec) error
+	// Diff 只读地比较当前规则与Spec，返回不一致的链
+	Diff(spec Spec) ([]Drift, error)
+	// Reconcile 只修复不一致的部分，返回修复前发现的差异
+	Reconcile(spec Spec) ([]Drift, error)
+	// Cleanup 删除zmesh安装的所有规则，Spec只用于确定tproxy策略路由的mark和路由表
+	Cleanup(spec Spec) error
+}
+
+// Drift 某条链的实际规则与期望不一致的部分
+type Drift struct {
+	IPv6       bool
+	Table      string
+	Chain      string
+	Missing    []string // 期望存在但实际没有的规则
+	Unexpected []string // 实际存在但不期望的规则，包括顺序不对的规则
+	Obsolete   bool     // 整条链都不应该存在
+}
+
+func (d Drift) String() string {
+	family := "ipv4"
+	if d.IPv6 {
+		family = "ipv6"
+	}
+	if d.Obsolete {
+		return fmt.Sprintf("%s %s/%s: obsolete chain with %d rules", family, d.Table, d.Chain, len(d.Unexpected))
+	}
+	return fmt.Sprintf("%s %s/%s: missing %q, unexpected %q", family, d.Table, d.Chain, d.Missing, d.Unexpected)
+}
@@ -0,0 +1,139 @@
+package interception
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// TProxyRoute tproxy所需的策略路由：带Mark的包查询单独的路由表Table，
+// 该表把所有地址都视为本机地址交给lo，使得目的地址不是本机的包也能被本地的透明socket接收
+type TProxyRoute struct {
+	Mark  int
+	Table int
+	IPv6  bool
+}
+
+func (r TProxyRoute) family() int {
+	if r.IPv6 {
+		return netlink.FAMILY_V6
+	}
+	return netlink.FAMILY_V4
+}
+
+func (r TProxyRoute) rule() *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Family = r.family()
+	rule.Mark = uint32(r.Mark)
+	rule.Table = r.Table
+	return rule
+}
+
+func (r TProxyRoute) route() (*netlink.Route, error) {
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		return nil, err
+	}
+	dst := &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+	if r.IPv6 {
+		dst = &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+	}
+	return &netlink.Route{
+		Family:    r.family(),
+		Type:      unix.RTN_LOCAL,
+		Scope:     netlink.SCOPE_HOST,
+		Table:     r.Table,
+		Dst:       dst,
+		LinkIndex: lo.Attrs().Index,
+	}, nil
+}
+
+func (r TProxyRoute) ruleText() string {
+	return fmt.Sprintf("fwmark %#x lookup %d", r.Mark, r.Table)
+}
+
+func (r TProxyRoute) routeText() string {
+	return fmt.Sprintf("local default dev lo table %d", r.Table)
+}
+
+func (r TProxyRoute) state() (hasRule, hasRoute bool, err error) {
+	rules, err := netlink.RuleListFiltered(r.family(), r.rule(), netlink.RT_FILTER_MARK|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return false, false, fmt.Errorf("error listing ip rules: %w", err)
+	}
+	routes, err := netlink.RouteListFiltered(r.family(), &netlink.Route{Table: r.Table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return false, false, fmt.Errorf("error listing routes of table %d: %w", r.Table, err)
+	}
+	for _, rt := range routes {
+		// 默认路由的Dst可能为nil，也可能是0.0.0.0/0
+		if rt.Type == unix.RTN_LOCAL && (rt.Dst == nil || rt.Dst.IP.IsUnspecified()) {
+			hasRoute = true
+		}
+	}
+	return len(rules) > 0, hasRoute, nil
+}
+
+// Ensure 添加缺失的策略路由，可以重复执行
+func (r TProxyRoute) Ensure() error {
+	hasRule, hasRoute, err := r.state()
+	if err != nil {
+		return err
+	}
+	if !hasRoute {
+		rt, err := r.route()
+		if err != nil {
+			return err
+		}
+		if err := netlink.RouteReplace(rt); err != nil {
+			return fmt.Errorf("error adding %s: %w", r.routeText(), err)
+		}
+	}
+	if !hasRule {
+		if err := netlink.RuleAdd(r.rule()); err != nil {
+			return fmt.Errorf("error adding ip rule %s: %w", r.ruleText(), err)
+		}
+	}
+	return nil
+}
+
+// Drift 策略路由缺失时返回对应的差异，没有差异时返回nil
+func (r TProxyRoute) Drift() (*Drift, error) {
+	hasRule, hasRoute, err := r.state()
+	if err != nil || (hasRule && hasRoute) {
+		return nil, err
+	}
+	d := &Drift{IPv6: r.IPv6, Table: "route", Chain: fmt.Sprintf("table %d", r.Table)}
+	if !hasRule {
+		d.Missing = append(d.Missing, r.ruleText())
+	}
+	if !hasRoute {
+		d.Missing = append(d.Missing, r.routeText())
+	}
+	return d, nil
+}
+
+// Delete 删除策略路由，不存在时忽略
+func (r TProxyRoute) Delete() error {
+	for {
+		err := netlink.RuleDel(r.rule())
+		if errors.Is(err, syscall.ENOENT) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error deleting ip rule %s: %w", r.ruleText(), err)
+		}
+	}
+	rt, err := r.route()
+	if err != nil {
+		return err
+	}
+	if err := netlink.RouteDel(rt); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return fmt.Errorf("error deleting %s: %w", r.routeText(), err)
+	}
+	return nil
+}
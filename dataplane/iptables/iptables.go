@@ -1,6 +1,7 @@
 package iptables
 
 import (
+	"github.com/SMALL-head/zmesh/dataplane/interception"
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/sirupsen/logrus"
 )
@@ -11,8 +12,13 @@ var (
 	MESH_OUPUT_CHAIN      = "ZMESH_OUTPUT"
 	MESH_PREROUTING_CHAIN = "ZMESH_PREROUTING"
 
-	// MARK
-	PROXY_PACKET_MARK       = "77"
+	// tproxy模式下mangle表中的链：INBOUND拦截入站流量，DIVERT把已有透明连接的包交给本机，
+	// RESTORE让应用发往客户端地址的回包带上mark，经策略路由回到proxy
+	MESH_INBOUND_CHAIN = "ZMESH_INBOUND"
+	MESH_DIVERT_CHAIN  = "ZMESH_DIVERT"
+	MESH_RESTORE_CHAIN = "ZMESH_RESTORE"
+
+	// MARK，proxy连接所带的mark由interception.proxy_mark配置
 	OUTBOUND_CONNTRACK_MARK = "0x43"
 
 	// Basic rules for zmesh
@@ -20,72 +26,132 @@ var (
 		// jump rules
 		{"nat", "OUTPUT", "-p", "tcp", "-j", MESH_OUPUT_CHAIN},
 		{"nat", "PREROUTING", "-p", "tcp", "-j", MESH_PREROUTING_CHAIN},
+	}
+
+	// tproxy模式的跳转规则和链
+	tproxyRules = [][]string{
+		{"mangle", "PREROUTING", "-p", "tcp", "-j", MESH_INBOUND_CHAIN},
+		{"mangle", "OUTPUT", "-p", "tcp", "-j", MESH_RESTORE_CHAIN},
+	}
+	tproxyChains = [][]string{
+		{"mangle", MESH_INBOUND_CHAIN},
+		{"mangle", MESH_DIVERT_CHAIN},
+		{"mangle", MESH_RESTORE_CHAIN},
+	}
+
+	// 早期版本在mangle表中创建的跳转规则，目前没有用到，只在清理时删除
+	legacyRules = [][]string{
 		{"mangle", "PREROUTING", "-p", "tcp", "-j", MESH_PREROUTING_CHAIN},
 		{"mangle", "OUTPUT", "-p", "tcp", "-j", MESH_OUPUT_CHAIN},
 	}
+
+	// zmesh创建的链：table, chain
+	meshChains = [][]string{
+		{"nat", MESH_OUPUT_CHAIN},
+		{"nat", MESH_PREROUTING_CHAIN},
+	}
+	legacyChains = [][]string{
+		{"mangle", MESH_OUPUT_CHAIN},
+		{"mangle", MESH_PREROUTING_CHAIN},
+	}
 )
 
+// Manager 网段、端口等拦截参数不再保存在Manager中，统一由Apply的Spec传入
 type Manager struct {
 	Ipt       *iptables.IPTables
+	Ip6t      *iptables.IPTables // 节点不支持ip6tables时为nil
 	ChainName string
-	PodCIDR   string
 }
 
 func New(chainName string) (Manager, error) {
 	tables, err := iptables.New()
 	if err != nil {
-		logrus.Fatalf("error creating iptables manager: %s", err)
-		return Manager{}, nil
+		return Manager{}, err
+	}
+	tables6, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
+	if err != nil {
+		logrus.Warnf("ip6tables is not available, ipv6 interception disabled: %s", err)
+		tables6 = nil
 	}
 	return Manager{
 		Ipt:       tables,
+		Ip6t:      tables6,
 		ChainName: chainName,
-		PodCIDR:   "10.10.0.0/16",
 	}, nil
 }
 
+// tables 返回所有可用的地址族对应的iptables
+func (m *Manager) tables() []*iptables.IPTables {
+	if m.Ip6t == nil {
+		return []*iptables.IPTables{m.Ipt}
+	}
+	return []*iptables.IPTables{m.Ipt, m.Ip6t}
+}
+
 // SetupBasicRules 创建zmesh所需要的基本规则
 func (m *Manager) SetupBasicRules() error {
-	// 创建必要的链条
-	if err := m.Ipt.NewChain("nat", MESH_OUPUT_CHAIN); err != nil {
-		logrus.Errorf("[SetupBasicRules] error creating MESH_OUTPUT_CHAIN: %s", err)
-	}
-	if err := m.Ipt.NewChain("nat", MESH_PREROUTING_CHAIN); err != nil {
-		logrus.Errorf("[SetupBasicRules] error creating MESH_PREROUTING_CHAIN: %s", err)
-	}
-	if err := m.Ipt.NewChain("mangle", MESH_OUPUT_CHAIN); err != nil {
-		logrus.Errorf("[SetupBasicRules] error creating MESH_OUPUT_CHAIN in mangle table: %s", err)
-	}
-	if err := m.Ipt.NewChain("mangle", MESH_PREROUTING_CHAIN); err != nil {
-		logrus.Errorf("[SetupBasicRules] error creating MESH_PREROUTING_CHAIN in mangle table: %s", err)
-	}
+	for _, ipt := range m.tables() {
+		// 创建必要的链条，已存在的跳过，保证可以重复执行
+		for _, tc := range meshChains {
+			if ok, _ := ipt.ChainExists(tc[0], tc[1]); ok {
+				continue
+			}
+			if err := ipt.NewChain(tc[0], tc[1]); err != nil {
+				logrus.Errorf("[SetupBasicRules] error creating %s in %s table: %s", tc[1], tc[0], err)
+			}
+		}
 
-	// 基础跳转规则
-	for _, rule := range basicRules {
-		if err := m.Ipt.AppendUnique(rule[0], rule[1], rule[2:]...); err != nil {
-			return err
+		// 基础跳转规则
+		for _, rule := range basicRules {
+			if err := ipt.AppendUnique(rule[0], rule[1], rule[2:]...); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
+// ClearBasicRules 删除zmesh的跳转规则和链。链被引用时无法删除，因此先删跳转规则，再清空并删除链
 func (m *Manager) ClearBasicRules() {
-	if b, _ := m.Ipt.ChainExists("nat", MESH_OUPUT_CHAIN); b {
-		m.Ipt.DeleteChain("nat", MESH_OUPUT_CHAIN)
-	}
-	if b, _ := m.Ipt.ChainExists("nat", MESH_PREROUTING_CHAIN); b {
-		m.Ipt.DeleteChain("nat", MESH_PREROUTING_CHAIN)
-	}
-	if b, _ := m.Ipt.ChainExists("mangle", MESH_OUPUT_CHAIN); b {
-		m.Ipt.DeleteChain("mangle", MESH_OUPUT_CHAIN)
-	}
-	if b, _ := m.Ipt.ChainExists("mangle", MESH_PREROUTING_CHAIN); b {
-		m.Ipt.DeleteChain("mangle", MESH_PREROUTING_CHAIN)
+	for _, ipt := range m.tables() {
+		for _, rule := range concat(basicRules, tproxyRules, legacyRules) {
+			if ok, _ := ipt.Exists(rule[0], rule[1], rule[2:]...); !ok {
+				continue
+			}
+			if err := ipt.Delete(rule[0], rule[1], rule[2:]...); err != nil {
+				logrus.Errorf("[ClearBasicRules] error deleting rule %v: %s", rule, err)
+			}
+		}
+		for _, tc := range concat(meshChains, tproxyChains, legacyChains) {
+			if ok, _ := ipt.ChainExists(tc[0], tc[1]); !ok {
+				continue
+			}
+			if err := ipt.ClearAndDeleteChain(tc[0], tc[1]); err != nil {
+				logrus.Errorf("[ClearBasicRules] error deleting chain %s in %s table: %s", tc[1], tc[0], err)
+			}
+		}
 	}
-	for _, rule := range basicRules {
-		err := m.Ipt.Delete(rule[0], rule[1], rule[2:]...)
-		if err != nil {
-			logrus.Errorf("[ClearBasicRules] error deleting rule %v: %s", rule, err)
+}
+
+// Cleanup 删除Apply安装的所有规则、链以及tproxy的策略路由，单条规则删除失败只记录日志
+func (m *Manager) Cleanup(spec interception.Spec) error {
+	m.ClearBasicRules()
+	for _, ipt := range m.tables() {
+		if err := spec.TProxyRoute(ipt.Proto() == iptables.ProtocolIPv6).Delete(); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+func concat(lists ...[][]string) [][]string {
+	var res [][]string
+	for _, l := range lists {
+		res = append(res, l...)
+	}
+	return res
+}
+
+func (m *Manager) Name() string {
+	return "iptables"
 }
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"strconv"
+
+	"github.com/SMALL-head/zmesh/dataplane/interception"
 	"github.com/SMALL-head/zmesh/dataplane/iptables"
 	"github.com/sirupsen/logrus"
 )
@@ -11,11 +14,19 @@ func main() {
 		logrus.Fatal("error creating iptables manager: ", err)
 	}
 
-	DefaultSidecarRule(m)
+	DefaultSidecarRule(m, sidecarSpec)
 	// DefaultSidecarRuleClean(m)
 }
 
-func SceneOutBound(m iptables.Manager) {
+// sidecarSpec 实验场景使用的固定参数，实际部署使用zmesh iptables setup按配置安装
+var sidecarSpec = interception.Spec{
+	OutboundPort: 8090,
+	InboundPort:  8092,
+	ProxyUID:     1337,
+	CaptureCIDRs: []string{"10.10.0.0/16"},
+}
+
+func SceneOutBound(m iptables.Manager, spec interception.Spec) {
 	// 注：数据包流出方向，首先经过四表的OUTPUT链。路由选择后走POSTROUTING链。
 	if b, _ := m.Ipt.ChainExists("nat", iptables.MESH_OUPUT_CHAIN); !b {
 		err := m.Ipt.NewChain("nat", iptables.MESH_OUPUT_CHAIN)
@@ -34,31 +45,35 @@ func SceneOutBound(m iptables.Manager) {
 		logrus.Errorf("[SceneOutBound] error appending rule to OUTPUT chain: %s", err)
 		return
 	}
-	m.PodCIDR = "10.10.0.0/16"
+	uids, _ := spec.ExemptIDs()
+	for _, uid := range uids {
+		err = m.Ipt.AppendUnique(
+			"nat", iptables.MESH_OUPUT_CHAIN,
+			"-p", "tcp",
+			"-m", "owner", "--uid-owner", strconv.Itoa(uid),
+			"-j", "RETURN",
+		)
 
-	err = m.Ipt.AppendUnique(
-		"nat", iptables.MESH_OUPUT_CHAIN,
-		"-p", "tcp",
-		"-m", "owner", "--uid-owner", "1337",
-		"-j", "RETURN",
-	)
-
-	if err != nil {
-		logrus.Errorf("[SceneOutBound] error appending rule1 to MESH_OUTPUT_CHAIN: %s", err)
-		return
+		if err != nil {
+			logrus.Errorf("[SceneOutBound] error appending rule1 to MESH_OUTPUT_CHAIN: %s", err)
+			return
+		}
 	}
 
-	err = m.Ipt.AppendUnique(
-		"nat", iptables.MESH_OUPUT_CHAIN,
-		"-p", "tcp",
-		"-d", m.PodCIDR,
-		"!", "--sport", "8090", // 从proxy返回给src的流量不应该被重定向
-		"-j", "REDIRECT",
-		"--to-ports", "8090") // 转发流量至proxy
+	out := strconv.Itoa(spec.OutboundPort)
+	for _, cidr := range spec.CaptureCIDRs {
+		err = m.Ipt.AppendUnique(
+			"nat", iptables.MESH_OUPUT_CHAIN,
+			"-p", "tcp",
+			"-d", cidr,
+			"!", "--sport", out, // 从proxy返回给src的流量不应该被重定向
+			"-j", "REDIRECT",
+			"--to-ports", out) // 转发流量至proxy
 
-	if err != nil {
-		logrus.Errorf("[SceneOutBound] error appending rule to MESH_OUTPUT_CHAIN: %s", err)
-		return
+		if err != nil {
+			logrus.Errorf("[SceneOutBound] error appending rule to MESH_OUTPUT_CHAIN: %s", err)
+			return
+		}
 	}
 
 	// 下一个规则的反条件，对于特定的数据包，不要打OUTBOUND_CONNTRACK_MARK标记
@@ -155,7 +170,7 @@ func SceneOutBoundClean(m iptables.Manager) {
 }
 
 // SceneInbound 这个场景是为了测试Mesh2Mesh的转发逻辑
-func SceneInbound(m iptables.Manager) {
+func SceneInbound(m iptables.Manager, spec interception.Spec) {
 	if b, _ := m.Ipt.ChainExists("nat", iptables.MESH_PREROUTING_CHAIN); !b {
 		err := m.Ipt.NewChain("nat", iptables.MESH_PREROUTING_CHAIN)
 		if err != nil {
@@ -169,16 +184,19 @@ func SceneInbound(m iptables.Manager) {
 		return
 	}
 
-	err = m.Ipt.AppendUnique("nat", iptables.MESH_PREROUTING_CHAIN,
-		"-p", "tcp",
-		"-d", m.PodCIDR,
-		"!", "--sport", "8092", // 从proxy返回给src的流量不应该被重定向
-		"-j", "REDIRECT",
-		"--to-ports", "8092",
-	)
-	if err != nil {
-		logrus.Errorf("[SceneInbound] error appending rule to MESH_PREROUTING_CHAIN: %s", err)
-		return
+	in := strconv.Itoa(spec.InboundPort)
+	for _, cidr := range spec.CaptureCIDRs {
+		err = m.Ipt.AppendUnique("nat", iptables.MESH_PREROUTING_CHAIN,
+			"-p", "tcp",
+			"-d", cidr,
+			"!", "--sport", in, // 从proxy返回给src的流量不应该被重定向
+			"-j", "REDIRECT",
+			"--to-ports", in,
+		)
+		if err != nil {
+			logrus.Errorf("[SceneInbound] error appending rule to MESH_PREROUTING_CHAIN: %s", err)
+			return
+		}
 	}
 
 }
@@ -198,14 +216,13 @@ func SceneInboundClean(m iptables.Manager) {
 	}
 }
 
-func DefaultSidecarRule(m iptables.Manager) {
-	m.SetupBasicRules()
-	SceneOutBound(m)
-	SceneInbound(m)
+// DefaultSidecarRule 按spec安装sidecar规则
+func DefaultSidecarRule(m iptables.Manager, spec interception.Spec) {
+	if err := m.Apply(spec); err != nil {
+		logrus.Errorf("[DefaultSidecarRule] error applying sidecar rules: %s", err)
+	}
 }
 
 func DefaultSidecarRuleClean(m iptables.Manager) {
-	SceneOutBoundClean(m)
-	SceneInboundClean(m)
-	m.ClearBasicRules()
+	_ = m.Cleanup(sidecarSpec)
 }
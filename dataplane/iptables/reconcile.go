@@ -0,0 +1,346 @@
+package iptables
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/SMALL-head/zmesh/dataplane/interception"
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/sirupsen/logrus"
+)
+
+// ChainDiff 把一条链从current变为desired所需的操作，规则均为不带"-A chain"前缀的rulespec
+type ChainDiff struct {
+	// 需要删除的规则，按出现顺序逐条删除
+	Deletes [][]string
+	// 删除之后按顺序插入的规则，Pos从1开始，插入时前面的规则已经就位
+	Inserts []RuleInsert
+}
+
+type RuleInsert struct {
+	Pos  int
+	Rule []string
+}
+
+func (d ChainDiff) Empty() bool {
+	return len(d.Deletes) == 0 && len(d.Inserts) == 0
+}
+
+// DiffChain 计算有序规则列表之间的差异：保留两者的最长公共子序列，其余的规则删除或插入，
+// 因此顺序错误的规则会被删除后在正确的位置重新插入
+func DiffChain(current, desired [][]string) ChainDiff {
+	n, m := len(current), len(desired)
+	// lcs[i][j]为current[i:]与desired[j:]的最长公共子序列长度
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if sameRule(current[i], desired[j]) {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var diff ChainDiff
+	kept := make([]bool, m)
+	for i, j := 0, 0; i < n || j < m; {
+		switch {
+		case i < n && j < m && sameRule(current[i], desired[j]):
+			kept[j] = true
+			i++
+			j++
+		case j == m || (i < n && lcs[i+1][j] >= lcs[i][j+1]):
+			diff.Deletes = append(diff.Deletes, current[i])
+			i++
+		default:
+			j++
+		}
+	}
+	for j, rule := range desired {
+		if !kept[j] {
+			diff.Inserts = append(diff.Inserts, RuleInsert{Pos: j + 1, Rule: rule})
+		}
+	}
+	return diff
+}
+
+// sameRule 比较两条rulespec。iptables -S输出的规则会补上隐式的"-m tcp"并调整参数顺序，
+// 因此去掉隐式匹配后按参数集合比较
+func sameRule(a, b []string) bool {
+	return canonical(a) == canonical(b)
+}
+
+func canonical(rule []string) string {
+	var opts []string
+	for i := 0; i < len(rule); i++ {
+		tok := rule[i]
+		if tok == "-m" && i+1 < len(rule) && (rule[i+1] == "tcp" || rule[i+1] == "udp") {
+			i++
+			continue
+		}
+		// 选项与其参数(以及前面的"!")作为一个整体
+		opt := tok
+		if tok == "!" && i+1 < len(rule) {
+			i++
+			opt += " " + rule[i]
+		}
+		for i+1 < len(rule) && !strings.HasPrefix(rule[i+1], "-") && rule[i+1] != "!" {
+			i++
+			opt += " " + rule[i]
+		}
+		opts = append(opts, opt)
+	}
+	sort.Strings(opts)
+	return strings.Join(opts, " ")
+}
+
+// listRules 读取链中的规则，去掉"-A chain"前缀
+func listRules(ipt *iptables.IPTables, table, chain string) ([][]string, error) {
+	lines, err := ipt.List(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	var rules [][]string
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "-A" {
+			continue
+		}
+		rules = append(rules, fields[2:])
+	}
+	return rules, nil
+}
+
+// chainRules 返回规则集中属于chain的规则
+func chainRules(rules [][]string, chain string) [][]string {
+	var res [][]string
+	for _, r := range rules {
+		if r[0] == chain {
+			res = append(res, r[1:])
+		}
+	}
+	return res
+}
+
+func hasChain(chains [][]string, table, chain string) bool {
+	for _, c := range chains {
+		if c[0] == table && c[1] == chain {
+			return true
+		}
+	}
+	return false
+}
+
+// allChains zmesh可能创建的所有链，整条删除时按此顺序，被引用的链排在引用它的链之后
+var allChains = concat(meshChains, tproxyChains, legacyChains)
+
+type chainPlan struct {
+	table, chain string
+	diff         ChainDiff
+	obsolete     bool // 整条链需要删除
+	builtin      bool // 内置链，只管理其中指向zmesh链的跳转
+}
+
+// plan 计算一个地址族从当前状态收敛到期望状态的所有操作
+func (m *Manager) plan(ipt *iptables.IPTables, rs Ruleset) ([]chainPlan, error) {
+	var plans []chainPlan
+	// zmesh的链：期望存在的计算差异，不期望存在的(早期版本或另一种拦截模式创建的)整条删除
+	for _, tc := range allChains {
+		table, chain := tc[0], tc[1]
+		exists, err := ipt.ChainExists(table, chain)
+		if err != nil {
+			return nil, err
+		}
+		desired := hasChain(rs.Chains, table, chain)
+		if !desired && !exists {
+			continue
+		}
+		var current [][]string
+		if exists {
+			if current, err = listRules(ipt, table, chain); err != nil {
+				return nil, err
+			}
+		}
+		var want [][]string
+		if desired {
+			want = chainRules(inTable(rs.Rules, table), chain)
+		}
+		plans = append(plans, chainPlan{table: table, chain: chain, diff: DiffChain(current, want), obsolete: !desired})
+	}
+	// 内置链只关心指向zmesh链的跳转，其他规则不属于zmesh
+	for _, builtin := range []string{"OUTPUT", "PREROUTING"} {
+		for _, table := range []string{"nat", "mangle"} {
+			current, err := listRules(ipt, table, builtin)
+			if err != nil {
+				return nil, err
+			}
+			var ours [][]string
+			for _, r := range current {
+				if isMeshJump(r) {
+					ours = append(ours, r)
+				}
+			}
+			diff := DiffChain(ours, chainRules(inTable(rs.Jumps, table), builtin))
+			// 跳转规则追加在链尾，不关心与其他规则的相对位置
+			for i := range diff.Inserts {
+				diff.Inserts[i].Pos = 0
+			}
+			plans = append(plans, chainPlan{table: table, chain: builtin, diff: diff, builtin: true})
+		}
+	}
+	return plans, nil
+}
+
+func isMeshJump(rule []string) bool {
+	for i := 0; i+1 < len(rule); i++ {
+		if rule[i] != "-j" {
+			continue
+		}
+		for _, tc := range allChains {
+			if rule[i+1] == tc[1] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// prune 删除当前规则集不再需要的跳转和zmesh链，如切换拦截模式后遗留的链
+func (m *Manager) prune(ipt *iptables.IPTables, rs Ruleset) error {
+	plans, err := m.plan(ipt, rs)
+	if err != nil {
+		return err
+	}
+	for _, p := range plans {
+		if p.builtin {
+			if err := applyChainDiff(ipt, chainPlan{table: p.table, chain: p.chain, diff: ChainDiff{Deletes: p.diff.Deletes}}); err != nil {
+				return err
+			}
+		}
+	}
+	for _, p := range plans {
+		if p.obsolete {
+			if err := ipt.ClearAndDeleteChain(p.table, p.chain); err != nil {
+				return fmt.Errorf("error deleting chain %s in %s table: %w", p.chain, p.table, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Diff 只读地比较当前规则与Spec，返回不一致的链
+func (m *Manager) Diff(spec interception.Spec) ([]interception.Drift, error) {
+	var drifts []interception.Drift
+	for _, ipt := range m.tables() {
+		ipv6 := ipt.Proto() == iptables.ProtocolIPv6
+		rs, err := Render(spec, ipv6)
+		if err != nil {
+			return nil, err
+		}
+		plans, err := m.plan(ipt, rs)
+		if err != nil {
+			return nil, err
+		}
+		if spec.TProxy() {
+			d, err := spec.TProxyRoute(ipv6).Drift()
+			if err != nil {
+				return nil, err
+			}
+			if d != nil {
+				drifts = append(drifts, *d)
+			}
+		}
+		for _, p := range plans {
+			if p.diff.Empty() && !p.obsolete {
+				continue
+			}
+			d := interception.Drift{IPv6: ipv6, Table: p.table, Chain: p.chain, Obsolete: p.obsolete}
+			for _, r := range p.diff.Deletes {
+				d.Unexpected = append(d.Unexpected, strings.Join(r, " "))
+			}
+			for _, ins := range p.diff.Inserts {
+				d.Missing = append(d.Missing, strings.Join(ins.Rule, " "))
+			}
+			drifts = append(drifts, d)
+		}
+	}
+	return drifts, nil
+}
+
+// Reconcile 把当前规则收敛到Spec：只应用差异部分，可以重复执行。
+// 顺序为：补齐tproxy的策略路由 -> 创建缺失的链 -> 收敛zmesh链中的规则 -> 收敛内置链中的跳转 -> 删除不再需要的链，
+// 保证跳转规则生效时链中的规则已经就位，删除链时已经没有跳转引用它。返回修复前发现的差异
+func (m *Manager) Reconcile(spec interception.Spec) ([]interception.Drift, error) {
+	drifts, err := m.Diff(spec)
+	if err != nil || len(drifts) == 0 {
+		return drifts, err
+	}
+	for _, d := range drifts {
+		logrus.Warnf("[Reconcile] - drift detected: %s", d)
+	}
+
+	for _, ipt := range m.tables() {
+		ipv6 := ipt.Proto() == iptables.ProtocolIPv6
+		rs, err := Render(spec, ipv6)
+		if err != nil {
+			return drifts, err
+		}
+		if spec.TProxy() {
+			if err := spec.TProxyRoute(ipv6).Ensure(); err != nil {
+				return drifts, err
+			}
+		}
+		for _, tc := range rs.Chains {
+			if ok, _ := ipt.ChainExists(tc[0], tc[1]); !ok {
+				if err := ipt.NewChain(tc[0], tc[1]); err != nil {
+					return drifts, fmt.Errorf("error creating chain %s in %s table: %w", tc[1], tc[0], err)
+				}
+			}
+		}
+		plans, err := m.plan(ipt, rs)
+		if err != nil {
+			return drifts, err
+		}
+		var obsolete []chainPlan
+		for _, p := range plans {
+			if p.obsolete {
+				obsolete = append(obsolete, p)
+				continue
+			}
+			if err := applyChainDiff(ipt, p); err != nil {
+				return drifts, err
+			}
+		}
+		for _, p := range obsolete {
+			if err := ipt.ClearAndDeleteChain(p.table, p.chain); err != nil {
+				return drifts, fmt.Errorf("error deleting chain %s in %s table: %w", p.chain, p.table, err)
+			}
+		}
+	}
+	return drifts, nil
+}
+
+func applyChainDiff(ipt *iptables.IPTables, p chainPlan) error {
+	for _, r := range p.diff.Deletes {
+		if err := ipt.Delete(p.table, p.chain, r...); err != nil {
+			return fmt.Errorf("error deleting rule %v from %s/%s: %w", r, p.table, p.chain, err)
+		}
+	}
+	for _, ins := range p.diff.Inserts {
+		var err error
+		if ins.Pos == 0 {
+			err = ipt.Append(p.table, p.chain, ins.Rule...)
+		} else {
+			err = ipt.Insert(p.table, p.chain, ins.Pos, ins.Rule...)
+		}
+		if err != nil {
+			return fmt.Errorf("error inserting rule %v into %s/%s: %w", ins.Rule, p.table, p.chain, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package iptables_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/SMALL-head/zmesh/dataplane/iptables"
+	"github.com/stretchr/testify/require"
+)
+
+func rules(lines ...string) [][]string {
+	var res [][]string
+	for _, l := range lines {
+		res = append(res, strings.Fields(l))
+	}
+	return res
+}
+
+func TestDiffChainInSync(t *testing.T) {
+	desired := rules(
+		"-p tcp -m owner --uid-owner 1337 -j RETURN",
+		"-p tcp -d 10.10.0.0/16 ! --sport 8090 -j REDIRECT --to-ports 8090",
+	)
+	// iptables -S输出的格式：补上了-m tcp，地址排在协议前面
+	current := rules(
+		"-p tcp -m owner --uid-owner 1337 -j RETURN",
+		"-d 10.10.0.0/16 -p tcp -m tcp ! --sport 8090 -j REDIRECT --to-ports 8090",
+	)
+	require.True(t, iptables.DiffChain(current, desired).Empty())
+}
+
+func TestDiffChainDelta(t *testing.T) {
+	desired := rules("-j A", "-j B", "-j C")
+
+	// 缺少的规则插入到对应位置
+	diff := iptables.DiffChain(rules("-j A", "-j C"), desired)
+	require.Empty(t, diff.Deletes)
+	require.Equal(t, []iptables.RuleInsert{{Pos: 2, Rule: []string{"-j", "B"}}}, diff.Inserts)
+
+	// 多余的规则删除
+	diff = iptables.DiffChain(rules("-j A", "-j X", "-j B", "-j C"), desired)
+	require.Equal(t, rules("-j X"), diff.Deletes)
+	require.Empty(t, diff.Inserts)
+
+	// 顺序错误的规则删除后在正确的位置重新插入
+	diff = iptables.DiffChain(rules("-j C", "-j A", "-j B"), desired)
+	require.Equal(t, rules("-j C"), diff.Deletes)
+	require.Equal(t, []iptables.RuleInsert{{Pos: 3, Rule: []string{"-j", "C"}}}, diff.Inserts)
+
+	// 重复的规则只保留一条
+	diff = iptables.DiffChain(rules("-j A", "-j A", "-j B", "-j C"), desired)
+	require.Equal(t, rules("-j A"), diff.Deletes)
+	require.Empty(t, diff.Inserts)
+
+	// 空链
+	diff = iptables.DiffChain(nil, desired)
+	require.Empty(t, diff.Deletes)
+	require.Len(t, diff.Inserts, 3)
+	require.Equal(t, 1, diff.Inserts[0].Pos)
+	require.Equal(t, 3, diff.Inserts[2].Pos)
+}
+
+func TestDiffChainAppliesCleanly(t *testing.T) {
+	// 模拟按ChainDiff操作一条链，结果应与期望一致
+	apply := func(chain [][]string, diff iptables.ChainDiff) [][]string {
+		for _, d := range diff.Deletes {
+			for i, r := range chain {
+				if strings.Join(r, " ") == strings.Join(d, " ") {
+					chain = append(chain[:i:i], chain[i+1:]...)
+					break
+				}
+			}
+		}
+		for _, ins := range diff.Inserts {
+			pos := ins.Pos - 1
+			chain = append(chain[:pos:pos], append([][]string{ins.Rule}, chain[pos:]...)...)
+		}
+		return chain
+	}
+	desired := rules("-j A", "-j B", "-j C", "-j D")
+	for _, current := range [][][]string{
+		rules("-j D", "-j C", "-j B", "-j A"),
+		rules("-j B", "-j X", "-j D"),
+		rules("-j A", "-j B", "-j C", "-j D", "-j E"),
+		nil,
+	} {
+		got := apply(append([][]string{}, current...), iptables.DiffChain(current, desired))
+		require.Equal(t, desired, got, "current: %v", current)
+	}
+}
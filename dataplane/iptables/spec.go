@@ -0,0 +1,242 @@
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/SMALL-head/zmesh/dataplane/interception"
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// Ruleset 一个地址族的完整规则，redirect模式只使用nat表，tproxy模式的入站规则在mangle表
+type Ruleset struct {
+	IPv6   bool
+	Chains [][]string // zmesh自己的链：table, chain，应用时会被清空后重建
+	Jumps  [][]string // 内置链到zmesh链的跳转：table, chain, rulespec...
+	Rules  [][]string // zmesh链中的规则：table, chain, rulespec...
+}
+
+// Render 把Spec渲染为指定地址族的规则集
+func Render(spec interception.Spec, ipv6 bool) (Ruleset, error) {
+	if spec.OutboundPort <= 0 || spec.InboundPort <= 0 {
+		return Ruleset{}, fmt.Errorf("inbound and outbound ports are required")
+	}
+	cidrs, err := interception.FamilyCIDRs(spec.CaptureCIDRs, ipv6)
+	if err != nil {
+		return Ruleset{}, err
+	}
+	excluded, err := interception.FamilyCIDRs(spec.ExcludeOutboundCIDRs, ipv6)
+	if err != nil {
+		return Ruleset{}, err
+	}
+	loopback := "127.0.0.1/32"
+	if ipv6 {
+		loopback = "::1/128"
+	}
+	out, in := strconv.Itoa(spec.OutboundPort), strconv.Itoa(spec.InboundPort)
+
+	rs := Ruleset{
+		IPv6:   ipv6,
+		Chains: [][]string{{"nat", MESH_OUPUT_CHAIN}},
+		Jumps:  [][]string{{"nat", "OUTPUT", "-p", "tcp", "-j", MESH_OUPUT_CHAIN}},
+	}
+	if !spec.TProxy() {
+		rs.Chains = append(rs.Chains, []string{"nat", MESH_PREROUTING_CHAIN})
+		rs.Jumps = append(rs.Jumps, []string{"nat", "PREROUTING", "-p", "tcp", "-j", MESH_PREROUTING_CHAIN})
+	}
+	add := func(rule ...string) {
+		rs.Rules = append(rs.Rules, append([]string{"nat"}, rule...))
+	}
+
+	// outbound：proxy自身及豁免的进程、访问本机以及排除的网段和端口直接放行
+	for _, mark := range spec.ExemptMarks() {
+		add(MESH_OUPUT_CHAIN, "-p", "tcp", "-m", "mark", "--mark", fmt.Sprintf("%#x", mark), "-j", "RETURN")
+	}
+	uids, gids := spec.ExemptIDs()
+	for _, uid := range uids {
+		add(MESH_OUPUT_CHAIN, "-p", "tcp", "-m", "owner", "--uid-owner", strconv.Itoa(uid), "-j", "RETURN")
+	}
+	for _, gid := range gids {
+		add(MESH_OUPUT_CHAIN, "-p", "tcp", "-m", "owner", "--gid-owner", strconv.Itoa(gid), "-j", "RETURN")
+	}
+	add(MESH_OUPUT_CHAIN, "-p", "tcp", "-d", loopback, "-j", "RETURN")
+	for _, cidr := range excluded {
+		add(MESH_OUPUT_CHAIN, "-p", "tcp", "-d", cidr.String(), "-j", "RETURN")
+	}
+	for _, port := range spec.ExcludeOutboundPorts {
+		add(MESH_OUPUT_CHAIN, "-p", "tcp", "--dport", strconv.Itoa(port), "-j", "RETURN")
+	}
+	// 目的网段与目的端口的每个组合一条REDIRECT，没有配置的一项不限制
+	var dsts [][]string
+	if len(cidrs) == 0 {
+		dsts = append(dsts, nil)
+	}
+	for _, cidr := range cidrs {
+		dsts = append(dsts, []string{"-d", cidr.String()})
+	}
+	var dports [][]string
+	if len(spec.IncludeOutboundPorts) == 0 {
+		dports = append(dports, nil)
+	}
+	for _, port := range spec.IncludeOutboundPorts {
+		dports = append(dports, []string{"--dport", strconv.Itoa(port)})
+	}
+	for _, dst := range dsts {
+		for _, dport := range dports {
+			rule := append([]string{MESH_OUPUT_CHAIN, "-p", "tcp"}, dst...)
+			rule = append(rule, dport...)
+			add(append(rule, "!", "--sport", out, "-j", "REDIRECT", "--to-ports", out)...)
+		}
+	}
+
+	// inbound
+	if spec.TProxy() {
+		renderTProxy(&rs, spec, loopback)
+		return rs, nil
+	}
+	for _, port := range spec.ExcludeInboundPorts {
+		add(MESH_PREROUTING_CHAIN, "-p", "tcp", "--dport", strconv.Itoa(port), "-j", "RETURN")
+	}
+	if len(spec.IncludeInboundPorts) == 0 {
+		add(MESH_PREROUTING_CHAIN, "-p", "tcp", "!", "--sport", in, "-j", "REDIRECT", "--to-ports", in)
+	}
+	for _, port := range spec.IncludeInboundPorts {
+		add(MESH_PREROUTING_CHAIN, "-p", "tcp", "--dport", strconv.Itoa(port), "-j", "REDIRECT", "--to-ports", in)
+	}
+	return rs, nil
+}
+
+// renderTProxy 生成tproxy模式下mangle表的入站规则。规则按iptables -S的输出格式书写，便于reconcile比较。
+//
+// 客户端的包经TPROXY打上mark交给透明监听的proxy，之后同一连接的包由socket匹配后经DIVERT直接交给本机；
+// proxy以客户端地址连接应用时socket带有同样的mark，这些包经lo回到PREROUTING时保存到conntrack中，
+// 应用的回包在OUTPUT中恢复mark，经策略路由重新回到本机，被proxy的透明socket接收
+func renderTProxy(rs *Ruleset, spec interception.Spec, loopback string) {
+	route := spec.TProxyRoute(rs.IPv6)
+	mark := fmt.Sprintf("%#x", route.Mark)
+	onIP := "0.0.0.0"
+	if rs.IPv6 {
+		onIP = "::"
+	}
+	in := strconv.Itoa(spec.InboundPort)
+
+	rs.Chains = append(rs.Chains, tproxyChains...)
+	rs.Jumps = append(rs.Jumps, tproxyRules...)
+	add := func(chain string, rule ...string) {
+		rs.Rules = append(rs.Rules, append([]string{"mangle", chain}, rule...))
+	}
+
+	add(MESH_DIVERT_CHAIN, "-j", "MARK", "--set-xmark", mark+"/0xffffffff")
+	add(MESH_DIVERT_CHAIN, "-j", "ACCEPT")
+
+	// proxy连接应用的包
+	add(MESH_INBOUND_CHAIN, "-p", "tcp", "-m", "mark", "--mark", mark, "-j", "CONNMARK", "--save-mark", "--nfmask", "0xffffffff", "--ctmask", "0xffffffff")
+	add(MESH_INBOUND_CHAIN, "-p", "tcp", "-m", "mark", "--mark", mark, "-j", "RETURN")
+	add(MESH_INBOUND_CHAIN, "-p", "tcp", "-d", loopback, "-j", "RETURN")
+	for _, port := range spec.ExcludeInboundPorts {
+		add(MESH_INBOUND_CHAIN, "-p", "tcp", "--dport", strconv.Itoa(port), "-j", "RETURN")
+	}
+	add(MESH_INBOUND_CHAIN, "-p", "tcp", "-m", "socket", "--transparent", "-j", MESH_DIVERT_CHAIN)
+	tproxy := []string{"-j", "TPROXY", "--on-port", in, "--on-ip", onIP, "--tproxy-mark", mark + "/0xffffffff"}
+	if len(spec.IncludeInboundPorts) == 0 {
+		add(MESH_INBOUND_CHAIN, append([]string{"-p", "tcp"}, tproxy...)...)
+	}
+	for _, port := range spec.IncludeInboundPorts {
+		add(MESH_INBOUND_CHAIN, append([]string{"-p", "tcp", "--dport", strconv.Itoa(port)}, tproxy...)...)
+	}
+
+	add(MESH_RESTORE_CHAIN, "-p", "tcp", "-m", "connmark", "--mark", mark, "-j", "CONNMARK", "--restore-mark", "--nfmask", "0xffffffff", "--ctmask", "0xffffffff")
+}
+
+// String 渲染为iptables-restore的输入
+func (r Ruleset) String() string {
+	return r.restoreInput(nil)
+}
+
+// restoreInput 生成iptables-restore --noflush的输入，每张表一段。声明zmesh链会清空链中原有的规则，
+// 内置链不会被清空，因此已经存在的跳转规则(skip返回true)不再重复添加
+func (r Ruleset) restoreInput(skip func(jump []string) bool) string {
+	var b strings.Builder
+	for _, table := range []string{"nat", "mangle"} {
+		chains := inTable(r.Chains, table)
+		if len(chains) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "*%s\n", table)
+		for _, chain := range chains {
+			fmt.Fprintf(&b, ":%s - [0:0]\n", chain[0])
+		}
+		for _, jump := range r.Jumps {
+			if jump[0] != table || (skip != nil && skip(jump)) {
+				continue
+			}
+			fmt.Fprintf(&b, "-A %s\n", strings.Join(jump[1:], " "))
+		}
+		for _, rule := range inTable(r.Rules, table) {
+			fmt.Fprintf(&b, "-A %s\n", strings.Join(rule, " "))
+		}
+		b.WriteString("COMMIT\n")
+	}
+	return b.String()
+}
+
+// inTable 返回属于table的条目，去掉table前缀
+func inTable(entries [][]string, table string) [][]string {
+	var res [][]string
+	for _, e := range entries {
+		if e[0] == table {
+			res = append(res, e[1:])
+		}
+	}
+	return res
+}
+
+// Apply 按Spec渲染规则，并通过iptables-restore对每个地址族原子地应用，任一规则有误时该地址族保持原样。
+// 之后删除当前模式不再需要的zmesh链，tproxy模式下再添加策略路由
+func (m *Manager) Apply(spec interception.Spec) error {
+	for _, ipt := range m.tables() {
+		ipv6 := ipt.Proto() == iptables.ProtocolIPv6
+		rs, err := Render(spec, ipv6)
+		if err != nil {
+			return err
+		}
+		input := rs.restoreInput(func(jump []string) bool {
+			ok, _ := ipt.Exists(jump[0], jump[1], jump[2:]...)
+			return ok
+		})
+		if err := restore(ipv6, input); err != nil {
+			return err
+		}
+		if err := m.prune(ipt, rs); err != nil {
+			return err
+		}
+		route := spec.TProxyRoute(ipv6)
+		if spec.TProxy() {
+			err = route.Ensure()
+		} else {
+			err = route.Delete()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func restore(ipv6 bool, input string) error {
+	bin := "iptables-restore"
+	if ipv6 {
+		bin = "ip6tables-restore"
+	}
+	cmd := exec.Command(bin, "--noflush")
+	cmd.Stdin = strings.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w: %s", bin, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package iptables_test
+
+import (
+	"testing"
+
+	"github.com/SMALL-head/zmesh/dataplane/interception"
+	"github.com/SMALL-head/zmesh/dataplane/iptables"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRender(t *testing.T) {
+	spec := interception.Spec{
+		OutboundPort:         15001,
+		InboundPort:          15006,
+		ProxyUID:             1337,
+		ProxyGID:             1337,
+		CaptureCIDRs:         []string{"10.10.0.0/16", "fd00::/64"},
+		ExcludeInboundPorts:  []int{15020},
+		ExcludeOutboundPorts: []int{22},
+	}
+	rs, err := iptables.Render(spec, false)
+	require.NoError(t, err)
+	require.Equal(t, `*nat
+:ZMESH_OUTPUT - [0:0]
+:ZMESH_PREROUTING - [0:0]
+-A OUTPUT -p tcp -j ZMESH_OUTPUT
+-A PREROUTING -p tcp -j ZMESH_PREROUTING
+-A ZMESH_OUTPUT -p tcp -m owner --uid-owner 1337 -j RETURN
+-A ZMESH_OUTPUT -p tcp -m owner --gid-owner 1337 -j RETURN
+-A ZMESH_OUTPUT -p tcp -d 127.0.0.1/32 -j RETURN
+-A ZMESH_OUTPUT -p tcp --dport 22 -j RETURN
+-A ZMESH_OUTPUT -p tcp -d 10.10.0.0/16 ! --sport 15001 -j REDIRECT --to-ports 15001
+-A ZMESH_PREROUTING -p tcp --dport 15020 -j RETURN
+-A ZMESH_PREROUTING -p tcp ! --sport 15006 -j REDIRECT --to-ports 15006
+COMMIT
+`, rs.String())
+
+	// ipv6只使用ipv6的网段
+	rs, err = iptables.Render(spec, true)
+	require.NoError(t, err)
+	require.Contains(t, rs.String(), "-A ZMESH_OUTPUT -p tcp -d ::1/128 -j RETURN\n")
+	require.Contains(t, rs.String(), "-A ZMESH_OUTPUT -p tcp -d fd00::/64 ! --sport 15001 -j REDIRECT --to-ports 15001\n")
+	require.NotContains(t, rs.String(), "10.10.0.0/16")
+}
+
+func TestRenderIncludeInboundPorts(t *testing.T) {
+	rs, err := iptables.Render(interception.Spec{
+		OutboundPort:        15001,
+		InboundPort:         15006,
+		ProxyUID:            1337,
+		IncludeInboundPorts: []int{80, 443},
+	}, false)
+	require.NoError(t, err)
+	require.Contains(t, rs.String(), "-A ZMESH_PREROUTING -p tcp --dport 80 -j REDIRECT --to-ports 15006\n")
+	require.Contains(t, rs.String(), "-A ZMESH_PREROUTING -p tcp --dport 443 -j REDIRECT --to-ports 15006\n")
+	require.NotContains(t, rs.String(), "! --sport 15006")
+	// 没有配置网段时不限制目的地址
+	require.Contains(t, rs.String(), "-A ZMESH_OUTPUT -p tcp ! --sport 15001 -j REDIRECT --to-ports 15001\n")
+	require.NotContains(t, rs.String(), "--gid-owner")
+}
+
+func TestRenderInvalidSpec(t *testing.T) {
+	_, err := iptables.Render(interception.Spec{InboundPort: 15006}, false)
+	require.Error(t, err)
+	_, err = iptables.Render(interception.Spec{OutboundPort: 1, InboundPort: 2, CaptureCIDRs: []string{"10.0.0.0"}}, false)
+	require.Error(t, err)
+}
+
+func TestRenderExclusions(t *testing.T) {
+	spec := interception.Spec{
+		OutboundPort:         15001,
+		InboundPort:          15006,
+		ProxyUID:             1337,
+		ExemptUIDs:           []int{1000},
+		ExemptGIDs:           []int{2000},
+		CaptureCIDRs:         []string{"10.10.0.0/16", "172.16.0.0/12"},
+		ExcludeOutboundCIDRs: []string{"10.10.3.4/32", "fd00::1/128"},
+		IncludeOutboundPorts: []int{80, 3306},
+	}
+	rs, err := iptables.Render(spec, false)
+	require.NoError(t, err)
+	require.Equal(t, `*nat
+:ZMESH_OUTPUT - [0:0]
+:ZMESH_PREROUTING - [0:0]
+-A OUTPUT -p tcp -j ZMESH_OUTPUT
+-A PREROUTING -p tcp -j ZMESH_PREROUTING
+-A ZMESH_OUTPUT -p tcp -m owner --uid-owner 1337 -j RETURN
+-A ZMESH_OUTPUT -p tcp -m owner --uid-owner 1000 -j RETURN
+-A ZMESH_OUTPUT -p tcp -m owner --gid-owner 2000 -j RETURN
+-A ZMESH_OUTPUT -p tcp -d 127.0.0.1/32 -j RETURN
+-A ZMESH_OUTPUT -p tcp -d 10.10.3.4/32 -j RETURN
+-A ZMESH_OUTPUT -p tcp -d 10.10.0.0/16 --dport 80 ! --sport 15001 -j REDIRECT --to-ports 15001
+-A ZMESH_OUTPUT -p tcp -d 10.10.0.0/16 --dport 3306 ! --sport 15001 -j REDIRECT --to-ports 15001
+-A ZMESH_OUTPUT -p tcp -d 172.16.0.0/12 --dport 80 ! --sport 15001 -j REDIRECT --to-ports 15001
+-A ZMESH_OUTPUT -p tcp -d 172.16.0.0/12 --dport 3306 ! --sport 15001 -j REDIRECT --to-ports 15001
+-A ZMESH_PREROUTING -p tcp ! --sport 15006 -j REDIRECT --to-ports 15006
+COMMIT
+`, rs.String())
+
+	// 没有配置网段时只按端口拦截
+	rs, err = iptables.Render(spec, true)
+	require.NoError(t, err)
+	require.Contains(t, rs.String(), "-A ZMESH_OUTPUT -p tcp -d fd00::1/128 -j RETURN\n")
+	require.Contains(t, rs.String(), "-A ZMESH_OUTPUT -p tcp --dport 3306 ! --sport 15001 -j REDIRECT --to-ports 15001\n")
+}
+
+func TestRenderNeverExemptsRoot(t *testing.T) {
+	// uid和gid中的0都被忽略，不会排除所有root的流量
+	rs, err := iptables.Render(interception.Spec{OutboundPort: 15001, InboundPort: 15006, ExemptUIDs: []int{0}, ExemptGIDs: []int{0, 1000}}, false)
+	require.NoError(t, err)
+	require.NotContains(t, rs.String(), "--uid-owner 0 ")
+	require.NotContains(t, rs.String(), "--gid-owner 0 ")
+	require.Contains(t, rs.String(), "--gid-owner 1000 ")
+}
+
+func TestRenderTProxy(t *testing.T) {
+	rs, err := iptables.Render(interception.Spec{
+		OutboundPort:        15001,
+		InboundPort:         15006,
+		InboundMode:         interception.ModeTProxy,
+		ProxyUID:            1337,
+		ExcludeInboundPorts: []int{15020},
+	}, false)
+	require.NoError(t, err)
+	require.Equal(t, `*nat
+:ZMESH_OUTPUT - [0:0]
+-A OUTPUT -p tcp -j ZMESH_OUTPUT
+-A ZMESH_OUTPUT -p tcp -m mark --mark 0x539 -j RETURN
+-A ZMESH_OUTPUT -p tcp -m owner --uid-owner 1337 -j RETURN
+-A ZMESH_OUTPUT -p tcp -d 127.0.0.1/32 -j RETURN
+-A ZMESH_OUTPUT -p tcp ! --sport 15001 -j REDIRECT --to-ports 15001
+COMMIT
+*mangle
+:ZMESH_INBOUND - [0:0]
+:ZMESH_DIVERT - [0:0]
+:ZMESH_RESTORE - [0:0]
+-A PREROUTING -p tcp -j ZMESH_INBOUND
+-A OUTPUT -p tcp -j ZMESH_RESTORE
+-A ZMESH_DIVERT -j MARK --set-xmark 0x539/0xffffffff
+-A ZMESH_DIVERT -j ACCEPT
+-A ZMESH_INBOUND -p tcp -m mark --mark 0x539 -j CONNMARK --save-mark --nfmask 0xffffffff --ctmask 0xffffffff
+-A ZMESH_INBOUND -p tcp -m mark --mark 0x539 -j RETURN
+-A ZMESH_INBOUND -p tcp -d 127.0.0.1/32 -j RETURN
+-A ZMESH_INBOUND -p tcp --dport 15020 -j RETURN
+-A ZMESH_INBOUND -p tcp -m socket --transparent -j ZMESH_DIVERT
+-A ZMESH_INBOUND -p tcp -j TPROXY --on-port 15006 --on-ip 0.0.0.0 --tproxy-mark 0x539/0xffffffff
+-A ZMESH_RESTORE -p tcp -m connmark --mark 0x539 -j CONNMARK --restore-mark --nfmask 0xffffffff --ctmask 0xffffffff
+COMMIT
+`, rs.String())
+
+	// ipv6监听在::上，mark和路由表可以配置
+	rs, err = iptables.Render(interception.Spec{
+		OutboundPort: 15001,
+		InboundPort:  15006,
+		InboundMode:  interception.ModeTProxy,
+		TProxyMark:   0x10,
+		ProxyUID:     1337,
+	}, true)
+	require.NoError(t, err)
+	require.Contains(t, rs.String(), "-A ZMESH_INBOUND -p tcp -j TPROXY --on-port 15006 --on-ip :: --tproxy-mark 0x10/0xffffffff\n")
+}
+
+func TestRenderProxyMark(t *testing.T) {
+	// 设置了mark后proxy可以运行在任意uid下，不再按uid排除
+	rs, err := iptables.Render(interception.Spec{
+		OutboundPort: 15001,
+		InboundPort:  15006,
+		ProxyMark:    0x83,
+		ExemptUIDs:   []int{1000},
+	}, false)
+	require.NoError(t, err)
+	require.Contains(t, rs.String(), `-A PREROUTING -p tcp -j ZMESH_PREROUTING
+-A ZMESH_OUTPUT -p tcp -m mark --mark 0x83 -j RETURN
+-A ZMESH_OUTPUT -p tcp -m owner --uid-owner 1000 -j RETURN
+-A ZMESH_OUTPUT -p tcp -d 127.0.0.1/32 -j RETURN
+`)
+	require.NotContains(t, rs.String(), "--uid-owner 0 ")
+
+	// 同时配置了uid时两者都排除
+	rs, err = iptables.Render(interception.Spec{OutboundPort: 15001, InboundPort: 15006, ProxyMark: 0x83, ProxyUID: 1337}, false)
+	require.NoError(t, err)
+	require.Contains(t, rs.String(), "-A ZMESH_OUTPUT -p tcp -m mark --mark 0x83 -j RETURN\n-A ZMESH_OUTPUT -p tcp -m owner --uid-owner 1337 -j RETURN\n")
+}
@@ -0,0 +1,140 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "zmesh"
+
+// label names
+const (
+	LabelListener    = "listener" // inbound或outbound
+	LabelMode        = "mode"     // sidecar或proxy
+	LabelOriginalDst = "original_dst"
+	LabelReason      = "reason"
+	LabelResult      = "result"
+	LabelRule        = "rule"
+	LabelDecision    = "decision"
+	LabelProtocol    = "protocol"
+	LabelMethod      = "method"
+	LabelPath        = "path"
+	LabelCode        = "code"
+)
+
+var (
+	registry = prometheus.NewRegistry()
+
+	ActiveConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_connections",
+		Help:      "Number of currently proxied connections.",
+	}, []string{LabelListener, LabelMode})
+
+	TotalConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "connections_total",
+		Help:      "Total number of proxied connections.",
+	}, []string{LabelListener, LabelMode, LabelOriginalDst})
+
+	// BytesReceived 从下游收到并转发给上游的字节数
+	BytesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "received_bytes_total",
+		Help:      "Bytes received from downstream and forwarded upstream.",
+	}, []string{LabelListener, LabelMode, LabelOriginalDst})
+
+	// BytesSent 从上游收到并回传给下游的字节数
+	BytesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sent_bytes_total",
+		Help:      "Bytes received from upstream and sent back downstream.",
+	}, []string{LabelListener, LabelMode, LabelOriginalDst})
+
+	DialFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_dial_failures_total",
+		Help:      "Number of failed upstream connection attempts.",
+	}, []string{LabelListener, LabelMode, LabelOriginalDst, LabelReason})
+
+	DialLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_dial_duration_seconds",
+		Help:      "Time spent establishing upstream connections.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{LabelListener, LabelMode, LabelOriginalDst})
+
+	ClosedConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "closed_connections_total",
+		Help:      "Number of closed connections by close reason.",
+	}, []string{LabelListener, LabelMode, LabelReason})
+
+	// MTLSHandshakes sidecar之间的mTLS握手，result为ok、failed、plaintext(退回或接受明文)或rejected(strict模式拒绝明文)
+	MTLSHandshakes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mtls_handshakes_total",
+		Help:      "Number of mTLS handshakes between sidecars by result.",
+	}, []string{LabelListener, LabelResult})
+
+	// AuthzDecisions inbound的授权决策，decision为allow、deny或audit_deny(audit模式下本应拒绝，实际放行)
+	AuthzDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "authz_decisions_total",
+		Help:      "Number of inbound authorization decisions by matched rule.",
+	}, []string{LabelRule, LabelDecision})
+
+	// ProtocolDetections 按识别出的应用层协议统计的连接数，protocol为http1、http2、tls或unknown
+	ProtocolDetections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "protocol_detections_total",
+		Help:      "Number of proxied connections by detected application protocol.",
+	}, []string{LabelListener, LabelMode, LabelProtocol})
+
+	// HTTPRequests HTTP/1.1连接上的请求数，code为响应的状态码，连接在收到响应之前关闭时为0
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP/1.1 requests by method, path and response code.",
+	}, []string{LabelListener, LabelMode, LabelOriginalDst, LabelMethod, LabelPath, LabelCode})
+
+	// HTTPRequestDuration 从收到请求的第一个字节到响应结束的时间
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time from the first byte of an HTTP/1.1 request to the end of its response.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{LabelListener, LabelMode, LabelOriginalDst, LabelCode})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		ActiveConnections,
+		TotalConnections,
+		BytesReceived,
+		BytesSent,
+		DialFailures,
+		DialLatency,
+		ClosedConnections,
+		MTLSHandshakes,
+		AuthzDecisions,
+		ProtocolDetections,
+		HTTPRequests,
+		HTTPRequestDuration,
+	)
+}
+
+// Registry 返回dataplane使用的prometheus registry
+func Registry() *prometheus.Registry {
+	return registry
+}
+
+// Handler 以prometheus文本格式输出所有指标
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
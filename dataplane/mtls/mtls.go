@@ -0,0 +1,267 @@
+// Package mtls sidecar之间的双向TLS：证书从文件加载并在文件变化后自动重新加载，
+// 以及inbound识别zmesh发起的mTLS连接所需的ClientHello解析
+package mtls
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ALPN zmesh之间的mTLS连接协商的应用层协议，inbound据此区分sidecar发起的mTLS和应用自己的TLS
+const ALPN = "zmesh-mtls"
+
+// mTLS的工作模式
+const (
+	// ModeDisable 不使用mTLS
+	ModeDisable = "disable"
+	// ModePermissive outbound尝试mTLS，对端不支持时退回明文；inbound同时接受明文和mTLS
+	ModePermissive = "permissive"
+	// ModeStrict outbound只使用mTLS，inbound拒绝明文连接
+	ModeStrict = "strict"
+)
+
+// Credentials 本地证书、私钥以及用于校验对端的CA，握手时检查文件是否变化，变化后重新加载。
+// 本地证书需要带有SPIFFE ID，outbound只接受同一个trust domain中的对端
+type Credentials struct {
+	certFile, keyFile, caFile string
+
+	lock        sync.Mutex
+	stamps      [3]fileStamp
+	cert        *tls.Certificate
+	roots       *x509.CertPool
+	trustDomain string
+	checked     time.Time
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// reloadCheckInterval 两次检查文件是否变化的最短间隔
+const reloadCheckInterval = time.Second
+
+func Load(certFile, keyFile, caFile string) (*Credentials, error) {
+	c := &Credentials{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Credentials) files() [3]string {
+	return [3]string{c.certFile, c.keyFile, c.caFile}
+}
+
+func (c *Credentials) reload() error {
+	var stamps [3]fileStamp
+	for i, f := range c.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		stamps[i] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading key pair: %w", err)
+	}
+	id := spiffeID(cert.Leaf)
+	if id == nil {
+		return fmt.Errorf("certificate in %s has no spiffe id", c.certFile)
+	}
+	pem, err := os.ReadFile(c.caFile)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificate found in %s", c.caFile)
+	}
+	c.stamps, c.cert, c.roots, c.trustDomain = stamps, &cert, roots, id.Host
+	return nil
+}
+
+// current 返回当前的证书、CA和trust domain，文件变化时重新加载，加载失败时继续使用旧的证书
+func (c *Credentials) current() (*tls.Certificate, *x509.CertPool, string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if time.Since(c.checked) < reloadCheckInterval {
+		return c.cert, c.roots, c.trustDomain
+	}
+	c.checked = time.Now()
+	for i, f := range c.files() {
+		info, err := os.Stat(f)
+		if err != nil || (fileStamp{modTime: info.ModTime(), size: info.Size()}) != c.stamps[i] {
+			if err := c.reload(); err != nil {
+				logrus.Warnf("[mtls] - error reloading certificates, keep using the old ones: %s", err)
+			} else {
+				logrus.Infof("[mtls] - certificates reloaded from %s", c.certFile)
+			}
+			break
+		}
+	}
+	return c.cert, c.roots, c.trustDomain
+}
+
+// ServerConfig inbound终结mTLS使用的配置，要求对端出示由CA签发的证书
+func (c *Credentials) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, roots, _ := c.current()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    roots,
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				NextProtos:   []string{ALPN},
+			}, nil
+		},
+	}
+}
+
+// ClientConfig outbound发起mTLS使用的配置。对端是按pod地址访问的，证书中没有对应的SAN，
+// 因此不校验主机名，而是校验证书链，并要求对端的SPIFFE ID与本地证书在同一个trust domain中
+func (c *Credentials) ClientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{ALPN},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _, _ := c.current()
+			return cert, nil
+		},
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("peer presented no certificate")
+			}
+			if cs.NegotiatedProtocol != ALPN {
+				return fmt.Errorf("peer negotiated %q instead of %s", cs.NegotiatedProtocol, ALPN)
+			}
+			_, roots, trustDomain := c.current()
+			opts := x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: x509.NewCertPool(),
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			if _, err := cs.PeerCertificates[0].Verify(opts); err != nil {
+				return err
+			}
+			if id := spiffeID(cs.PeerCertificates[0]); id == nil || id.Host != trustDomain {
+				return fmt.Errorf("peer %q is not in trust domain %s", PeerID(cs), trustDomain)
+			}
+			return nil
+		},
+	}
+}
+
+// spiffeID 证书中spiffe://形式的URI SAN，没有时返回nil
+func spiffeID(cert *x509.Certificate) *url.URL {
+	for _, u := range cert.URIs {
+		if u.Scheme == "spiffe" && u.Host != "" {
+			return u
+		}
+	}
+	return nil
+}
+
+// PeerID 对端证书的身份：优先使用URI SAN(如SPIFFE ID)，没有时使用CN
+func PeerID(cs tls.ConnectionState) string {
+	if len(cs.PeerCertificates) == 0 {
+		return ""
+	}
+	cert := cs.PeerCertificates[0]
+	if len(cert.URIs) > 0 {
+		return cert.URIs[0].String()
+	}
+	return cert.Subject.CommonName
+}
+
+const (
+	recordHeaderLen     = 5
+	recordTypeHandshake = 0x16
+	maxRecordLen        = 16384 + 2048
+)
+
+// IsHandshake 数据是否以TLS握手记录开头
+func IsHandshake(first byte) bool {
+	return first == recordTypeHandshake
+}
+
+var errHelloParsed = errors.New("client hello parsed")
+
+// PeekClientHello 解析r中的ClientHello但不消费数据，之后仍可以从r开始完整的TLS握手。
+// ClientHello需要在第一个TLS记录中，r的缓冲区至少要能放下一个完整的记录
+func PeekClientHello(r *bufio.Reader) (*tls.ClientHelloInfo, error) {
+	header, err := r.Peek(recordHeaderLen)
+	if err != nil {
+		return nil, err
+	}
+	if !IsHandshake(header[0]) {
+		return nil, errors.New("not a tls handshake")
+	}
+	n := int(binary.BigEndian.Uint16(header[3:]))
+	if n > maxRecordLen || recordHeaderLen+n > r.Size() {
+		return nil, fmt.Errorf("tls record too large: %d bytes", n)
+	}
+	record, err := r.Peek(recordHeaderLen + n)
+	if err != nil {
+		return nil, err
+	}
+
+	// 借助crypto/tls解析，在拿到ClientHello之后立即中止握手
+	var hello *tls.ClientHelloInfo
+	err = tls.Server(&replayConn{data: record}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = &tls.ClientHelloInfo{
+				ServerName:        info.ServerName,
+				SupportedProtos:   info.SupportedProtos,
+				SupportedVersions: info.SupportedVersions,
+				CipherSuites:      info.CipherSuites,
+			}
+			return nil, errHelloParsed
+		},
+	}).Handshake()
+	if hello == nil {
+		return nil, fmt.Errorf("error parsing client hello: %w", err)
+	}
+	return hello, nil
+}
+
+// replayConn 只读的内存连接，写入的数据(握手失败时的alert)直接丢弃
+type replayConn struct {
+	data []byte
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	if len(c.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, c.data)
+	c.data = c.data[n:]
+	return n, nil
+}
+
+func (c *replayConn) Write(b []byte) (int, error)      { return len(b), nil }
+func (c *replayConn) Close() error                     { return nil }
+func (c *replayConn) LocalAddr() net.Addr              { return &net.TCPAddr{} }
+func (c *replayConn) RemoteAddr() net.Addr             { return &net.TCPAddr{} }
+func (c *replayConn) SetDeadline(time.Time) error      { return nil }
+func (c *replayConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *replayConn) SetWriteDeadline(time.Time) error { return nil }
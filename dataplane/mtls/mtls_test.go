@@ -0,0 +1,182 @@
+package mtls_test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SMALL-head/zmesh/dataplane/mtls"
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue 签发一张工作负载证书并写入dir，返回cert、key和ca文件的路径
+func (ca *testCA) issue(t *testing.T, dir, id string) (certFile, keyFile, caFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	uri, err := url.Parse(id)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{uri},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile, keyFile, caFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	require.NoError(t, os.WriteFile(caFile, ca.pem, 0o600))
+	return certFile, keyFile, caFile
+}
+
+func load(t *testing.T, ca *testCA, id string) *mtls.Credentials {
+	creds, err := mtls.Load(ca.issue(t, t.TempDir(), id))
+	require.NoError(t, err)
+	return creds
+}
+
+// handshake 在内存连接上完成一次握手，返回双方看到的对端身份
+func handshake(client, server *mtls.Credentials) (clientSaw, serverSaw string, err error) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	tc, ts := tls.Client(c, client.ClientConfig()), tls.Server(s, server.ServerConfig())
+	errc := make(chan error, 1)
+	go func() {
+		err := ts.Handshake()
+		if err != nil {
+			// 让客户端的握手尽快结束
+			_ = s.Close()
+		}
+		errc <- err
+	}()
+	err = tc.Handshake()
+	if serr := <-errc; err == nil {
+		err = serr
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return mtls.PeerID(tc.ConnectionState()), mtls.PeerID(ts.ConnectionState()), nil
+}
+
+func TestHandshake(t *testing.T) {
+	ca := newTestCA(t, "zmesh")
+	a := load(t, ca, "spiffe://cluster.local/ns/default/sa/a")
+	b := load(t, ca, "spiffe://cluster.local/ns/default/sa/b")
+
+	clientSaw, serverSaw, err := handshake(a, b)
+	require.NoError(t, err)
+	require.Equal(t, "spiffe://cluster.local/ns/default/sa/b", clientSaw)
+	require.Equal(t, "spiffe://cluster.local/ns/default/sa/a", serverSaw)
+
+	// 其他CA签发的证书双方都不接受
+	other := load(t, newTestCA(t, "other"), "spiffe://cluster.local/ns/default/sa/c")
+	_, _, err = handshake(other, b)
+	require.Error(t, err)
+	_, _, err = handshake(a, other)
+	require.Error(t, err)
+
+	// 同一个CA签发但不在本地trust domain中的对端，outbound不接受
+	foreign := load(t, ca, "spiffe://other.local/ns/default/sa/b")
+	_, _, err = handshake(a, foreign)
+	require.ErrorContains(t, err, "not in trust domain cluster.local")
+
+	// 没有SPIFFE ID的证书不能加载
+	_, err = mtls.Load(ca.issue(t, t.TempDir(), "https://reviews.default"))
+	require.ErrorContains(t, err, "has no spiffe id")
+}
+
+func TestCredentialsReload(t *testing.T) {
+	ca := newTestCA(t, "zmesh")
+	dir := t.TempDir()
+	creds, err := mtls.Load(ca.issue(t, dir, "spiffe://cluster.local/ns/default/sa/old"))
+	require.NoError(t, err)
+	peer := load(t, ca, "spiffe://cluster.local/ns/default/sa/peer")
+
+	_, serverSaw, err := handshake(creds, peer)
+	require.NoError(t, err)
+	require.Equal(t, "spiffe://cluster.local/ns/default/sa/old", serverSaw)
+
+	// 证书文件被替换后使用新证书
+	ca.issue(t, dir, "spiffe://cluster.local/ns/default/sa/new")
+	require.Eventually(t, func() bool {
+		_, serverSaw, err := handshake(creds, peer)
+		return err == nil && serverSaw == "spiffe://cluster.local/ns/default/sa/new"
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// 文件损坏时继续使用之前的证书
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "key.pem"), []byte("broken"), 0o600))
+	time.Sleep(1100 * time.Millisecond)
+	_, serverSaw, err = handshake(creds, peer)
+	require.NoError(t, err)
+	require.Equal(t, "spiffe://cluster.local/ns/default/sa/new", serverSaw)
+}
+
+func TestPeekClientHello(t *testing.T) {
+	// 录下客户端发出的ClientHello
+	c, s := net.Pipe()
+	go func() {
+		_ = tls.Client(c, &tls.Config{ServerName: "reviews.default", NextProtos: []string{mtls.ALPN, "h2"}}).Handshake()
+	}()
+	buf := make([]byte, 16<<10)
+	n, err := s.Read(buf)
+	require.NoError(t, err)
+	c.Close()
+	s.Close()
+
+	r := bufio.NewReaderSize(bytes.NewReader(buf[:n]), 20<<10)
+	hello, err := mtls.PeekClientHello(r)
+	require.NoError(t, err)
+	require.Equal(t, "reviews.default", hello.ServerName)
+	require.Equal(t, []string{mtls.ALPN, "h2"}, hello.SupportedProtos)
+	// 数据没有被消费
+	require.Equal(t, n, r.Buffered())
+
+	_, err = mtls.PeekClientHello(bufio.NewReader(bytes.NewReader([]byte("GET / HTTP/1.1\r\n\r\n"))))
+	require.Error(t, err)
+}
@@ -0,0 +1,350 @@
+// Package nftables 基于netlink直接操作nftables的拦截后端，不依赖nft命令，
+// 适用于没有iptables的镜像以及只支持nftables的内核
+package nftables
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/SMALL-head/zmesh/dataplane/interception"
+	"github.com/google/nftables"
+	"github.com/google/nftables/userdata"
+	"github.com/sirupsen/logrus"
+)
+
+type Manager struct {
+	conn *nftables.Conn
+}
+
+func New() (*Manager, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, err
+	}
+	return &Manager{conn: conn}, nil
+}
+
+func (m *Manager) Name() string {
+	return "nftables"
+}
+
+// Available 能否读取nftables规则，用于自动选择后端
+func (m *Manager) Available() bool {
+	_, err := m.conn.ListTablesOfFamily(nftables.TableFamilyIPv4)
+	return err == nil
+}
+
+func table(ipv6 bool) *nftables.Table {
+	return &nftables.Table{Name: TableName, Family: family(ipv6)}
+}
+
+func newChain(t *nftables.Table, c chainDef) *nftables.Chain {
+	return &nftables.Chain{
+		Name:     c.name,
+		Table:    t,
+		Type:     c.typ,
+		Hooknum:  c.hook,
+		Priority: c.priority,
+	}
+}
+
+func (m *Manager) addRules(ch *nftables.Chain, rules []Rule) {
+	for _, r := range rules {
+		m.conn.AddRule(&nftables.Rule{
+			Table:    ch.Table,
+			Chain:    ch,
+			Exprs:    r.exprs,
+			UserData: userdata.AppendString(nil, userdata.TypeComment, r.Text),
+		})
+	}
+}
+
+// Apply 按Spec渲染规则，每个地址族在一个netlink事务中删除旧表并重建，任一规则有误时该地址族保持原样。
+// tproxy模式下再添加策略路由
+func (m *Manager) Apply(spec interception.Spec) error {
+	for _, ipv6 := range []bool{false, true} {
+		rs, err := Render(spec, ipv6)
+		if err != nil {
+			return err
+		}
+		t := table(ipv6)
+		// 先添加再删除，表不存在时删除也不会失败
+		m.conn.AddTable(t)
+		m.conn.DelTable(t)
+		m.conn.AddTable(t)
+		for _, c := range rs.chains {
+			m.addRules(m.conn.AddChain(newChain(t, c)), rs.chainRules(c.name))
+		}
+		if err := m.conn.Flush(); err != nil {
+			return fmt.Errorf("error applying %s table: %w", familyName(ipv6), err)
+		}
+		route := spec.TProxyRoute(ipv6)
+		if spec.TProxy() {
+			err = route.Ensure()
+		} else {
+			err = route.Delete()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Cleanup 删除两个地址族的zmesh表以及tproxy的策略路由
+func (m *Manager) Cleanup(spec interception.Spec) error {
+	for _, ipv6 := range []bool{false, true} {
+		t := table(ipv6)
+		m.conn.AddTable(t)
+		m.conn.DelTable(t)
+	}
+	if err := m.conn.Flush(); err != nil {
+		return err
+	}
+	for _, ipv6 := range []bool{false, true} {
+		if err := spec.TProxyRoute(ipv6).Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type chainState int
+
+const (
+	chainInSync chainState = iota
+	chainMissing
+	chainMismatch // 链的类型、hook或优先级不对，需要重建
+	chainRulesDrift
+	chainObsolete
+)
+
+type chainPlan struct {
+	chain *nftables.Chain
+	def   chainDef
+	state chainState
+	rules []Rule
+	drift interception.Drift
+}
+
+// plan 比较一个地址族的zmesh表与期望的规则集。表由zmesh独占，其中的规则按注释比较，
+// 没有注释的规则视为不属于zmesh
+func (m *Manager) plan(rs Ruleset) (bool, []chainPlan, error) {
+	t := table(rs.IPv6)
+	all, err := m.conn.ListChainsOfTableFamily(t.Family)
+	if err != nil {
+		return false, nil, err
+	}
+	current := map[string]*nftables.Chain{}
+	for _, c := range all {
+		if c.Table != nil && c.Table.Name == TableName {
+			current[c.Name] = c
+		}
+	}
+	tables, err := m.conn.ListTablesOfFamily(t.Family)
+	if err != nil {
+		return false, nil, err
+	}
+	tableExists := slices.ContainsFunc(tables, func(tb *nftables.Table) bool { return tb.Name == TableName })
+
+	var plans []chainPlan
+	for _, def := range rs.chains {
+		desired := rs.chainRules(def.name)
+		p := chainPlan{def: def, rules: desired, chain: current[def.name]}
+		p.drift = interception.Drift{IPv6: rs.IPv6, Table: TableName, Chain: def.name}
+		delete(current, def.name)
+
+		var texts []string
+		for _, r := range desired {
+			texts = append(texts, r.Text)
+		}
+		if p.chain == nil {
+			p.state = chainMissing
+			p.drift.Missing = texts
+			plans = append(plans, p)
+			continue
+		}
+		got, err := m.ruleTexts(p.chain)
+		if err != nil {
+			return false, nil, err
+		}
+		switch {
+		case !sameDef(p.chain, def):
+			p.state = chainMismatch
+			p.drift.Missing = texts
+			p.drift.Unexpected = append([]string{"chain definition"}, got...)
+		case !slices.Equal(got, texts):
+			p.state = chainRulesDrift
+			p.drift.Missing, p.drift.Unexpected = difference(texts, got), difference(got, texts)
+			if len(p.drift.Missing) == 0 && len(p.drift.Unexpected) == 0 {
+				// 规则相同但顺序不对
+				p.drift.Missing, p.drift.Unexpected = texts, got
+			}
+		}
+		plans = append(plans, p)
+	}
+	// 表中多出来的链
+	for _, def := range sortedChains(current) {
+		got, err := m.ruleTexts(def)
+		if err != nil {
+			return false, nil, err
+		}
+		plans = append(plans, chainPlan{
+			chain: def,
+			state: chainObsolete,
+			drift: interception.Drift{IPv6: rs.IPv6, Table: TableName, Chain: def.Name, Unexpected: got, Obsolete: true},
+		})
+	}
+	return tableExists, plans, nil
+}
+
+func (m *Manager) ruleTexts(ch *nftables.Chain) ([]string, error) {
+	rules, err := m.conn.GetRules(ch.Table, ch)
+	if err != nil {
+		return nil, fmt.Errorf("error listing rules of %s: %w", ch.Name, err)
+	}
+	texts := make([]string, 0, len(rules))
+	for _, r := range rules {
+		text, ok := userdata.GetString(r.UserData, userdata.TypeComment)
+		if !ok {
+			text = fmt.Sprintf("<handle %d>", r.Handle)
+		}
+		texts = append(texts, text)
+	}
+	return texts, nil
+}
+
+func sameDef(c *nftables.Chain, def chainDef) bool {
+	return c.Type == def.typ &&
+		c.Hooknum != nil && *c.Hooknum == *def.hook &&
+		c.Priority != nil && *c.Priority == *def.priority
+}
+
+// difference 返回a中不在b中的元素
+func difference(a, b []string) []string {
+	var res []string
+	for _, s := range a {
+		if !slices.Contains(b, s) {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+func sortedChains(m map[string]*nftables.Chain) []*nftables.Chain {
+	res := make([]*nftables.Chain, 0, len(m))
+	for _, c := range m {
+		res = append(res, c)
+	}
+	slices.SortFunc(res, func(a, b *nftables.Chain) int {
+		if a.Name < b.Name {
+			return -1
+		}
+		if a.Name > b.Name {
+			return 1
+		}
+		return 0
+	})
+	return res
+}
+
+// Diff 只读地比较当前规则与Spec，返回不一致的链
+func (m *Manager) Diff(spec interception.Spec) ([]interception.Drift, error) {
+	var drifts []interception.Drift
+	for _, ipv6 := range []bool{false, true} {
+		rs, err := Render(spec, ipv6)
+		if err != nil {
+			return nil, err
+		}
+		_, plans, err := m.plan(rs)
+		if err != nil {
+			return nil, err
+		}
+		if spec.TProxy() {
+			d, err := spec.TProxyRoute(ipv6).Drift()
+			if err != nil {
+				return nil, err
+			}
+			if d != nil {
+				drifts = append(drifts, *d)
+			}
+		}
+		for _, p := range plans {
+			if p.state != chainInSync {
+				drifts = append(drifts, p.drift)
+			}
+		}
+	}
+	return drifts, nil
+}
+
+// Reconcile 把当前规则收敛到Spec：只重建不一致的链，每个地址族的修改在一个netlink事务中完成，可以重复执行。
+// 返回修复前发现的差异
+func (m *Manager) Reconcile(spec interception.Spec) ([]interception.Drift, error) {
+	var drifts []interception.Drift
+	for _, ipv6 := range []bool{false, true} {
+		rs, err := Render(spec, ipv6)
+		if err != nil {
+			return drifts, err
+		}
+		tableExists, plans, err := m.plan(rs)
+		if err != nil {
+			return drifts, err
+		}
+		if spec.TProxy() {
+			route := spec.TProxyRoute(ipv6)
+			d, err := route.Drift()
+			if err != nil {
+				return drifts, err
+			}
+			if d != nil {
+				drifts = append(drifts, *d)
+				logrus.Warnf("[Reconcile] - drift detected: %s", d)
+				if err := route.Ensure(); err != nil {
+					return drifts, err
+				}
+			}
+		}
+		t := table(ipv6)
+		changed := false
+		if !tableExists {
+			m.conn.AddTable(t)
+		}
+		for _, p := range plans {
+			if p.state == chainInSync {
+				continue
+			}
+			changed = true
+			drifts = append(drifts, p.drift)
+			logrus.Warnf("[Reconcile] - drift detected: %s", p.drift)
+			switch p.state {
+			case chainMissing:
+				m.addRules(m.conn.AddChain(newChain(t, p.def)), p.rules)
+			case chainMismatch:
+				m.conn.FlushChain(p.chain)
+				m.conn.DelChain(p.chain)
+				m.addRules(m.conn.AddChain(newChain(t, p.def)), p.rules)
+			case chainRulesDrift:
+				m.conn.FlushChain(p.chain)
+				m.addRules(p.chain, p.rules)
+			case chainObsolete:
+				m.conn.FlushChain(p.chain)
+				m.conn.DelChain(p.chain)
+			}
+		}
+		if !changed {
+			continue
+		}
+		if err := m.conn.Flush(); err != nil {
+			return drifts, fmt.Errorf("error reconciling %s table: %w", familyName(ipv6), err)
+		}
+	}
+	return drifts, nil
+}
+
+func familyName(ipv6 bool) string {
+	if ipv6 {
+		return "ip6"
+	}
+	return "ip"
+}
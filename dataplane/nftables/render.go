@@ -0,0 +1,359 @@
+package nftables
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/SMALL-head/zmesh/dataplane/interception"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// TableName zmesh独占的表，ipv4与ipv6各一个，清理时直接删除整张表
+	TableName = "zmesh"
+
+	OutputChain     = "output"
+	PreroutingChain = "prerouting"
+	// tproxy模式下的入站链以及恢复回包mark的链，作用与iptables后端mangle表中的链相同
+	TProxyPreroutingChain = "tproxy_prerouting"
+	TProxyOutputChain     = "tproxy_output"
+)
+
+// Rule 一条规则的nft语法以及对应的表达式。nft语法同时作为注释写入规则的userdata，
+// 读回规则时据此与期望比较
+type Rule struct {
+	Chain string
+	Text  string
+	exprs []expr.Any
+}
+
+// Ruleset 一个地址族在zmesh表中的完整规则
+type Ruleset struct {
+	IPv6   bool
+	Rules  []Rule
+	chains []chainDef
+}
+
+// chainDef zmesh表中的基础链
+type chainDef struct {
+	name     string
+	typ      nftables.ChainType
+	hook     *nftables.ChainHook
+	priority *nftables.ChainPriority
+	// nft语法中的hook和优先级名称
+	hookName, priorityName string
+}
+
+var (
+	natOutput     = chainDef{OutputChain, nftables.ChainTypeNAT, nftables.ChainHookOutput, nftables.ChainPriorityNATDest, "output", "dstnat"}
+	natPrerouting = chainDef{PreroutingChain, nftables.ChainTypeNAT, nftables.ChainHookPrerouting, nftables.ChainPriorityNATDest, "prerouting", "dstnat"}
+	// route类型的链在mark被修改后会重新查路由
+	tproxyOutput     = chainDef{TProxyOutputChain, nftables.ChainTypeRoute, nftables.ChainHookOutput, nftables.ChainPriorityMangle, "output", "mangle"}
+	tproxyPrerouting = chainDef{TProxyPreroutingChain, nftables.ChainTypeFilter, nftables.ChainHookPrerouting, nftables.ChainPriorityMangle, "prerouting", "mangle"}
+)
+
+func family(ipv6 bool) nftables.TableFamily {
+	if ipv6 {
+		return nftables.TableFamilyIPv6
+	}
+	return nftables.TableFamilyIPv4
+}
+
+// Render 把Spec渲染为指定地址族的规则集，规则与iptables后端一一对应
+func Render(spec interception.Spec, ipv6 bool) (Ruleset, error) {
+	if spec.OutboundPort <= 0 || spec.InboundPort <= 0 {
+		return Ruleset{}, fmt.Errorf("inbound and outbound ports are required")
+	}
+	cidrs, err := interception.FamilyCIDRs(spec.CaptureCIDRs, ipv6)
+	if err != nil {
+		return Ruleset{}, err
+	}
+	excluded, err := interception.FamilyCIDRs(spec.ExcludeOutboundCIDRs, ipv6)
+	if err != nil {
+		return Ruleset{}, err
+	}
+	loopback := netip.MustParsePrefix("127.0.0.1/32")
+	if ipv6 {
+		loopback = netip.MustParsePrefix("::1/128")
+	}
+	out, in := uint16(spec.OutboundPort), uint16(spec.InboundPort)
+
+	rs := Ruleset{IPv6: ipv6, chains: []chainDef{natOutput, natPrerouting}}
+	if spec.TProxy() {
+		rs.chains = []chainDef{natOutput, tproxyPrerouting, tproxyOutput}
+	}
+	add := func(chain string, b *builder) {
+		rs.Rules = append(rs.Rules, Rule{Chain: chain, Text: strings.Join(b.text, " "), exprs: b.exprs})
+	}
+
+	// outbound：proxy自身及豁免的进程、访问本机以及排除的网段和端口直接放行
+	for _, mark := range spec.ExemptMarks() {
+		add(OutputChain, tcp().metaMark(uint32(mark)).ret())
+	}
+	uids, gids := spec.ExemptIDs()
+	for _, uid := range uids {
+		add(OutputChain, tcp().skuid(uid).ret())
+	}
+	for _, gid := range gids {
+		add(OutputChain, tcp().skgid(gid).ret())
+	}
+	add(OutputChain, tcp().daddr(loopback).ret())
+	for _, cidr := range excluded {
+		add(OutputChain, tcp().daddr(cidr).ret())
+	}
+	for _, port := range spec.ExcludeOutboundPorts {
+		add(OutputChain, tcp().dport(uint16(port)).ret())
+	}
+	// 目的网段与目的端口的每个组合一条redirect，没有配置的一项不限制
+	dsts := []*netip.Prefix{nil}
+	if len(cidrs) > 0 {
+		dsts = dsts[:0]
+		for i := range cidrs {
+			dsts = append(dsts, &cidrs[i])
+		}
+	}
+	dports := []int{0}
+	if len(spec.IncludeOutboundPorts) > 0 {
+		dports = spec.IncludeOutboundPorts
+	}
+	for _, dst := range dsts {
+		for _, dport := range dports {
+			b := tcp()
+			if dst != nil {
+				b.daddr(*dst)
+			}
+			if dport > 0 {
+				b.dport(uint16(dport))
+			}
+			add(OutputChain, b.sportNot(out).redirect(out))
+		}
+	}
+
+	// inbound
+	if spec.TProxy() {
+		renderTProxy(&rs, spec, loopback)
+		return rs, nil
+	}
+	for _, port := range spec.ExcludeInboundPorts {
+		add(PreroutingChain, tcp().dport(uint16(port)).ret())
+	}
+	if len(spec.IncludeInboundPorts) == 0 {
+		add(PreroutingChain, tcp().sportNot(in).redirect(in))
+	}
+	for _, port := range spec.IncludeInboundPorts {
+		add(PreroutingChain, tcp().dport(uint16(port)).redirect(in))
+	}
+	return rs, nil
+}
+
+// renderTProxy 生成tproxy模式的入站规则，流程与iptables后端相同：
+// 客户端的包经tproxy交给透明监听的proxy，已有透明连接的包直接交给本机；
+// proxy连接应用的包带有mark，经lo回来时保存到conntrack，应用的回包在output中恢复mark后经策略路由回到proxy
+func renderTProxy(rs *Ruleset, spec interception.Spec, loopback netip.Prefix) {
+	mark := uint32(spec.TProxyRoute(rs.IPv6).Mark)
+	in := uint16(spec.InboundPort)
+	add := func(chain string, b *builder) {
+		rs.Rules = append(rs.Rules, Rule{Chain: chain, Text: strings.Join(b.text, " "), exprs: b.exprs})
+	}
+
+	// proxy连接应用的包
+	add(TProxyPreroutingChain, tcp().metaMark(mark).saveMark().ret())
+	add(TProxyPreroutingChain, tcp().daddr(loopback).ret())
+	for _, port := range spec.ExcludeInboundPorts {
+		add(TProxyPreroutingChain, tcp().dport(uint16(port)).ret())
+	}
+	add(TProxyPreroutingChain, tcp().socketTransparent().setMark(mark).accept())
+	if len(spec.IncludeInboundPorts) == 0 {
+		add(TProxyPreroutingChain, tcp().tproxy(in, rs.IPv6).setMark(mark).accept())
+	}
+	for _, port := range spec.IncludeInboundPorts {
+		add(TProxyPreroutingChain, tcp().dport(uint16(port)).tproxy(in, rs.IPv6).setMark(mark).accept())
+	}
+
+	add(TProxyOutputChain, tcp().ctMark(mark).restoreMark())
+}
+
+// chainRules 返回规则集中属于chain的规则
+func (r Ruleset) chainRules(chain string) []Rule {
+	var res []Rule
+	for _, rule := range r.Rules {
+		if rule.Chain == chain {
+			res = append(res, rule)
+		}
+	}
+	return res
+}
+
+// String 渲染为nft -f的输入，先删除旧表再整体重建，与Apply的效果相同
+func (r Ruleset) String() string {
+	fam := "ip"
+	if r.IPv6 {
+		fam = "ip6"
+	}
+	var b strings.Builder
+	// 先声明再删除，表不存在时也不会报错
+	fmt.Fprintf(&b, "table %s %s\ndelete table %s %s\n", fam, TableName, fam, TableName)
+	fmt.Fprintf(&b, "table %s %s {\n", fam, TableName)
+	for i, c := range r.chains {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "\tchain %s {\n\t\ttype %s hook %s priority %s; policy accept;\n", c.name, c.typ, c.hookName, c.priorityName)
+		for _, rule := range r.chainRules(c.name) {
+			fmt.Fprintf(&b, "\t\t%s\n", rule.Text)
+		}
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// builder 同时拼接规则的nft语法和表达式，所有匹配都使用1号寄存器
+type builder struct {
+	text  []string
+	exprs []expr.Any
+}
+
+func tcp() *builder {
+	b := &builder{}
+	return b.match("meta l4proto tcp",
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+	)
+}
+
+func (b *builder) match(text string, exprs ...expr.Any) *builder {
+	b.text = append(b.text, text)
+	b.exprs = append(b.exprs, exprs...)
+	return b
+}
+
+func (b *builder) skuid(uid int) *builder {
+	return b.match("meta skuid "+strconv.Itoa(uid),
+		&expr.Meta{Key: expr.MetaKeySKUID, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(uint32(uid))},
+	)
+}
+
+func (b *builder) skgid(gid int) *builder {
+	return b.match("meta skgid "+strconv.Itoa(gid),
+		&expr.Meta{Key: expr.MetaKeySKGID, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(uint32(gid))},
+	)
+}
+
+// daddr 匹配目的地址所在网段，ipv4目的地址在网络层头部偏移16处，ipv6在偏移24处
+func (b *builder) daddr(prefix netip.Prefix) *builder {
+	fam, offset := "ip", uint32(16)
+	if prefix.Addr().Is6() {
+		fam, offset = "ip6", 24
+	}
+	addr := prefix.Addr().AsSlice()
+	size := uint32(len(addr))
+	exprs := []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: size},
+	}
+	if prefix.Bits() < int(size)*8 {
+		mask := make([]byte, size)
+		for i := 0; i < prefix.Bits(); i++ {
+			mask[i/8] |= 0x80 >> (i % 8)
+		}
+		exprs = append(exprs, &expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: size, Mask: mask, Xor: make([]byte, size)})
+	}
+	exprs = append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: addr})
+	return b.match(fmt.Sprintf("%s daddr %s", fam, prefix), exprs...)
+}
+
+// port 匹配tcp端口，源端口在传输层头部偏移0处，目的端口在偏移2处
+func (b *builder) port(text string, offset uint32, op expr.CmpOp, port uint16) *builder {
+	return b.match(text,
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: offset, Len: 2},
+		&expr.Cmp{Op: op, Register: 1, Data: binary.BigEndian.AppendUint16(nil, port)},
+	)
+}
+
+func (b *builder) dport(port uint16) *builder {
+	return b.port(fmt.Sprintf("tcp dport %d", port), 2, expr.CmpOpEq, port)
+}
+
+func (b *builder) sportNot(port uint16) *builder {
+	return b.port(fmt.Sprintf("tcp sport != %d", port), 0, expr.CmpOpNeq, port)
+}
+
+func (b *builder) ret() *builder {
+	return b.match("return", &expr.Verdict{Kind: expr.VerdictReturn})
+}
+
+func (b *builder) redirect(port uint16) *builder {
+	return b.match(fmt.Sprintf("redirect to :%d", port),
+		&expr.Immediate{Register: 1, Data: binary.BigEndian.AppendUint16(nil, port)},
+		&expr.Redir{RegisterProtoMin: 1},
+	)
+}
+
+func (b *builder) accept() *builder {
+	return b.match("accept", &expr.Verdict{Kind: expr.VerdictAccept})
+}
+
+func (b *builder) metaMark(mark uint32) *builder {
+	return b.match(fmt.Sprintf("meta mark %#x", mark),
+		&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(mark)},
+	)
+}
+
+func (b *builder) ctMark(mark uint32) *builder {
+	return b.match(fmt.Sprintf("ct mark %#x", mark),
+		&expr.Ct{Key: expr.CtKeyMARK, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(mark)},
+	)
+}
+
+func (b *builder) setMark(mark uint32) *builder {
+	return b.match(fmt.Sprintf("meta mark set %#x", mark),
+		&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(mark)},
+		&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+	)
+}
+
+// saveMark 把包的mark保存到conntrack，相当于CONNMARK --save-mark
+func (b *builder) saveMark() *builder {
+	return b.match("ct mark set meta mark",
+		&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+		&expr.Ct{Key: expr.CtKeyMARK, SourceRegister: true, Register: 1},
+	)
+}
+
+// restoreMark 用conntrack中的mark设置包的mark，相当于CONNMARK --restore-mark
+func (b *builder) restoreMark() *builder {
+	return b.match("meta mark set ct mark",
+		&expr.Ct{Key: expr.CtKeyMARK, Register: 1},
+		&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+	)
+}
+
+// socketTransparent 匹配属于本机透明socket(IP_TRANSPARENT)的包
+func (b *builder) socketTransparent() *builder {
+	return b.match("socket transparent 1",
+		&expr.Socket{Key: expr.SocketKeyTransparent, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{1}},
+	)
+}
+
+// tproxy 把包交给本机监听port的透明socket，不修改包的内容
+func (b *builder) tproxy(port uint16, ipv6 bool) *builder {
+	fam := byte(unix.NFPROTO_IPV4)
+	if ipv6 {
+		fam = unix.NFPROTO_IPV6
+	}
+	return b.match(fmt.Sprintf("tproxy to :%d", port),
+		&expr.Immediate{Register: 1, Data: binary.BigEndian.AppendUint16(nil, port)},
+		&expr.TProxy{Family: fam, TableFamily: fam, RegPort: 1},
+	)
+}
@@ -0,0 +1,137 @@
+package nftables_test
+
+import (
+	"testing"
+
+	"github.com/SMALL-head/zmesh/dataplane/interception"
+	"github.com/SMALL-head/zmesh/dataplane/nftables"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRender(t *testing.T) {
+	spec := interception.Spec{
+		OutboundPort:         15001,
+		InboundPort:          15006,
+		ProxyUID:             1337,
+		ProxyGID:             1337,
+		CaptureCIDRs:         []string{"10.10.0.0/16", "fd00::/64"},
+		ExcludeInboundPorts:  []int{15020},
+		ExcludeOutboundPorts: []int{22},
+	}
+	rs, err := nftables.Render(spec, false)
+	require.NoError(t, err)
+	require.Equal(t, `table ip zmesh
+delete table ip zmesh
+table ip zmesh {
+	chain output {
+		type nat hook output priority dstnat; policy accept;
+		meta l4proto tcp meta skuid 1337 return
+		meta l4proto tcp meta skgid 1337 return
+		meta l4proto tcp ip daddr 127.0.0.1/32 return
+		meta l4proto tcp tcp dport 22 return
+		meta l4proto tcp ip daddr 10.10.0.0/16 tcp sport != 15001 redirect to :15001
+	}
+
+	chain prerouting {
+		type nat hook prerouting priority dstnat; policy accept;
+		meta l4proto tcp tcp dport 15020 return
+		meta l4proto tcp tcp sport != 15006 redirect to :15006
+	}
+}
+`, rs.String())
+
+	// ipv6只使用ipv6的网段
+	rs, err = nftables.Render(spec, true)
+	require.NoError(t, err)
+	require.Contains(t, rs.String(), "table ip6 zmesh {\n")
+	require.Contains(t, rs.String(), "meta l4proto tcp ip6 daddr fd00::/64 tcp sport != 15001 redirect to :15001\n")
+	require.NotContains(t, rs.String(), "10.10.0.0/16")
+}
+
+func TestRenderIncludeInboundPorts(t *testing.T) {
+	rs, err := nftables.Render(interception.Spec{
+		OutboundPort:        15001,
+		InboundPort:         15006,
+		ProxyUID:            1337,
+		CaptureCIDRs:        []string{"10.10.1.7/16"},
+		IncludeInboundPorts: []int{80, 443},
+	}, false)
+	require.NoError(t, err)
+	require.Contains(t, rs.String(), "meta l4proto tcp tcp dport 80 redirect to :15006\n")
+	require.Contains(t, rs.String(), "meta l4proto tcp tcp dport 443 redirect to :15006\n")
+	require.NotContains(t, rs.String(), "sport != 15006")
+	// 网段按掩码规整
+	require.Contains(t, rs.String(), "ip daddr 10.10.0.0/16 ")
+
+	_, err = nftables.Render(interception.Spec{InboundPort: 15006}, false)
+	require.Error(t, err)
+}
+
+func TestRenderExclusions(t *testing.T) {
+	rs, err := nftables.Render(interception.Spec{
+		OutboundPort:         15001,
+		InboundPort:          15006,
+		ProxyUID:             1337,
+		ExemptUIDs:           []int{1000},
+		ExemptGIDs:           []int{2000},
+		CaptureCIDRs:         []string{"10.10.0.0/16"},
+		ExcludeOutboundCIDRs: []string{"10.10.3.4/32"},
+		IncludeOutboundPorts: []int{80, 3306},
+	}, false)
+	require.NoError(t, err)
+	require.Contains(t, rs.String(), `		meta l4proto tcp meta skuid 1337 return
+		meta l4proto tcp meta skuid 1000 return
+		meta l4proto tcp meta skgid 2000 return
+		meta l4proto tcp ip daddr 127.0.0.1/32 return
+		meta l4proto tcp ip daddr 10.10.3.4/32 return
+		meta l4proto tcp ip daddr 10.10.0.0/16 tcp dport 80 tcp sport != 15001 redirect to :15001
+		meta l4proto tcp ip daddr 10.10.0.0/16 tcp dport 3306 tcp sport != 15001 redirect to :15001
+`)
+}
+
+func TestRenderTProxy(t *testing.T) {
+	rs, err := nftables.Render(interception.Spec{
+		OutboundPort:        15001,
+		InboundPort:         15006,
+		InboundMode:         interception.ModeTProxy,
+		ProxyUID:            1337,
+		ExcludeInboundPorts: []int{15020},
+	}, true)
+	require.NoError(t, err)
+	require.Equal(t, `table ip6 zmesh
+delete table ip6 zmesh
+table ip6 zmesh {
+	chain output {
+		type nat hook output priority dstnat; policy accept;
+		meta l4proto tcp meta mark 0x539 return
+		meta l4proto tcp meta skuid 1337 return
+		meta l4proto tcp ip6 daddr ::1/128 return
+		meta l4proto tcp tcp sport != 15001 redirect to :15001
+	}
+
+	chain tproxy_prerouting {
+		type filter hook prerouting priority mangle; policy accept;
+		meta l4proto tcp meta mark 0x539 ct mark set meta mark return
+		meta l4proto tcp ip6 daddr ::1/128 return
+		meta l4proto tcp tcp dport 15020 return
+		meta l4proto tcp socket transparent 1 meta mark set 0x539 accept
+		meta l4proto tcp tproxy to :15006 meta mark set 0x539 accept
+	}
+
+	chain tproxy_output {
+		type route hook output priority mangle; policy accept;
+		meta l4proto tcp ct mark 0x539 meta mark set ct mark
+	}
+}
+`, rs.String())
+}
+
+func TestRenderProxyMark(t *testing.T) {
+	rs, err := nftables.Render(interception.Spec{OutboundPort: 15001, InboundPort: 15006, ProxyMark: 0x83}, false)
+	require.NoError(t, err)
+	require.Contains(t, rs.String(), `		type nat hook output priority dstnat; policy accept;
+		meta l4proto tcp meta mark 0x83 return
+		meta l4proto tcp ip daddr 127.0.0.1/32 return
+`)
+	require.NotContains(t, rs.String(), "skuid")
+}
@@ -0,0 +1,106 @@
+package proxy_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SMALL-head/zmesh/dataplane/accesslog"
+	"github.com/SMALL-head/zmesh/dataplane/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// syncBuffer 可以被并发读写的buffer
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+// entries 解析出所有满足条件的访问日志
+func (b *syncBuffer) entries(match func(map[string]any) bool) []map[string]any {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var res []map[string]any
+	dec := json.NewDecoder(bytes.NewReader(b.buf.Bytes()))
+	for {
+		var m map[string]any
+		if err := dec.Decode(&m); err != nil {
+			return res
+		}
+		if match(m) {
+			res = append(res, m)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var buf syncBuffer
+	al, err := accesslog.NewWithWriter(accesslog.FormatJSON, &buf)
+	require.NoError(t, err)
+
+	upstreamAddr, release := startUpstream(t)
+	defer close(release)
+	addr := startProxyOutbound(t,
+		proxy.WithAccessLog(al),
+		proxy.WithUpstream(proxy.NewUpstream("test", time.Second, proxy.Endpoint{Addr: upstreamAddr})),
+	)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	downstream := conn.LocalAddr().String()
+	msg := []byte("echo access log")
+	_, err = conn.Write(msg)
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, len(msg)))
+	require.NoError(t, err)
+	conn.Close()
+
+	var entries []map[string]any
+	require.Eventually(t, func() bool {
+		entries = buf.entries(func(m map[string]any) bool { return m["downstream"] == downstream })
+		return len(entries) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	e := entries[0]
+	require.Equal(t, upstreamAddr, e["original_dst"])
+	require.Equal(t, "outbound", e["direction"])
+	require.Equal(t, "proxy", e["mode"])
+	require.Equal(t, string(proxy.CloseNormal), e["reason"])
+	require.Equal(t, float64(len(msg)), e["bytes_received"])
+	require.Equal(t, float64(len(msg)), e["bytes_sent"])
+	require.NotEmpty(t, e["start_time"])
+	require.Contains(t, e, "duration_ms")
+	require.Contains(t, e, "connect_ms")
+}
+
+func TestAccessLogConnectError(t *testing.T) {
+	var buf syncBuffer
+	al, err := accesslog.NewWithWriter(accesslog.FormatJSON, &buf)
+	require.NoError(t, err)
+
+	dead := net.JoinHostPort("127.0.0.1", strconv.Itoa(freePort(t)))
+	addr := startProxyOutbound(t,
+		proxy.WithAccessLog(al),
+		proxy.WithUpstream(proxy.NewUpstream("dead", time.Second, proxy.Endpoint{Addr: dead})),
+	)
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	downstream := conn.LocalAddr().String()
+	defer conn.Close()
+
+	require.Eventually(t, func() bool {
+		entries := buf.entries(func(m map[string]any) bool { return m["downstream"] == downstream })
+		return len(entries) == 1 && entries[0]["reason"] == string(proxy.CloseConnectError)
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+
+	"github.com/SMALL-head/zmesh/dataplane/authz"
+	"github.com/SMALL-head/zmesh/dataplane/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// 授权决策，用于日志和指标
+const (
+	authzAllow     = "allow"
+	authzDeny      = "deny"
+	authzAuditDeny = "audit_deny"
+)
+
+// notHTTPRule 策略需要HTTP请求但连接不是HTTP/1.x时指标中rule的值
+const notHTTPRule = "not_http"
+
+// errDenied 连接上后续的HTTP请求被拒绝
+var errDenied = errors.New("request denied")
+
+// WithAuthz inbound在连接应用之前按policy授权，为nil时不授权。可以通过Reload热更新，只影响之后建立的连接
+func WithAuthz(policy *authz.Policy) Option {
+	return func(p *Proxy) {
+		p.settings.authz = policy
+	}
+}
+
+// policy 当前生效的授权策略，只有inbound授权
+func (p *Proxy) policy() *authz.Policy {
+	if p.listener != "inbound" {
+		return nil
+	}
+	return p.current().authz
+}
+
+// newAuthzRequest 从下游地址和目的地址中取出来源地址和目的端口
+func newAuthzRequest(downstream, dst string) authz.Request {
+	var req authz.Request
+	if ap, err := netip.ParseAddrPort(downstream); err == nil {
+		req.Source = ap.Addr().Unmap()
+	}
+	if _, port, err := net.SplitHostPort(dst); err == nil {
+		req.Port, _ = strconv.Atoi(port)
+	}
+	return req
+}
+
+// authorize 按策略判断是否放行，记录日志和指标。audit模式下只记录决策，总是放行
+func (p *Proxy) authorize(policy *authz.Policy, req authz.Request, downstream, dst string) bool {
+	d := policy.Evaluate(req)
+	decision := authzAllow
+	if !d.Allow {
+		decision = authzDeny
+		if policy.Audit() {
+			decision = authzAuditDeny
+		}
+	}
+	metrics.AuthzDecisions.WithLabelValues(d.Rule, decision).Inc()
+
+	peer := downstream
+	if req.Principal != "" {
+		peer = fmt.Sprintf("%s(%s)", downstream, req.Principal)
+	}
+	target := dst
+	if req.HTTP {
+		target = fmt.Sprintf("%s %s %s", dst, req.Method, req.Path)
+	}
+	switch {
+	case decision == authzDeny:
+		logrus.Warnf("[authorize] - denied connection from %s to %s, rule: %s", peer, target, d.Rule)
+	case policy.Audit():
+		logrus.Infof("[authorize] - audit: %s connection from %s to %s, rule: %s", decision, peer, target, d.Rule)
+	default:
+		logrus.Debugf("[authorize] - allowed connection from %s to %s, rule: %s", peer, target, d.Rule)
+	}
+	return d.Allow || policy.Audit()
+}
+
+// authorizeNotHTTP 有HTTP条件的规则可能命中但连接不是HTTP/1.x，无法按请求授权，拒绝连接。audit模式下只记录，总是放行
+func (p *Proxy) authorizeNotHTTP(policy *authz.Policy, protocol, downstream, dst string) bool {
+	decision := authzDeny
+	if policy.Audit() {
+		decision = authzAuditDeny
+	}
+	metrics.AuthzDecisions.WithLabelValues(notHTTPRule, decision).Inc()
+	if policy.Audit() {
+		logrus.Infof("[authorize] - audit: %s connection from %s to %s, policy needs http but got %s", decision, downstream, dst, protocol)
+		return true
+	}
+	logrus.Warnf("[authorize] - denied connection from %s to %s, policy needs http but got %s", downstream, dst, protocol)
+	return false
+}
@@ -0,0 +1,190 @@
+package proxy_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SMALL-head/zmesh/dataplane/authz"
+	"github.com/SMALL-head/zmesh/dataplane/metrics"
+	"github.com/SMALL-head/zmesh/dataplane/mtls"
+	"github.com/SMALL-head/zmesh/dataplane/proxy"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func startHTTPUpstream(t *testing.T) string {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reviews", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "reviews")
+	})
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		// 没有Content-Length，以chunked返回
+		for i := range 3 {
+			_, _ = fmt.Fprintf(w, "part%d;", i)
+			w.(http.Flusher).Flush()
+		}
+	})
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s.Listener.Addr().String()
+}
+
+// roundTrip 在同一个连接上一次写出所有请求(pipelining)，按顺序读出响应体
+func roundTrip(t *testing.T, conn net.Conn, paths ...string) []string {
+	var reqs strings.Builder
+	for _, path := range paths {
+		fmt.Fprintf(&reqs, "GET %s HTTP/1.1\r\nHost: reviews\r\n\r\n", path)
+	}
+	_, err := conn.Write([]byte(reqs.String()))
+	require.NoError(t, err)
+	r := bufio.NewReader(conn)
+	var bodies []string
+	for range paths {
+		resp, err := http.ReadResponse(r, nil)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		bodies = append(bodies, fmt.Sprintf("%d %s", resp.StatusCode, body))
+	}
+	return bodies
+}
+
+func newPolicy(t *testing.T, mode, defaultAction string, rules ...authz.Rule) *authz.Policy {
+	p, err := authz.New(mode, defaultAction, rules)
+	require.NoError(t, err)
+	return p
+}
+
+func TestAuthzL4(t *testing.T) {
+	upstreamAddr, accepted := startCountingUpstream(t)
+	port := netip.MustParseAddrPort(upstreamAddr).Port()
+	deny := authz.Rule{Name: "no-app", Action: authz.ActionDeny, Sources: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}, Ports: []int{int(port)}}
+
+	p, inbound := serveProxyInbound(t, upstreamTo(upstreamAddr), proxy.WithAuthz(newPolicy(t, authz.ModeEnforce, authz.ActionAllow, deny)))
+	require.Empty(t, request(t, inbound, "hello"))
+	// 在连接应用之前就被拒绝
+	require.Zero(t, accepted.Load())
+	require.Eventually(t, func() bool {
+		return p.CloseReasonCounts()[proxy.CloseDenied] >= 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// audit模式下只记录
+	auditDeny := metrics.AuthzDecisions.WithLabelValues("no-app", "audit_deny")
+	before := testutil.ToFloat64(auditDeny)
+	audit := startProxyInbound(t, upstreamTo(upstreamAddr), proxy.WithAuthz(newPolicy(t, authz.ModeAudit, authz.ActionAllow, deny)))
+	require.Equal(t, "hello", request(t, audit, "hello"))
+	require.GreaterOrEqual(t, testutil.ToFloat64(auditDeny), before+1)
+}
+
+func TestAuthzPrincipalAndHTTP(t *testing.T) {
+	upstreamAddr, accepted := startCountingUpstream(t)
+	creds := testCredentials(t)
+	policy := newPolicy(t, authz.ModeEnforce, authz.ActionDeny, authz.Rule{
+		Name:       "sidecar-get",
+		Action:     authz.ActionAllow,
+		Principals: []string{"spiffe://cluster.local/ns/default/sa/sidecar"},
+		Methods:    []string{"GET"},
+		Paths:      []string{"/api/*"},
+	})
+	inbound := startProxyInbound(t, upstreamTo(upstreamAddr),
+		proxy.WithMTLS(mtls.ModePermissive, creds), proxy.WithAuthz(policy))
+	outbound := startProxyOutbound(t, upstreamTo(inbound), proxy.WithMTLS(mtls.ModePermissive, creds))
+	denied := metrics.AuthzDecisions.WithLabelValues(authz.DefaultRule, "deny")
+	before := testutil.ToFloat64(denied)
+
+	get := "GET /api/reviews?id=1 HTTP/1.1\r\nHost: reviews\r\n\r\n"
+	require.Equal(t, get, request(t, outbound, get))
+	require.EqualValues(t, 1, accepted.Load())
+
+	// 方法不匹配，以及没有经过mTLS的明文连接
+	require.Empty(t, request(t, outbound, "POST /api/reviews HTTP/1.1\r\nHost: reviews\r\n\r\n"))
+	require.Empty(t, request(t, inbound, get))
+	require.EqualValues(t, 1, accepted.Load())
+	require.GreaterOrEqual(t, testutil.ToFloat64(denied), before+2)
+}
+
+func TestAuthzEveryHTTPRequest(t *testing.T) {
+	creds := testCredentials(t)
+	policy := newPolicy(t, authz.ModeEnforce, authz.ActionAllow, authz.Rule{
+		Name:   "deny-admin",
+		Action: authz.ActionDeny,
+		Paths:  []string{"/admin*"},
+	})
+	p, inbound := serveProxyInbound(t, upstreamTo(startHTTPUpstream(t)),
+		proxy.WithMTLS(mtls.ModePermissive, creds), proxy.WithAuthz(policy))
+	outbound := startProxyOutbound(t, upstreamTo(inbound), proxy.WithMTLS(mtls.ModePermissive, creds))
+	denied := metrics.AuthzDecisions.WithLabelValues("deny-admin", "deny")
+	before := testutil.ToFloat64(denied)
+
+	dial := func(t *testing.T, target string) net.Conn {
+		conn, err := net.Dial("tcp", target)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+		return conn
+	}
+	admin := "GET /admin/users HTTP/1.1\r\nHost: reviews\r\n\r\n"
+	for name, target := range map[string]string{"mtls": outbound, "plaintext": inbound} {
+		t.Run(name+" keep-alive", func(t *testing.T) {
+			conn := dial(t, target)
+			require.Equal(t, []string{"200 reviews"}, roundTrip(t, conn, "/reviews"))
+			// 同一个连接上的第二个请求被拒绝，连接被关闭
+			_, err := conn.Write([]byte(admin))
+			require.NoError(t, err)
+			rest, err := io.ReadAll(conn)
+			require.NoError(t, err)
+			require.Empty(t, rest)
+		})
+		t.Run(name+" pipelining", func(t *testing.T) {
+			conn := dial(t, target)
+			_, err := conn.Write([]byte("GET /reviews HTTP/1.1\r\nHost: reviews\r\n\r\n" + admin))
+			require.NoError(t, err)
+			// 应用没有收到/admin的请求，不会返回404
+			rest, err := io.ReadAll(conn)
+			require.NoError(t, err)
+			require.NotContains(t, string(rest), "404")
+		})
+		t.Run(name+" split request line", func(t *testing.T) {
+			conn := dial(t, target)
+			// 请求行在识别超时之后才完整，不能按TCP放行
+			_, err := conn.Write([]byte(admin[:2]))
+			require.NoError(t, err)
+			time.Sleep(300 * time.Millisecond)
+			_, err = conn.Write([]byte(admin[2:]))
+			require.NoError(t, err)
+			rest, err := io.ReadAll(conn)
+			require.NoError(t, err)
+			require.Empty(t, rest)
+		})
+		t.Run(name+" after connect", func(t *testing.T) {
+			conn := dial(t, target)
+			// CONNECT的响应到达之前后面的数据仍按请求授权
+			_, err := conn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n" + admin))
+			require.NoError(t, err)
+			rest, err := io.ReadAll(conn)
+			require.NoError(t, err)
+			require.NotContains(t, string(rest), "404")
+		})
+		t.Run(name+" not http", func(t *testing.T) {
+			conn := dial(t, target)
+			_, err := conn.Write([]byte("hello\r\n"))
+			require.NoError(t, err)
+			rest, err := io.ReadAll(conn)
+			require.NoError(t, err)
+			require.Empty(t, rest)
+		})
+	}
+	require.GreaterOrEqual(t, testutil.ToFloat64(denied), before+8)
+	require.Eventually(t, func() bool {
+		return p.CloseReasonCounts()[proxy.CloseDenied] >= 10
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,189 @@
+package proxy_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/SMALL-head/zmesh/dataplane/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// freePort 获取一个当前空闲的端口
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startProxyOutbound 以proxy模式启动outbound代理，返回监听地址
+func startProxyOutbound(t *testing.T, opts ...proxy.Option) string {
+	_, addr := serveProxyOutbound(t, opts...)
+	return addr
+}
+
+func serveProxyOutbound(t *testing.T, opts ...proxy.Option) (*proxy.ProxyOutbound, string) {
+	port := freePort(t)
+	p := proxy.NewProxyOutBound(proxyModeOptions(port, opts)...)
+	go func() { _ = p.Start() }()
+	return p, waitListening(t, port)
+}
+
+// startProxyInbound 以proxy模式启动inbound代理，返回监听地址
+func startProxyInbound(t *testing.T, opts ...proxy.Option) string {
+	port := freePort(t)
+	p := proxy.NewProxyInBound(proxyModeOptions(port, opts)...)
+	go func() { _ = p.Start() }()
+	return waitListening(t, port)
+}
+
+func proxyModeOptions(port int, opts []proxy.Option) []proxy.Option {
+	return append([]proxy.Option{
+		proxy.WithHost("127.0.0.1"),
+		proxy.WithPort(port),
+		proxy.WithMode(proxy.ProxyMode),
+	}, opts...)
+}
+
+func waitListening(t *testing.T, port int) string {
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}, 5*time.Second, 20*time.Millisecond)
+	return addr
+}
+
+// startUpstream 启动上游服务，首字节为's'的连接模拟一个迟迟不读数据的慢上游，其余连接原样回显
+func startUpstream(t *testing.T) (addr string, release chan struct{}) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	release = make(chan struct{})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				first := make([]byte, 1)
+				if _, err := io.ReadFull(conn, first); err != nil {
+					return
+				}
+				if first[0] == 's' {
+					<-release
+					_, _ = io.Copy(io.Discard, conn)
+					return
+				}
+				_, _ = conn.Write(first)
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String(), release
+}
+
+func TestSlowUpstreamDoesNotBlockEventLoop(t *testing.T) {
+	upstreamAddr, release := startUpstream(t)
+	defer close(release)
+	addr := startProxyOutbound(t,
+		proxy.WithUpstream(proxy.NewUpstream("test", time.Second, proxy.Endpoint{Addr: upstreamAddr})),
+		proxy.WithWatermarks(64<<10, 16<<10),
+	)
+
+	slow, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer slow.Close()
+	go func() {
+		chunk := bytes.Repeat([]byte{'s'}, 64<<10)
+		for i := 0; i < 256; i++ {
+			if _, err := slow.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// 慢上游把缓冲写满后，其它连接仍然可以正常收发
+	for i := 0; i < 8; i++ {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		require.NoError(t, conn.SetDeadline(time.Now().Add(3*time.Second)))
+		msg := []byte("echo-" + strconv.Itoa(i))
+		_, err = conn.Write(msg)
+		require.NoError(t, err)
+		got := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, got)
+		require.NoError(t, err)
+		require.Equal(t, msg, got)
+		conn.Close()
+	}
+}
+
+// startStalledUpstream 返回一个accept队列已满的地址，之后连接它的SYN都被丢弃，连接一直阻塞到超时
+func startStalledUpstream(t *testing.T) string {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	t.Cleanup(func() { syscall.Close(fd) })
+	require.NoError(t, syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}))
+	require.NoError(t, syscall.Listen(fd, 0))
+	sa, err := syscall.Getsockname(fd)
+	require.NoError(t, err)
+	addr := fmt.Sprintf("127.0.0.1:%d", sa.(*syscall.SockaddrInet4).Port)
+	// 占满accept队列
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return addr
+}
+
+func TestSlowDialDoesNotBlockEventLoop(t *testing.T) {
+	echoAddr, release := startUpstream(t)
+	defer close(release)
+	// 两个endpoint权重相同，轮流选中
+	u := proxy.NewUpstream("test", 10*time.Second, proxy.Endpoint{Addr: startStalledUpstream(t)}, proxy.Endpoint{Addr: echoAddr})
+	addr := startProxyOutbound(t, proxy.WithUpstream(u))
+
+	// 等待listener启动时的连接同样会选择endpoint，因此逐个尝试，直到某个连接选中连接不上的endpoint
+	for {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+		if _, err = conn.Read(make([]byte, 1)); err != nil {
+			break
+		}
+	}
+
+	// 连接上游还在进行时，同一个event-loop上的其它连接仍然可以建立并收发数据，每个event-loop都至少有一个连接
+	for i := range runtime.NumCPU() + 1 {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		require.NoError(t, conn.SetDeadline(time.Now().Add(3*time.Second)))
+		msg := []byte("echo-" + strconv.Itoa(i))
+		_, err = conn.Write(msg)
+		require.NoError(t, err)
+		got := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, got)
+		require.NoError(t, err)
+		require.Equal(t, msg, got)
+		conn.Close()
+		// 跳过下一次轮到的连接不上的endpoint
+		_, _ = u.Pick()
+	}
+}
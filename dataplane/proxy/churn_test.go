@@ -0,0 +1,88 @@
+package proxy_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SMALL-head/zmesh/dataplane/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// openSockets 统计当前进程打开的socket数量，io.Copy在linux下走splice会缓存pipe，因此只统计socket
+func openSockets(t *testing.T) int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("cannot read /proc/self/fd: %v", err)
+	}
+	n := 0
+	for _, e := range entries {
+		if link, err := os.Readlink("/proc/self/fd/" + e.Name()); err == nil && strings.HasPrefix(link, "socket:") {
+			n++
+		}
+	}
+	return n
+}
+
+// TestConnChurnNoFdDoubleClose 大量连接反复建立、中途断开，
+// 如果回传路径关闭了gnet仍持有的fd，被复用的fd会串到其它连接上，表现为回显内容错乱或fd泄漏
+func TestConnChurnNoFdDoubleClose(t *testing.T) {
+	upstreamAddr, release := startUpstream(t)
+	defer close(release)
+	addr := startProxyOutbound(t,
+		proxy.WithUpstream(proxy.NewUpstream("test", time.Second, proxy.Endpoint{Addr: upstreamAddr})),
+	)
+	baseline := openSockets(t)
+
+	const rounds, concurrency = 20, 50
+	for r := 0; r < rounds; r++ {
+		var wg sync.WaitGroup
+		errCh := make(chan error, concurrency)
+		for i := 0; i < concurrency; i++ {
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				conn, err := net.Dial("tcp", addr)
+				if err != nil {
+					errCh <- err
+					return
+				}
+				defer conn.Close()
+				_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+				payload := bytes.Repeat([]byte(fmt.Sprintf("e%d-%d|", r, id)), 1+id*97)
+				if _, err = conn.Write(payload); err != nil {
+					errCh <- err
+					return
+				}
+				if id%2 == 1 {
+					// 一半的连接不等回显直接断开
+					return
+				}
+				got := make([]byte, len(payload))
+				if _, err = io.ReadFull(conn, got); err != nil {
+					errCh <- fmt.Errorf("conn %d-%d: %w", r, id, err)
+					return
+				}
+				if !bytes.Equal(payload, got) {
+					errCh <- fmt.Errorf("conn %d-%d: echoed payload mismatch", r, id)
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errCh)
+		for err := range errCh {
+			require.NoError(t, err)
+		}
+	}
+
+	require.Eventually(t, func() bool {
+		return openSockets(t) <= baseline
+	}, 10*time.Second, 50*time.Millisecond, "fd leaked after churn")
+}
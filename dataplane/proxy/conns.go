@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"sort"
+	"time"
+)
+
+// ConnInfo 一条被代理连接的快照，供admin接口展示
+type ConnInfo struct {
+	Listener      string        `json:"listener"`
+	Downstream    string        `json:"downstream"`
+	OriginalDst   string        `json:"original_dst"`
+	StartTime     time.Time     `json:"start_time"`
+	Age           time.Duration `json:"age"`
+	BytesReceived int64         `json:"bytes_received"` // 下游 -> 上游
+	BytesSent     int64         `json:"bytes_sent"`     // 上游 -> 下游
+}
+
+func (p *Proxy) trackConn(cc *ConnContext) {
+	p.conns.Store(cc, struct{}{})
+}
+
+func (p *Proxy) untrackConn(cc *ConnContext) {
+	p.conns.Delete(cc)
+}
+
+// Connections 返回当前所有存活连接，按建立时间排序
+func (p *Proxy) Connections() []ConnInfo {
+	var infos []ConnInfo
+	now := time.Now()
+	p.conns.Range(func(k, _ any) bool {
+		cc := k.(*ConnContext)
+		infos = append(infos, ConnInfo{
+			Listener:      p.listener,
+			Downstream:    cc.downstreamAddr,
+			OriginalDst:   cc.destAddr,
+			StartTime:     cc.startTime,
+			Age:           now.Sub(cc.startTime),
+			BytesReceived: cc.rxBytes.Load(),
+			BytesSent:     cc.txBytes.Load(),
+		})
+		return true
+	})
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].StartTime.Before(infos[j].StartTime)
+	})
+	return infos
+}
+
+// ActiveConnections 当前存活的连接数
+func (p *Proxy) ActiveConnections() int {
+	n := 0
+	p.conns.Range(func(_, _ any) bool {
+		n++
+		return true
+	})
+	return n
+}
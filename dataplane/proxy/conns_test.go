@@ -0,0 +1,88 @@
+package proxy_test
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/SMALL-head/zmesh/dataplane/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// startCountingUpstream 原样回显的上游，记录接受的连接数
+func startCountingUpstream(t *testing.T) (string, *atomic.Int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String(), &accepted
+}
+
+func TestConnectionsAndDrain(t *testing.T) {
+	upstreamAddr, accepted := startCountingUpstream(t)
+	p, addr := serveProxyOutbound(t,
+		proxy.WithUpstream(proxy.NewUpstream("test", time.Second, proxy.Endpoint{Addr: upstreamAddr})),
+	)
+	require.Eventually(t, p.Ready, 5*time.Second, 10*time.Millisecond)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	msg := []byte("echo conns")
+	_, err = conn.Write(msg)
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, len(msg)))
+	require.NoError(t, err)
+
+	var info proxy.ConnInfo
+	require.Eventually(t, func() bool {
+		for _, c := range p.Connections() {
+			if c.Downstream == conn.LocalAddr().String() {
+				info = c
+				return c.BytesSent == int64(len(msg))
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "outbound", info.Listener)
+	require.Equal(t, upstreamAddr, info.OriginalDst)
+	require.Equal(t, int64(len(msg)), info.BytesReceived)
+
+	// waitListening的探测连接同样会连接上游
+	require.Eventually(t, func() bool { return accepted.Load() == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	// 排空后不再ready。监听端口仍然完成三次握手，但新连接立即被reset，不会连接上游；已有连接不受影响
+	p.Drain()
+	require.False(t, p.Ready())
+	// reset可能在connect返回之前就已经到达
+	rejected, err := net.Dial("tcp", addr)
+	if err == nil {
+		require.NoError(t, rejected.SetDeadline(time.Now().Add(5*time.Second)))
+		_, err = rejected.Read(make([]byte, 1))
+		rejected.Close()
+	}
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.EqualValues(t, 2, accepted.Load())
+
+	_, err = conn.Write(msg)
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, len(msg)))
+	require.NoError(t, err)
+}
@@ -0,0 +1,125 @@
+package proxy_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/SMALL-head/zmesh/dataplane/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// startHalfCloseUpstream 上游读到EOF后才回复收到的字节数，随后关闭连接，
+// 对应shutdown(SHUT_WR)式的请求/响应模式
+func startHalfCloseUpstream(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				n, err := io.Copy(io.Discard, conn)
+				if err != nil {
+					return
+				}
+				_, _ = fmt.Fprintf(conn, "received %d bytes", n)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// startServerFirstCloseUpstream 上游先发送问候并关闭写端，之后仍然读取客户端数据，读到EOF后回写到结果通道
+func startServerFirstCloseUpstream(t *testing.T) (string, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	result := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = conn.Write([]byte("hello"))
+				_ = conn.(*net.TCPConn).CloseWrite()
+				// 探测代理是否就绪的连接不会发送数据，忽略即可
+				if data, _ := io.ReadAll(conn); len(data) > 0 {
+					result <- string(data)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), result
+}
+
+func halfCloseProxies(t *testing.T, upstreamAddr string) map[string]string {
+	u := func() proxy.Option {
+		return proxy.WithUpstream(proxy.NewUpstream("test", time.Second, proxy.Endpoint{Addr: upstreamAddr}))
+	}
+	return map[string]string{
+		"outbound": startProxyOutbound(t, u()),
+		"inbound":  startProxyInbound(t, u()),
+	}
+}
+
+func TestDownstreamHalfClose(t *testing.T) {
+	for name, addr := range halfCloseProxies(t, startHalfCloseUpstream(t)) {
+		t.Run(name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			require.NoError(t, err)
+			defer conn.Close()
+			require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+			payload := make([]byte, 100<<10)
+			_, err = conn.Write(payload)
+			require.NoError(t, err)
+			require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+
+			// 关闭写端之后仍然能完整收到响应，并且最终读到EOF
+			resp, err := io.ReadAll(conn)
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf("received %d bytes", len(payload)), string(resp))
+		})
+	}
+}
+
+func TestUpstreamHalfClose(t *testing.T) {
+	for _, name := range []string{"outbound", "inbound"} {
+		t.Run(name, func(t *testing.T) {
+			upstreamAddr, result := startServerFirstCloseUpstream(t)
+			addr := halfCloseProxies(t, upstreamAddr)[name]
+
+			conn, err := net.Dial("tcp", addr)
+			require.NoError(t, err)
+			defer conn.Close()
+			require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+			// 上游关闭写端后下游收到EOF
+			greeting, err := io.ReadAll(conn)
+			require.NoError(t, err)
+			require.Equal(t, "hello", string(greeting))
+
+			// 下游仍然可以继续发送数据
+			_, err = conn.Write([]byte("still writable"))
+			require.NoError(t, err)
+			require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+
+			select {
+			case got := <-result:
+				require.Equal(t, "still writable", got)
+			case <-time.After(5 * time.Second):
+				t.Fatal("upstream did not receive data after half close")
+			}
+		})
+	}
+}
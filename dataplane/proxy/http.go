@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/SMALL-head/zmesh/dataplane/accesslog"
+	"github.com/SMALL-head/zmesh/dataplane/http1"
+	"github.com/SMALL-head/zmesh/dataplane/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// maxPathLabels 每个listener指标中path取值的上限，超过之后新的路径记为other，避免指标无限增长
+const maxPathLabels = 200
+
+const otherLabel = "other"
+
+// WithHTTPPorts 目的端口在ports中的连接总是按HTTP/1.1解析，其余连接在识别出HTTP/1.x之后解析
+func WithHTTPPorts(ports ...int) Option {
+	return func(p *Proxy) {
+		p.settings.httpPorts = ports
+	}
+}
+
+func (s *settings) isHTTPPort(dst string) bool {
+	ap, err := netip.ParseAddrPort(dst)
+	return err == nil && slices.Contains(s.httpPorts, int(ap.Port()))
+}
+
+// startHTTP 开始按HTTP/1.1解析连接上的数据，解析只用于指标和访问日志，转发的数据不变
+func (cc *ConnContext) startHTTP() {
+	cc.http.CompareAndSwap(nil, http1.New(cc.observeRequest))
+}
+
+// tapRequest 下游 -> 上游方向的数据在转发之前交给HTTP解析
+func (cc *ConnContext) tapRequest(b []byte) {
+	cc.tap(b, (*http1.Codec).Request)
+}
+
+// tapResponse 上游 -> 下游方向的数据在转发之前交给HTTP解析
+func (cc *ConnContext) tapResponse(b []byte) {
+	cc.tap(b, (*http1.Codec).Response)
+}
+
+func (cc *ConnContext) tap(b []byte, write func(*http1.Codec, []byte) error) {
+	codec := cc.http.Load()
+	if codec == nil {
+		return
+	}
+	if err := write(codec, b); err != nil {
+		// 之后只转发，不再解析
+		logrus.Debugf("[ConnContext] - stop parsing http on connection from %s to %s: %v", cc.downstreamAddr, cc.destAddr, err)
+	}
+}
+
+// observeRequest 一个请求结束，记录指标和访问日志
+func (cc *ConnContext) observeRequest(ex http1.Exchange) {
+	p := cc.p
+	code := strconv.Itoa(ex.Status)
+	metrics.HTTPRequests.WithLabelValues(p.listener, string(p.mode), cc.destAddr, methodLabel(ex.Method), p.pathLabel(ex.Path), code).Inc()
+	metrics.HTTPRequestDuration.WithLabelValues(p.listener, string(p.mode), cc.destAddr, code).Observe(ex.Duration.Seconds())
+	logrus.Debugf("[ConnContext] - %s %s from %s to %s: %d in %s", ex.Method, ex.Path, cc.downstreamAddr, cc.destAddr, ex.Status, ex.Duration)
+	p.accessLog.LogRequest(accesslog.RequestEntry{
+		Downstream:    cc.downstreamAddr,
+		OriginalDst:   cc.destAddr,
+		Direction:     p.listener,
+		Mode:          string(p.mode),
+		StartTime:     ex.Start,
+		Duration:      ex.Duration,
+		Method:        ex.Method,
+		Path:          ex.Path,
+		Host:          ex.Host,
+		Status:        ex.Status,
+		BytesReceived: ex.RequestBytes,
+		BytesSent:     ex.ResponseBytes,
+	})
+}
+
+// methodLabel 标准方法以外的方法记为other
+func methodLabel(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH":
+		return method
+	default:
+		return otherLabel
+	}
+}
+
+// pathLabel 去掉query的路径，listener上出现过的路径超过maxPathLabels之后，新的路径记为other
+func (p *Proxy) pathLabel(path string) string {
+	path, _, _ = strings.Cut(path, "?")
+	if _, ok := p.httpPaths.Load(path); ok {
+		return path
+	}
+	if p.httpPathCount.Add(1) > maxPathLabels {
+		p.httpPathCount.Add(-1)
+		return otherLabel
+	}
+	if _, loaded := p.httpPaths.LoadOrStore(path, struct{}{}); loaded {
+		p.httpPathCount.Add(-1)
+	}
+	return path
+}
@@ -0,0 +1,114 @@
+package proxy_test
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/SMALL-head/zmesh/dataplane/accesslog"
+	"github.com/SMALL-head/zmesh/dataplane/metrics"
+	"github.com/SMALL-head/zmesh/dataplane/mtls"
+	"github.com/SMALL-head/zmesh/dataplane/proxy"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// requestEntries 下游连接上所有请求的访问日志
+func requestEntries(buf *syncBuffer, downstream string) []map[string]any {
+	return buf.entries(func(m map[string]any) bool {
+		return m["msg"] == "request" && m["downstream"] == downstream
+	})
+}
+
+func TestHTTPRequests(t *testing.T) {
+	var buf syncBuffer
+	al, err := accesslog.NewWithWriter(accesslog.FormatJSON, &buf)
+	require.NoError(t, err)
+	upstreamAddr := startHTTPUpstream(t)
+	outbound := startProxyOutbound(t, upstreamTo(upstreamAddr), proxy.WithAccessLog(al))
+	notFound := metrics.HTTPRequests.WithLabelValues("outbound", string(proxy.ProxyMode), upstreamAddr, "GET", "/missing", "404")
+	before := testutil.ToFloat64(notFound)
+
+	conn, err := net.Dial("tcp", outbound)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	downstream := conn.LocalAddr().String()
+	require.Equal(t, []string{"200 reviews", "200 part0;part1;part2;", "404 404 page not found\n"},
+		roundTrip(t, conn, "/reviews?id=1", "/stream", "/missing"))
+	// keep-alive
+	require.Equal(t, []string{"200 reviews"}, roundTrip(t, conn, "/reviews"))
+
+	var entries []map[string]any
+	require.Eventually(t, func() bool {
+		entries = requestEntries(&buf, downstream)
+		return len(entries) == 4
+	}, 5*time.Second, 10*time.Millisecond)
+	for i, want := range []struct {
+		path   string
+		status float64
+	}{{"/reviews?id=1", 200}, {"/stream", 200}, {"/missing", 404}, {"/reviews", 200}} {
+		require.Equal(t, "GET", entries[i]["method"])
+		require.Equal(t, want.path, entries[i]["path"])
+		require.Equal(t, want.status, entries[i]["status"])
+		require.Equal(t, "reviews", entries[i]["host"])
+		require.Equal(t, upstreamAddr, entries[i]["original_dst"])
+	}
+	require.Equal(t, before+1, testutil.ToFloat64(notFound))
+}
+
+func TestHTTPPorts(t *testing.T) {
+	var buf syncBuffer
+	al, err := accesslog.NewWithWriter(accesslog.FormatJSON, &buf)
+	require.NoError(t, err)
+	upstreamAddr := startHTTPUpstream(t)
+	port := netip.MustParseAddrPort(upstreamAddr).Port()
+	// 请求行来得太慢，识别为unknown，但端口配置为HTTP时仍然解析
+	outbound := startProxyOutbound(t, upstreamTo(upstreamAddr), proxy.WithAccessLog(al),
+		proxy.WithSniffTimeout(10*time.Millisecond), proxy.WithHTTPPorts(int(port)))
+
+	conn, err := net.Dial("tcp", outbound)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	downstream := conn.LocalAddr().String()
+	_, err = conn.Write([]byte("GE"))
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	_, err = conn.Write([]byte("T /reviews HTTP/1.1\r\nHost: reviews\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+
+	require.Eventually(t, func() bool {
+		entries := requestEntries(&buf, downstream)
+		return len(entries) == 1 && entries[0]["path"] == "/reviews"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestHTTPRequestsOverMTLS(t *testing.T) {
+	var buf syncBuffer
+	al, err := accesslog.NewWithWriter(accesslog.FormatJSON, &buf)
+	require.NoError(t, err)
+	creds := testCredentials(t)
+	inbound := startProxyInbound(t, upstreamTo(startHTTPUpstream(t)),
+		proxy.WithMTLS(mtls.ModeStrict, creds), proxy.WithAccessLog(al))
+	outbound := startProxyOutbound(t, upstreamTo(inbound), proxy.WithMTLS(mtls.ModeStrict, creds))
+
+	conn, err := net.Dial("tcp", outbound)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	require.Equal(t, []string{"200 reviews", "200 part0;part1;part2;"}, roundTrip(t, conn, "/reviews", "/stream"))
+
+	// inbound解析的是去掉mTLS之后的数据
+	require.Eventually(t, func() bool {
+		entries := buf.entries(func(m map[string]any) bool { return m["msg"] == "request" && m["direction"] == "inbound" })
+		return len(entries) == 2 && entries[0]["path"] == "/reviews" && entries[1]["path"] == "/stream"
+	}, 5*time.Second, 10*time.Millisecond)
+}
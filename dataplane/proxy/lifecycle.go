@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+	"github.com/sirupsen/logrus"
+)
+
+const drainPollInterval = 100 * time.Millisecond
+
+// setEngine 记录gnet引擎，若在启动之前已经调用过Stop则返回false，由OnBoot直接关闭引擎
+func (p *Proxy) setEngine(eng gnet.Engine) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.stopped {
+		return false
+	}
+	p.eng = eng
+	p.booted.Store(true)
+	return true
+}
+
+// Drain 进入排空状态：readiness失败，已有连接继续转发直到自然结束。
+// gnet无法在引擎运行期间注销监听socket(accept出错会停止整个引擎)，因此监听端口仍然完成三次握手，
+// 新连接在OnOpen中以RST关闭，见rejectDraining：客户端立即收到connection reset，不会收到数据，也不会连接上游
+func (p *Proxy) Drain() {
+	if !p.draining.Swap(true) {
+		logrus.Infof("%s listener %s start draining", p.listener, p.listenAddr())
+	}
+}
+
+func (p *Proxy) Draining() bool {
+	return p.draining.Load()
+}
+
+// rejectDraining 排空期间的新连接以RST关闭，避免客户端把FIN当成上游返回的空响应
+func rejectDraining(c gnet.Conn, tag string) (out []byte, action gnet.Action) {
+	logrus.Infof("[%s] - rejecting connection from %s, listener is draining", tag, c.RemoteAddr().String())
+	_ = c.SetLinger(0)
+	return nil, gnet.Close
+}
+
+// Ready listener已经启动并且没有在排空
+func (p *Proxy) Ready() bool {
+	return p.booted.Load() && !p.draining.Load()
+}
+
+// WaitDrained 等待已有连接全部结束，ctx到期时返回ctx.Err()
+func (p *Proxy) WaitDrained(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for p.ActiveConnections() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// Stop 停止gnet引擎，仍存活的连接会被强制关闭，Start随之返回
+func (p *Proxy) Stop(ctx context.Context) error {
+	p.draining.Store(true)
+	p.lock.Lock()
+	p.stopped = true
+	eng := p.eng
+	p.lock.Unlock()
+	if !p.booted.Load() {
+		return nil
+	}
+	if n := p.ActiveConnections(); n > 0 {
+		logrus.Warnf("%s listener %s force closing %d connections", p.listener, p.listenAddr(), n)
+	}
+	return eng.Stop(ctx)
+}
+
+// Shutdown 优雅关闭：先排空，最多等到ctx到期，然后停止引擎
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.Drain()
+	if err := p.WaitDrained(ctx); err != nil {
+		logrus.Warnf("%s listener %s drain period expired with %d connections left",
+			p.listener, p.listenAddr(), p.ActiveConnections())
+	}
+	return p.Stop(context.Background())
+}
@@ -0,0 +1,101 @@
+package proxy_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/SMALL-head/zmesh/dataplane/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// startStoppableOutbound 启动outbound代理，返回的chan在Start返回时关闭
+func startStoppableOutbound(t *testing.T, opts ...proxy.Option) (*proxy.ProxyOutbound, string, chan struct{}) {
+	port := freePort(t)
+	p := proxy.NewProxyOutBound(proxyModeOptions(port, opts)...)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = p.Start()
+	}()
+	return p, waitListening(t, port), done
+}
+
+func dialEcho(t *testing.T, addr string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+	msg := []byte("echo lifecycle")
+	_, err = conn.Write(msg)
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, len(msg)))
+	require.NoError(t, err)
+	return conn
+}
+
+func TestShutdownWaitsForConnections(t *testing.T) {
+	upstreamAddr, release := startUpstream(t)
+	defer close(release)
+	p, addr, done := startStoppableOutbound(t,
+		proxy.WithUpstream(proxy.NewUpstream("test", time.Second, proxy.Endpoint{Addr: upstreamAddr})),
+	)
+	require.Eventually(t, p.Ready, 5*time.Second, 10*time.Millisecond)
+	conn := dialEcho(t, addr)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		shutdown <- p.Shutdown(ctx)
+	}()
+	require.Eventually(t, func() bool { return !p.Ready() }, 5*time.Second, 10*time.Millisecond)
+
+	// 排空期间已有连接仍然可用
+	msg := []byte("still alive")
+	_, err := conn.Write(msg)
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, len(msg)))
+	require.NoError(t, err)
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown returned before connection finished")
+	default:
+	}
+
+	start := time.Now()
+	conn.Close()
+	select {
+	case err := <-shutdown:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not return after connection finished")
+	}
+	require.Less(t, time.Since(start), 5*time.Second)
+	<-done
+}
+
+func TestShutdownForceClosesAfterDrainTimeout(t *testing.T) {
+	upstreamAddr, release := startUpstream(t)
+	defer close(release)
+	p, addr, done := startStoppableOutbound(t,
+		proxy.WithUpstream(proxy.NewUpstream("test", time.Second, proxy.Endpoint{Addr: upstreamAddr})),
+	)
+	conn := dialEcho(t, addr)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	require.NoError(t, p.Shutdown(ctx))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("engine did not stop")
+	}
+	// 连接被强制关闭
+	_, err := conn.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.Equal(t, 0, p.ActiveConnections())
+}
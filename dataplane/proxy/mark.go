@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// WithSocketMark proxy发起的连接都带上SO_MARK，拦截规则跳过带mark的流量，proxy不再需要以固定的uid运行。
+// 需要CAP_NET_ADMIN，mark为0时不设置
+func WithSocketMark(mark int) Option {
+	return func(p *Proxy) {
+		p.socketMark = mark
+	}
+}
+
+func setMark(fd, mark int) error {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, mark); err != nil {
+		return fmt.Errorf("setting SO_MARK: %w", err)
+	}
+	return nil
+}
+
+// control 在connect之前对socket执行f
+func control(rc syscall.RawConn, f func(fd int) error) error {
+	var ferr error
+	if err := rc.Control(func(fd uintptr) {
+		ferr = f(int(fd))
+	}); err != nil {
+		return err
+	}
+	return ferr
+}
+
+// dialer 连接上游使用的Dialer，配置了mark时给socket打上mark
+func (p *Proxy) dialer(timeout time.Duration) net.Dialer {
+	d := net.Dialer{Timeout: timeout}
+	if p.socketMark == 0 {
+		return d
+	}
+	mark := p.socketMark
+	d.Control = func(network, address string, rc syscall.RawConn) error {
+		return control(rc, func(fd int) error { return setMark(fd, mark) })
+	}
+	return d
+}
@@ -0,0 +1,41 @@
+package proxy_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/SMALL-head/zmesh/dataplane/metrics"
+	"github.com/SMALL-head/zmesh/dataplane/proxy"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectionMetrics(t *testing.T) {
+	upstreamAddr, release := startUpstream(t)
+	defer close(release)
+	addr := startProxyOutbound(t,
+		proxy.WithUpstream(proxy.NewUpstream("test", time.Second, proxy.Endpoint{Addr: upstreamAddr})),
+	)
+	total := metrics.TotalConnections.WithLabelValues("outbound", "proxy", upstreamAddr)
+	before := testutil.ToFloat64(total)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	msg := []byte("echo metrics")
+	_, err = conn.Write(msg)
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, len(msg)))
+	require.NoError(t, err)
+	conn.Close()
+
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(metrics.ClosedConnections.WithLabelValues("outbound", "proxy", string(proxy.CloseNormal))) >= 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.GreaterOrEqual(t, testutil.ToFloat64(total), before+1)
+	require.GreaterOrEqual(t, testutil.ToFloat64(metrics.BytesReceived.WithLabelValues("outbound", "proxy", upstreamAddr)), float64(len(msg)))
+	require.GreaterOrEqual(t, testutil.ToFloat64(metrics.BytesSent.WithLabelValues("outbound", "proxy", upstreamAddr)), float64(len(msg)))
+	require.Positive(t, testutil.CollectAndCount(metrics.DialLatency))
+}
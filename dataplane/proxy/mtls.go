@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/SMALL-head/zmesh/dataplane/metrics"
+	"github.com/SMALL-head/zmesh/dataplane/mtls"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// mtlsDetectTimeout inbound等待下游第一个字节的时间，超时的按明文处理(如服务端先发送数据的协议)
+	mtlsDetectTimeout = 100 * time.Millisecond
+	// plaintextPeerTTL permissive模式下对端mTLS握手失败后，在这段时间内直接使用明文连接
+	plaintextPeerTTL = time.Minute
+	// tls记录最大16KiB，再加上记录头和扩展的余量
+	mtlsSniffBufferSize = 20 << 10
+)
+
+// mTLS握手的结果，用于指标
+const (
+	mtlsResultOK        = "ok"
+	mtlsResultFailed    = "failed"
+	mtlsResultPlaintext = "plaintext"
+	mtlsResultRejected  = "rejected"
+)
+
+var errMTLS = errors.New("mtls handshake failed")
+
+// WithMTLS sidecar之间使用mTLS：outbound用creds发起mTLS，inbound终结mTLS后以明文转发给应用。
+// mode为permissive时outbound在对端不支持时退回明文，inbound同时接受明文；为strict时只使用mTLS
+func WithMTLS(mode string, creds *mtls.Credentials) Option {
+	return func(p *Proxy) {
+		if mode == mtls.ModeDisable || mode == "" || creds == nil {
+			p.mtlsMode, p.mtls = "", nil
+			return
+		}
+		p.mtlsMode, p.mtls = mode, creds
+	}
+}
+
+// WithMeshCIDRs outbound只对目的地址在这些网段内的连接发起mTLS，为空时对所有目的地址发起mTLS
+func WithMeshCIDRs(prefixes ...netip.Prefix) Option {
+	return func(p *Proxy) {
+		p.meshCIDRs = prefixes
+	}
+}
+
+// inMesh 按实际连接的上游地址判断，proxy模式下集群中配置的域名解析之后同样适用
+func (p *Proxy) inMesh(addr net.Addr) bool {
+	if len(p.meshCIDRs) == 0 {
+		return true
+	}
+	ta, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip := ta.AddrPort().Addr().Unmap()
+	return slices.ContainsFunc(p.meshCIDRs, func(prefix netip.Prefix) bool {
+		return prefix.Contains(ip)
+	})
+}
+
+func (p *Proxy) observeMTLS(result string) {
+	metrics.MTLSHandshakes.WithLabelValues(p.listener, result).Inc()
+}
+
+// secureUpstream outbound对新建立的mesh内的上游连接发起mTLS握手。permissive模式下握手失败时重新建立明文连接，
+// 并在一段时间内不再对该地址尝试mTLS。在连接上游的协程中调用，不阻塞event-loop
+func (p *Proxy) secureUpstream(d net.Dialer, dst string, conn net.Conn) (net.Conn, error) {
+	if p.mtls == nil || p.listener != "outbound" {
+		return conn, nil
+	}
+	if !p.inMesh(conn.RemoteAddr()) {
+		logrus.Debugf("[secureUpstream] - %s is outside the mesh, using plaintext", dst)
+		return conn, nil
+	}
+	if p.isPlaintextPeer(dst) {
+		return conn, nil
+	}
+	timeout := d.Timeout
+	if timeout <= 0 {
+		timeout = defaultConnectTimeout
+	}
+	tc := tls.Client(conn, p.mtls.ClientConfig())
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := tc.HandshakeContext(ctx)
+	if err == nil {
+		p.observeMTLS(mtlsResultOK)
+		logrus.Debugf("[secureUpstream] - mtls established with %s(%s)", dst, mtls.PeerID(tc.ConnectionState()))
+		return tc, nil
+	}
+	_ = conn.Close()
+	if p.mtlsMode == mtls.ModeStrict {
+		p.observeMTLS(mtlsResultFailed)
+		return nil, fmt.Errorf("%w with %s: %w", errMTLS, dst, err)
+	}
+	p.observeMTLS(mtlsResultPlaintext)
+	logrus.Infof("[secureUpstream] - mtls handshake with %s failed, falling back to plaintext: %s", dst, err)
+	p.rememberPlaintextPeer(dst)
+	return d.Dial("tcp", dst)
+}
+
+// isPlaintextPeer dst最近是否mTLS握手失败，过期的记录在这里删除
+func (p *Proxy) isPlaintextPeer(dst string) bool {
+	until, ok := p.plaintextPeers.Load(dst)
+	if !ok {
+		return false
+	}
+	if time.Now().Before(until.(time.Time)) {
+		return true
+	}
+	p.plaintextPeers.CompareAndDelete(dst, until)
+	return false
+}
+
+// rememberPlaintextPeer 记录握手失败的对端。每个TTL最多清理一次过期之后没有再访问的地址，避免记录无限增长
+func (p *Proxy) rememberPlaintextPeer(dst string) {
+	now := time.Now()
+	p.plaintextPeers.Store(dst, now.Add(plaintextPeerTTL))
+	last := p.plaintextSwept.Load()
+	if now.UnixNano()-last < int64(plaintextPeerTTL) || !p.plaintextSwept.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	p.plaintextPeers.Range(func(k, until any) bool {
+		if now.After(until.(time.Time)) {
+			p.plaintextPeers.CompareAndDelete(k, until)
+		}
+		return true
+	})
+}
+
+// accept 识别下游是否为zmesh发起的mTLS，是则完成握手并返回对端身份；应用自己的TLS和明文在permissive模式下原样转发。
+// 没有启用mTLS时直接返回socketpair
+func (t *terminator) accept(dst string) (net.Conn, string, error) {
+	p := t.p
+	if p.mtls == nil {
+		return t.raw, "", nil
+	}
+	r := bufio.NewReaderSize(t.raw, mtlsSniffBufferSize)
+	plain := &bufferedConn{Conn: t.raw, r: r}
+
+	_ = t.raw.SetReadDeadline(time.Now().Add(mtlsDetectTimeout))
+	first, err := r.Peek(1)
+	var ne net.Error
+	switch {
+	case errors.As(err, &ne) && ne.Timeout():
+		// 下游没有先发送数据，不可能是mTLS
+	case err != nil:
+		return nil, "", err
+	case mtls.IsHandshake(first[0]):
+		_ = t.raw.SetReadDeadline(time.Now().Add(p.dialTimeout(0)))
+		hello, err := mtls.PeekClientHello(r)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, proto := range hello.SupportedProtos {
+			if proto == mtls.ALPN {
+				return t.handshake(plain, dst)
+			}
+		}
+	}
+	_ = t.raw.SetReadDeadline(time.Time{})
+	if p.mtlsMode == mtls.ModeStrict {
+		p.observeMTLS(mtlsResultRejected)
+		return nil, "", fmt.Errorf("%w: plaintext connection to %s is not allowed in %s mode", errMTLS, dst, mtls.ModeStrict)
+	}
+	p.observeMTLS(mtlsResultPlaintext)
+	return plain, "", nil
+}
+
+func (t *terminator) handshake(plain *bufferedConn, dst string) (net.Conn, string, error) {
+	tc := tls.Server(plain, t.p.mtls.ServerConfig())
+	if err := tc.Handshake(); err != nil {
+		t.p.observeMTLS(mtlsResultFailed)
+		return nil, "", fmt.Errorf("%w: %w", errMTLS, err)
+	}
+	_ = t.raw.SetReadDeadline(time.Time{})
+	t.p.observeMTLS(mtlsResultOK)
+	peer := mtls.PeerID(tc.ConnectionState())
+	logrus.Debugf("[terminator] - mtls from %s to %s terminated", peer, dst)
+	return &secureConn{Conn: tc, closeWrite: func() error {
+		if err := tc.CloseWrite(); err != nil {
+			return err
+		}
+		return t.raw.CloseWrite()
+	}}, peer, nil
+}
+
+// secureConn 去掉mTLS之后的下游连接，closeWrite在tls的close_notify之外还要关闭socketpair的写端
+type secureConn struct {
+	net.Conn
+	closeWrite func() error
+}
+
+func (c *secureConn) CloseWrite() error {
+	return c.closeWrite()
+}
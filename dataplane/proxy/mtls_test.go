@@ -0,0 +1,247 @@
+package proxy_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SMALL-head/zmesh/dataplane/metrics"
+	"github.com/SMALL-head/zmesh/dataplane/mtls"
+	"github.com/SMALL-head/zmesh/dataplane/proxy"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// testCredentials 生成一个CA以及由它签发的证书，返回加载好的证书
+func testCredentials(t *testing.T) *mtls.Credentials {
+	dir := t.TempDir()
+	write := func(name, typ string, der []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600))
+		return path
+	}
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "zmesh test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "sidecar"},
+		URIs:         []*url.URL{{Scheme: "spiffe", Host: "cluster.local", Path: "/ns/default/sa/sidecar"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}, caTmpl, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	creds, err := mtls.Load(write("cert.pem", "CERTIFICATE", der), write("key.pem", "EC PRIVATE KEY", keyDER), write("ca.pem", "CERTIFICATE", caDER))
+	require.NoError(t, err)
+	return creds
+}
+
+func serveProxyInbound(t *testing.T, opts ...proxy.Option) (*proxy.ProxyInbound, string) {
+	port := freePort(t)
+	p := proxy.NewProxyInBound(proxyModeOptions(port, opts)...)
+	go func() { _ = p.Start() }()
+	return p, waitListening(t, port)
+}
+
+func upstreamTo(addr string) proxy.Option {
+	return proxy.WithUpstream(proxy.NewUpstream("test", time.Second, proxy.Endpoint{Addr: addr}))
+}
+
+func TestMTLSBetweenSidecars(t *testing.T) {
+	creds := testCredentials(t)
+	_, inbound := serveProxyInbound(t, upstreamTo(startHalfCloseUpstream(t)), proxy.WithMTLS(mtls.ModeStrict, creds))
+	outbound := startProxyOutbound(t, upstreamTo(inbound), proxy.WithMTLS(mtls.ModeStrict, creds))
+	handshakes := metrics.MTLSHandshakes.WithLabelValues("inbound", "ok")
+	before := testutil.ToFloat64(handshakes)
+
+	conn, err := net.Dial("tcp", outbound)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	// 经过mTLS之后半关闭仍然按顺序传递
+	payload := make([]byte, 100<<10)
+	_, err = conn.Write(payload)
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	resp, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("received %d bytes", len(payload)), string(resp))
+	require.GreaterOrEqual(t, testutil.ToFloat64(handshakes), before+1)
+}
+
+func TestMTLSStrictRejectsPlaintext(t *testing.T) {
+	upstreamAddr, release := startUpstream(t)
+	defer close(release)
+	p, inbound := serveProxyInbound(t, upstreamTo(upstreamAddr), proxy.WithMTLS(mtls.ModeStrict, testCredentials(t)))
+
+	conn, err := net.Dial("tcp", inbound)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Write([]byte("plaintext"))
+	require.NoError(t, err)
+	data, _ := io.ReadAll(conn)
+	require.Empty(t, data)
+	require.Eventually(t, func() bool {
+		return p.CloseReasonCounts()[proxy.CloseMTLSError] > 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestMTLSPermissive(t *testing.T) {
+	upstreamAddr, release := startUpstream(t)
+	defer close(release)
+	creds := testCredentials(t)
+
+	// outbound的对端不支持mTLS时退回明文，inbound接受明文连接
+	for name, addr := range map[string]string{
+		"outbound": startProxyOutbound(t, upstreamTo(upstreamAddr), proxy.WithMTLS(mtls.ModePermissive, creds)),
+		"inbound":  startProxyInbound(t, upstreamTo(upstreamAddr), proxy.WithMTLS(mtls.ModePermissive, creds)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < 2; i++ {
+				dialEcho(t, addr).Close()
+			}
+		})
+	}
+}
+
+// request 发送数据并读取回显，连接被关闭时返回的数据为空
+func request(t *testing.T, addr, data string) string {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Write([]byte(data))
+	require.NoError(t, err)
+	buf := make([]byte, len(data))
+	n, _ := io.ReadFull(conn, buf)
+	return string(buf[:n])
+}
+
+func TestMTLSMeshCIDRs(t *testing.T) {
+	upstreamAddr, release := startUpstream(t)
+	defer close(release)
+	creds := testCredentials(t)
+	mesh := startProxyOutbound(t, upstreamTo(upstreamAddr), proxy.WithMTLS(mtls.ModeStrict, creds),
+		proxy.WithMeshCIDRs(netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("127.0.0.0/8")))
+	external := startProxyOutbound(t, upstreamTo(upstreamAddr), proxy.WithMTLS(mtls.ModeStrict, creds),
+		proxy.WithMeshCIDRs(netip.MustParsePrefix("10.0.0.0/8")))
+
+	// 上游在mesh内，strict模式下只使用mTLS，不支持mTLS的上游连接失败
+	require.Empty(t, request(t, mesh, "hello"))
+	// mesh之外的上游直接使用明文，不尝试握手
+	failed := metrics.MTLSHandshakes.WithLabelValues("outbound", "failed")
+	before := testutil.ToFloat64(failed)
+	require.Equal(t, "hello", request(t, external, "hello"))
+	require.Equal(t, before, testutil.ToFloat64(failed))
+}
+
+// startStallingTLSUpstream 第一个mTLS握手一直不响应，之后的握手直接关闭连接让outbound退回明文，明文连接原样回显
+func startStallingTLSUpstream(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	release := make(chan struct{})
+	t.Cleanup(func() {
+		close(release)
+		l.Close()
+	})
+	var stalled atomic.Bool
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				first := make([]byte, 1)
+				if _, err := io.ReadFull(conn, first); err != nil {
+					return
+				}
+				if first[0] == 0x16 {
+					if stalled.CompareAndSwap(false, true) {
+						<-release
+					}
+					return
+				}
+				_, _ = conn.Write(first)
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestSlowHandshakeDoesNotBlockEventLoop(t *testing.T) {
+	addr := startProxyOutbound(t,
+		proxy.WithUpstream(proxy.NewUpstream("test", 10*time.Second, proxy.Endpoint{Addr: startStallingTLSUpstream(t)})),
+		proxy.WithMTLS(mtls.ModePermissive, testCredentials(t)),
+	)
+
+	stalled, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer stalled.Close()
+	_, err = stalled.Write([]byte("stalled"))
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	// 握手还在进行时，同一个event-loop上的其它连接仍然可以建立并收发数据，每个event-loop都至少有一个连接
+	for i := range runtime.NumCPU() + 1 {
+		require.Equal(t, fmt.Sprintf("echo-%d", i), request(t, addr, fmt.Sprintf("echo-%d", i)))
+	}
+}
+
+func TestMTLSDownstreamClosesBeforeHandshake(t *testing.T) {
+	upstreamAddr, release := startUpstream(t)
+	defer close(release)
+	p, inbound := serveProxyInbound(t, upstreamTo(upstreamAddr), proxy.WithMTLS(mtls.ModeStrict, testCredentials(t)))
+
+	// 没有发送数据就关闭，以及发送了一部分ClientHello后关闭，都不算mTLS错误
+	conn, err := net.Dial("tcp", inbound)
+	require.NoError(t, err)
+	conn.Close()
+	conn, err = net.Dial("tcp", inbound)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte{0x16, 0x03, 0x01, 0x02, 0x00})
+	require.NoError(t, err)
+	conn.Close()
+
+	require.Eventually(t, func() bool {
+		return p.CloseReasonCounts()[proxy.CloseNormal] >= 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Zero(t, p.CloseReasonCounts()[proxy.CloseMTLSError])
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"syscall"
+)
+
+const (
+	SO_ORIGINAL_DST      = 80
+	IP6T_SO_ORIGINAL_DST = 80
+)
+
+// getOriginDst 获取被iptables REDIRECT之前的原始目的地址，根据socket的地址族选择ipv4或ipv6的查询方式
+func getOriginDst(fd int) (netip.AddrPort, error) {
+	isV6, err := isIPv6Socket(fd)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if isV6 {
+		return getOriginDst6(fd)
+	}
+	return getOriginDst4(fd)
+}
+
+// isIPv6Socket 双栈socket上的ipv4连接(::ffff:a.b.c.d)走的是ipv4的conntrack，仍按ipv4处理
+func isIPv6Socket(fd int) (bool, error) {
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return false, err
+	}
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return false, nil
+	case *syscall.SockaddrInet6:
+		return !netip.AddrFrom16(sa.Addr).Is4In6(), nil
+	default:
+		return false, fmt.Errorf("unsupported socket address type %T", sa)
+	}
+}
+
+func getOriginDst4(fd int) (netip.AddrPort, error) {
+	// 下面的注释来自:https://gist.github.com/fangdingjun/11e5d63abe9284dc0255a574a76bbcb1
+	// Get original destination
+	// this is the only syscall in the Golang libs that I can find that returns 16 bytes
+	// Example result: &{Multiaddr:[2 0 31 144 206 190 36 45 0 0 0 0 0 0 0 0] Interface:0}
+	// port starts at the 3rd byte and is 2 bytes long (31 144 = port 8080)
+	// IPv4 address starts at the 5th byte, 4 bytes long (206 190 36 45)
+	addr, err := syscall.GetsockoptIPv6Mreq(fd, syscall.IPPROTO_IP, SO_ORIGINAL_DST)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	port := binary.BigEndian.Uint16(addr.Multiaddr[2:4])
+	ip := netip.AddrFrom4([4]byte(addr.Multiaddr[4:8]))
+	return netip.AddrPortFrom(ip, port), nil
+}
+
+func getOriginDst6(fd int) (netip.AddrPort, error) {
+	// IP6T_SO_ORIGINAL_DST返回的是sockaddr_in6(28字节)，IPv6Mreq只有20字节放不下，
+	// 这里借用同样以sockaddr_in6开头的IPv6MTUInfo来接收
+	info, err := syscall.GetsockoptIPv6MTUInfo(fd, syscall.IPPROTO_IPV6, IP6T_SO_ORIGINAL_DST)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	// Port字段按网络字节序存放，需要还原成主机字节序
+	var raw [2]byte
+	binary.NativeEndian.PutUint16(raw[:], info.Addr.Port)
+	port := binary.BigEndian.Uint16(raw[:])
+	ip := netip.AddrFrom16(info.Addr.Addr)
+	return netip.AddrPortFrom(ip, port), nil
+}
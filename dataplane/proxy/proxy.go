@@ -1,24 +1,21 @@
 package proxy
 
 import (
-	"context"
-	"encoding/binary"
+	"errors"
 	"fmt"
-	"io"
-	"os"
-	"os/signal"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/SMALL-head/zmesh/dataplane/accesslog"
+	"github.com/SMALL-head/zmesh/dataplane/authz"
+	"github.com/SMALL-head/zmesh/dataplane/metrics"
+	"github.com/SMALL-head/zmesh/dataplane/mtls"
 	"github.com/panjf2000/gnet/v2"
 	"github.com/sirupsen/logrus"
 
 	"net"
-	"syscall"
-)
-
-const (
-	SO_ORIGINAL_DST = 80
 )
 
 type Mode string
@@ -28,11 +25,6 @@ const (
 	SidecarMode Mode = "sidecar"
 )
 
-const (
-	outBoundFileName = "o"
-	inBoundFileName  = "i"
-)
-
 type NoOpLogger struct{}
 
 func (l *NoOpLogger) Debugf(format string, args ...interface{}) {}
@@ -46,9 +38,62 @@ type Proxy struct {
 	Host     string
 	Port     int
 	Protocol string
+	listener string // inbound或outbound，用于日志和指标
 	mode     Mode
 
-	lock sync.Mutex
+	// Option在构造时写入settings，运行期间通过Reload整体替换live
+	settings settings
+	live     atomic.Pointer[settings]
+
+	closeStats closeStats
+	accessLog  *accesslog.Logger
+
+	// 透明代理(TPROXY)模式，见WithTransparent
+	transparent bool
+	tproxyMark  int
+	// 连接上游时设置的SO_MARK，见WithSocketMark
+	socketMark int
+	// sidecar之间的mTLS，见WithMTLS，为nil时不使用
+	mtlsMode       string
+	mtls           *mtls.Credentials
+	meshCIDRs      []netip.Prefix // outbound发起mTLS的目的网段，见WithMeshCIDRs
+	plaintextPeers sync.Map       // permissive模式下不支持mTLS的对端地址 -> 过期时间
+	plaintextSwept atomic.Int64   // 上一次清理plaintextPeers的时间，UnixNano
+
+	// HTTP指标中出现过的path，见pathLabel
+	httpPaths     sync.Map
+	httpPathCount atomic.Int32
+
+	conns    sync.Map // *ConnContext -> struct{}，存活的连接
+	booted   atomic.Bool
+	draining atomic.Bool
+
+	lock    sync.Mutex
+	eng     gnet.Engine // OnBoot时记录，Stop时使用
+	stopped bool
+}
+
+// settings 可以热更新的配置
+type settings struct {
+	upstream *Upstream // 仅proxy模式使用
+
+	// 下游 -> 上游方向写缓冲的高低水位，单位字节
+	highWatermark int
+	lowWatermark  int
+
+	// connectTimeout 连接上游的超时时间，proxy模式下集群自身配置了超时的以集群为准
+	connectTimeout time.Duration
+	// idleTimeout 两个方向都没有数据的时间超过该值后关闭连接，为0时不限制
+	idleTimeout time.Duration
+	// maxConnectionDuration 连接的最长存活时间，为0时不限制
+	maxConnectionDuration time.Duration
+	// sniffTimeout 识别协议时等待下游数据的时间，为0时使用默认值
+	sniffTimeout time.Duration
+	// httpPorts 总是按HTTP/1.1解析的目的端口
+	httpPorts []int
+
+	// authz inbound的授权策略，为nil时不授权
+	authz *authz.Policy
 }
 
 type ProxyOutbound struct {
@@ -78,31 +123,90 @@ func WithMode(mode Mode) Option {
 	}
 }
 
+// WithUpstream 设置proxy模式下转发的上游集群
+func WithUpstream(u *Upstream) Option {
+	return func(p *Proxy) {
+		p.settings.upstream = u
+	}
+}
+
+// WithWatermarks 设置每个连接写往上游的缓冲水位，超过high后暂停读取下游，降到low以下后恢复
+func WithWatermarks(high, low int) Option {
+	return func(p *Proxy) {
+		p.settings.highWatermark = high
+		p.settings.lowWatermark = low
+	}
+}
+
+func WithConnectTimeout(d time.Duration) Option {
+	return func(p *Proxy) {
+		p.settings.connectTimeout = d
+	}
+}
+
+func WithIdleTimeout(d time.Duration) Option {
+	return func(p *Proxy) {
+		p.settings.idleTimeout = d
+	}
+}
+
+func WithMaxConnectionDuration(d time.Duration) Option {
+	return func(p *Proxy) {
+		p.settings.maxConnectionDuration = d
+	}
+}
+
+// WithAccessLog 设置访问日志，每个连接结束时输出一条
+func WithAccessLog(l *accesslog.Logger) Option {
+	return func(p *Proxy) {
+		p.accessLog = l
+	}
+}
+
 func New(opts ...Option) *Proxy {
 	p := &Proxy{}
 	p.EventHandler = &gnet.BuiltinEventEngine{}
 	for _, o := range opts {
 		o(p)
 	}
-
+	s := p.settings
+	p.live.Store(&s)
 	return p
 }
 
+// current 返回当前生效的settings，不可修改
+func (p *Proxy) current() *settings {
+	return p.live.Load()
+}
+
+// Reload 热更新上游、水位和超时配置。只影响之后建立的连接，已有连接按建立时的配置继续转发；
+// 监听地址和模式无法热更新，传入的WithHost、WithPort、WithMode会被忽略
+func (p *Proxy) Reload(opts ...Option) error {
+	scratch := &Proxy{settings: *p.current()}
+	for _, o := range opts {
+		o(scratch)
+	}
+	if p.mode == ProxyMode && scratch.settings.upstream == nil {
+		return fmt.Errorf("no upstream configured for %s mode", ProxyMode)
+	}
+	s := scratch.settings
+	p.live.Store(&s)
+	logrus.Infof("%s listener %s config reloaded", p.listener, p.listenAddr())
+	return nil
+}
+
 func NewProxyOutBound(opts ...Option) *ProxyOutbound {
 	p := New(opts...)
+	p.listener = "outbound"
 	return &ProxyOutbound{Proxy: p}
 }
 
 func NewProxyInBound(opts ...Option) *ProxyInbound {
 	p := New(opts...)
+	p.listener = "inbound"
 	return &ProxyInbound{Proxy: p}
 }
 
-type ConnContext struct {
-	destAddr string
-	conn     net.Conn
-}
-
 func (p *Proxy) listenAddr() string {
 	protocol := p.Protocol
 	if protocol == "" {
@@ -126,25 +230,26 @@ func (p *ProxyOutbound) OnBoot(eng gnet.Engine) (action gnet.Action) {
 			p.mode, ProxyMode, SidecarMode)
 		return gnet.Shutdown
 	}
-
-	// 启动一个协程监听系统信号，优雅关闭
-	go func() {
-		stopCh := make(chan os.Signal, 1)
-		signal.Notify(stopCh, syscall.SIGINT, syscall.SIGTERM)
-		<-stopCh
-		_ = eng.Stop(context.TODO())
-	}()
-
+	if p.mode == ProxyMode && p.current().upstream == nil {
+		logrus.Errorf("no upstream configured for %s mode", ProxyMode)
+		return gnet.Shutdown
+	}
+	if !p.setEngine(eng) {
+		return gnet.Shutdown
+	}
 	return
 }
 
 func (p *ProxyOutbound) OnOpen(c gnet.Conn) (out []byte, action gnet.Action) {
-	logrus.Infof("opening connection on %s", c.RemoteAddr().String())
+	logrus.Debugf("opening connection on %s", c.RemoteAddr().String())
+	if p.Draining() {
+		return rejectDraining(c, "OutBoundOnOpen")
+	}
 	switch p.mode {
 	case SidecarMode:
-		return sidecarModeOpenHandler(c, outBoundFileName)
+		return p.sidecarModeOpenHandler(c)
 	case ProxyMode:
-		return proxyModeOpenHandler(c, "127.0.0.1:8888") // 该模式用作测试，这里直接写死
+		return p.proxyModeOpenHandler(c)
 	default:
 		logrus.Errorf("unsupported mode: %s", p.mode)
 		return nil, gnet.Shutdown
@@ -152,82 +257,12 @@ func (p *ProxyOutbound) OnOpen(c gnet.Conn) (out []byte, action gnet.Action) {
 }
 
 func (p *ProxyOutbound) OnTraffic(c gnet.Conn) (action gnet.Action) {
-	// TODO 至真实服务器中
-	cc := c.Context()
-	connCtx, ok := cc.(ConnContext)
-	if !ok {
-		logrus.Errorf("[OutBoundOnTraffic] - failed to cast ConnContext")
-		return gnet.Close
-	}
-
-	// 按需建立连接
-	// 这里使用function包起来的主要目的是为了lock的作用域
-	// 锁的竞争不会很激烈，因此这里不使用双重校验锁了
-	// connErr := func() gnet.Action {
-	// 	p.lock.Lock()
-	// 	defer p.lock.Unlock()
-	// 	if connCtx.conn == nil {
-	// 		d := &net.Dialer{}
-	// 		conn, err := d.Dial("tcp", connCtx.destAddr)
-	// 		if err != nil {
-	// 			logrus.Errorf("failed to connect to %v: %v", connCtx.destAddr, err)
-	// 			// 远端异常回传给gnet
-	// 			return gnet.Close
-	// 		}
-	// 		connCtx.conn = conn
-
-	// 		// dst -> src 将实际的数据回传给gnet连接
-	// 		go func() {
-	// 			_, err = io.Copy(c, connCtx.conn)
-	// 			if err != nil {
-	// 				logrus.Errorf("failed to copy data from connection to gnet conn: %v", err)
-	// 			} else {
-	// 				logrus.Infoln("Connection closed normally")
-	// 			}
-	// 			logrus.Infof("connection to %s closed", connCtx.destAddr)
-	// 		}()
-	// 		c.SetContext(connCtx)
-	// 	}
-	// 	return gnet.None
-	// }()
-
-	// if connErr == gnet.Close {
-	// 	return gnet.Close
-	// }
-
-	// 将data送到conn里面
-	if connCtx.conn == nil {
-		logrus.Errorf("[OutBoundOnTraffic] - connection to %s is nil, cannot send data", connCtx.destAddr)
-		return gnet.Close
-	}
-	dataSize := c.InboundBuffered()
-	data, err := c.Next(dataSize)
-	if err != nil {
-		logrus.Errorf("[OutBoundOnTraffic] - failed to read data from connection: %v", err)
-		return gnet.Close
-	}
-	_, err = connCtx.conn.Write(data)
-	if err != nil {
-		logrus.Errorf("[OutBoundOnTraffic] - failed to copy data to connection: %v", err)
-		return gnet.Close
-	}
-
-	return
+	return trafficHandler(c, "OutBoundOnTraffic")
 }
 
-func (p *ProxyOutbound) OnClose(c gnet.Conn, _ error) (action gnet.Action) {
-	logrus.Infof("closing connection on %s", c.RemoteAddr().String())
-	cc := c.Context()
-	connCtx, ok := cc.(ConnContext)
-	if !ok {
-		logrus.Errorf("[OutBoundOnClose] - failed to cast ConnContext to ConnContext")
-		return
-	}
-	if connCtx.conn != nil {
-		connCtx.conn.Close()
-	}
-
-	return
+func (p *ProxyOutbound) OnClose(c gnet.Conn, err error) (action gnet.Action) {
+	logrus.Debugf("closing connection on %s", c.RemoteAddr().String())
+	return closeHandler(c, err, "OutBoundOnClose")
 }
 
 func (p *ProxyInbound) OnBoot(eng gnet.Engine) (action gnet.Action) {
@@ -237,25 +272,33 @@ func (p *ProxyInbound) OnBoot(eng gnet.Engine) (action gnet.Action) {
 			p.mode, ProxyMode, SidecarMode)
 		return gnet.Shutdown
 	}
-
-	// 启动一个协程监听系统信号，优雅关闭
-	go func() {
-		stopCh := make(chan os.Signal, 1)
-		signal.Notify(stopCh, syscall.SIGINT, syscall.SIGTERM)
-		<-stopCh
-		_ = eng.Stop(context.TODO())
-	}()
-
+	if p.mode == ProxyMode && p.current().upstream == nil {
+		logrus.Errorf("no upstream configured for %s mode", ProxyMode)
+		return gnet.Shutdown
+	}
+	if p.transparent {
+		if err := setListenerTransparent(eng); err != nil {
+			logrus.Errorf("error enabling transparent mode on %s: %s", p.listenAddr(), err)
+			return gnet.Shutdown
+		}
+		logrus.Infof("inbound server on %s is in transparent mode", p.listenAddr())
+	}
+	if !p.setEngine(eng) {
+		return gnet.Shutdown
+	}
 	return
 }
 
 func (p *ProxyInbound) OnOpen(c gnet.Conn) (out []byte, action gnet.Action) {
-	logrus.Infof("[InBoundOnOpen] - opening connection from %s", c.RemoteAddr().String())
+	logrus.Debugf("[InBoundOnOpen] - opening connection from %s", c.RemoteAddr().String())
+	if p.Draining() {
+		return rejectDraining(c, "InBoundOnOpen")
+	}
 	switch p.mode {
 	case SidecarMode:
-		return sidecarModeOpenHandler(c, inBoundFileName)
+		return p.sidecarModeOpenHandler(c)
 	case ProxyMode:
-		return proxyModeOpenHandler(c, "127.0.0.1:8888")
+		return p.proxyModeOpenHandler(c)
 	default:
 		logrus.Errorf("[InBoundOnOpen] - unsupported mode: %s", p.mode)
 		return nil, gnet.Close
@@ -263,134 +306,195 @@ func (p *ProxyInbound) OnOpen(c gnet.Conn) (out []byte, action gnet.Action) {
 }
 
 func (p *ProxyInbound) OnTraffic(c gnet.Conn) (action gnet.Action) {
-	cc := c.Context()
-	connCtx, ok := cc.(ConnContext)
+	return trafficHandler(c, "InBoundOnTraffic")
+}
+
+func (p *ProxyInbound) OnClose(c gnet.Conn, err error) (action gnet.Action) {
+	logrus.Debugf("[InBoundOnClose] - closing connection from %s", c.RemoteAddr().String())
+	return closeHandler(c, err, "InBoundOnClose")
+}
+
+// trafficHandler 将下游数据交给upstreamWriter，缓冲达到高水位时暂不读取，数据留在gnet的inbound buffer中
+func trafficHandler(c gnet.Conn, tag string) (action gnet.Action) {
+	connCtx, ok := c.Context().(*ConnContext)
 	if !ok {
-		logrus.Errorf("[InBoundOnTraffic] - failed to cast ConnContext")
+		logrus.Errorf("[%s] - failed to cast ConnContext", tag)
 		return gnet.Close
 	}
-	if connCtx.conn == nil {
-		logrus.Errorf("[InBoundOnTraffic] - connection to %s is nil, cannot send data", connCtx.destAddr)
-		return gnet.Close
+	if connCtx.writer.Full() {
+		return
 	}
-	dataSize := c.InboundBuffered()
-	data, err := c.Next(dataSize)
+	connCtx.touch()
+	if connCtx.detecting.Load() && !connCtx.detect(c) {
+		return
+	}
+	data, err := c.Next(c.InboundBuffered())
 	if err != nil {
-		logrus.Errorf("[InBoundOnTraffic] - failed to read data from connection: %v", err)
+		logrus.Errorf("[%s] - failed to read data from connection: %v", tag, err)
 		return gnet.Close
 	}
-
-	_, err = connCtx.conn.Write(data)
-	if err != nil {
-		logrus.Errorf("[InBoundOnTraffic] - failed to copy data to connection: %v", err)
+	if connCtx.tapTraffic {
+		connCtx.tapRequest(data)
+	}
+	if err = connCtx.writer.Write(data); err != nil {
+		logrus.Errorf("[%s] - failed to copy data to connection: %v", tag, err)
 		return gnet.Close
 	}
+	connCtx.metrics.received.Add(float64(len(data)))
+	connCtx.rxBytes.Add(int64(len(data)))
 	return
 }
 
-func getOriginDst(fd int) (originDst string, host string, port uint16, err error) {
-
-	// 下面的注释来自:https://gist.github.com/fangdingjun/11e5d63abe9284dc0255a574a76bbcb1
-	// Get original destination
-	// this is the only syscall in the Golang libs that I can find that returns 16 bytes
-	// Example result: &{Multiaddr:[2 0 31 144 206 190 36 45 0 0 0 0 0 0 0 0] Interface:0}
-	// port starts at the 3rd byte and is 2 bytes long (31 144 = port 8080)
-	// IPv6 version, didn't find a way to detect network family
-	//addr, err := syscall.GetsockoptIPv6Mreq(int(clientConnFile.Fd()), syscall.IPPROTO_IPV6, IP6T_SO_ORIGINAL_DST)
-	// IPv4 address starts at the 5th byte, 4 bytes long (206 190 36 45)
-	var addr *syscall.IPv6Mreq
-	addr, err = syscall.GetsockoptIPv6Mreq(fd, syscall.IPPROTO_IP, SO_ORIGINAL_DST)
-	if err != nil {
-		//logrus.Errorf("[getOriginDst] - error getting SO_ORIGINAL_DST: %s", err)
-		return "", "", 0, err
+// closeHandler err为EOF时表示下游只是半关闭，由ConnContext继续处理另一个方向
+func closeHandler(c gnet.Conn, err error, tag string) (action gnet.Action) {
+	if c.Context() == nil {
+		// OnOpen中连接上游失败或被拒绝，没有设置上下文
+		return
 	}
-
-	port = binary.BigEndian.Uint16(addr.Multiaddr[2:4])
-	host = fmt.Sprintf("%d.%d.%d.%d", addr.Multiaddr[4], addr.Multiaddr[5], addr.Multiaddr[6], addr.Multiaddr[7])
-
-	originDst = fmt.Sprintf("%s:%d", host, port)
-
-	return originDst, host, port, nil
+	connCtx, ok := c.Context().(*ConnContext)
+	if !ok {
+		logrus.Errorf("[%s] - failed to cast ConnContext", tag)
+		return
+	}
+	connCtx.onClose(err)
+	return
 }
 
-// fileName用于表示基于 c gnet.Conn 打开的文件唯一标识
-func sidecarModeOpenHandler(c gnet.Conn, fileName string) (out []byte, action gnet.Action) {
-	rawConnFd := c.Fd()
-	dst, _, _, err := getOriginDst(rawConnFd)
+func (p *Proxy) sidecarModeOpenHandler(c gnet.Conn) (out []byte, action gnet.Action) {
+	dst, err := p.originalDst(c)
 	if err != nil {
 		logrus.Errorf("failed to get origin dst %v", err)
 		return nil, gnet.Close
 	}
-	if dst == "" {
+	if !dst.IsValid() {
 		logrus.Errorf("origin dst is empty")
 		return nil, gnet.Close
 	}
-	logrus.Infof("[OnOpen]: origin dst: %s", dst)
-	// 设置连接上下文d := &net.Dialer{}
+	logrus.Debugf("[OnOpen]: origin dst: %s", dst)
 
-	connCtx := ConnContext{destAddr: dst}
-	d := net.Dialer{
-		Timeout: 5 * time.Second,
-	}
-	conn, err := d.Dial("tcp", connCtx.destAddr)
+	d := p.upstreamDialer(c, p.dialTimeout(0))
+	return p.open(c, dst.String(), d)
+}
+
+func (p *Proxy) proxyModeOpenHandler(c gnet.Conn) (out []byte, action gnet.Action) {
+	u := p.current().upstream
+	d := p.dialer(p.dialTimeout(u.ConnectTimeout))
+	dst, err := u.Pick()
 	if err != nil {
-		logrus.Errorf("failed to connect to %v: %v", connCtx.destAddr, err)
-		// 远端异常回传给gnet
+		reason := p.dialFailed(c, dst, err, time.Now())
+		logrus.Errorf("[OnOpen] - [proxyModeOpenHandler] - failed to pick endpoint of upstream %s: %v, reason: %s", u.Name, err, reason)
 		return nil, gnet.Close
 	}
-	connCtx.conn = conn
-	go func() {
-		// dst -> src 将实际的数据回传给gnet连接
-		fd := c.Fd()
-		f := os.NewFile(uintptr(fd), fileName)
-		if f == nil {
-			logrus.Errorf("failed to create os.File from fd %d", fd)
-			return
+	logrus.Debugf("[OnOpen] - [proxyModeOpenHandler] - upstream %s dst: %s", u.Name, dst)
+	return p.open(c, dst, d)
+}
+
+// open 授权并开始转发，连接上游在event-loop之外进行。授权只需要来源地址和目的端口时在连接上游之前完成；
+// 需要终结mTLS，或者授权需要对端身份、HTTP请求时，连接上游和授权都交给terminator
+func (p *Proxy) open(c gnet.Conn, dst string, d net.Dialer) (out []byte, action gnet.Action) {
+	start := time.Now()
+	policy := p.policy()
+	if policy != nil && !policy.NeedsPrincipal() && !policy.NeedsHTTP() {
+		downstream := c.RemoteAddr().String()
+		if !p.authorize(policy, newAuthzRequest(downstream, dst), downstream, dst) {
+			p.rejected(c, dst, CloseDenied, start, 0)
+			return nil, gnet.Close
 		}
+		policy = nil
+	}
+	dial := func() (net.Conn, error) {
+		conn, err := d.Dial("tcp", dst)
+		if err == nil {
+			conn, err = p.secureUpstream(d, dst, conn)
+		}
+		return conn, err
+	}
 
-		_, err = io.Copy(f, connCtx.conn)
+	if p.needsTerminator(policy) {
+		conn, term, err := p.newTerminator(dial, policy)
 		if err != nil {
-			logrus.Errorf("failed to copy data from connection to gnet conn: %v", err)
-		} else {
-			logrus.Infoln("Connection closed normally")
+			logrus.Errorf("[OnOpen] - failed to prepare terminator for %s: %v", dst, err)
+			return nil, gnet.Close
 		}
-		logrus.Infof("connection to %s closed", connCtx.destAddr)
-		connCtx.conn.Close()
-		connCtx.conn = nil
-	}()
-	c.SetContext(connCtx)
-	return
+		return p.serve(c, dst, conn, term, nil)
+	}
+	return p.serve(c, dst, nil, nil, dial)
 }
 
-func proxyModeOpenHandler(c gnet.Conn, dst string) (out []byte, action gnet.Action) {
-	logrus.Infof("[OnOpen] - [proxyModeOpenHandler] - origin dst: %s", dst)
-	connCtx := ConnContext{destAddr: dst}
-	d := net.Dialer{}
-	conn, err := d.Dial("tcp", connCtx.destAddr)
+// serve 设置连接上下文并开始转发。term不为nil时conn为与它相连的socketpair，由terminator连接上游；
+// 否则在单独的协程中调用dial连接上游，连接建立之前下游的数据先缓存在upstreamWriter中
+func (p *Proxy) serve(c gnet.Conn, dst string, conn net.Conn, term *terminator, dial func() (net.Conn, error)) (out []byte, action gnet.Action) {
+	connCtx, err := newConnContext(p, c, dst)
 	if err != nil {
-		logrus.Errorf("[OnOpen] - [proxyModeOpenHandler] - failed to connect to %v: %v", connCtx.destAddr, err)
+		logrus.Errorf("[OnOpen] - failed to create conn context for %s: %v", dst, err)
+		if conn != nil {
+			_ = conn.Close()
+		}
+		term.close()
 		return nil, gnet.Close
 	}
-
-	connCtx.conn = conn
-	go func() {
-		fd := c.Fd()
-		f := os.NewFile(uintptr(fd), "real-end")
-		if f == nil {
-			logrus.Errorf("[OnOpen] - [proxyModeOpenHandler] - failed to create os.File from fd %d", fd)
-			return
-		}
-		_, err = io.Copy(f, connCtx.conn)
-		if err != nil {
-			logrus.Errorf("[OnOpen] - [proxyModeOpenHandler] - failed to copy data from connection to gnet conn: %v", err)
-		} else {
-			logrus.Infoln("[OnOpen] - [proxyModeOpenHandler] - Connection closed normally")
-		}
-		logrus.Infof("[OnOpen] - [proxyModeOpenHandler] - connection to %s closed", connCtx.destAddr)
-		connCtx.conn.Close()
-		connCtx.conn = nil
-	}()
-
 	c.SetContext(connCtx)
+	connCtx.detecting.Store(term == nil)
+	connCtx.tapTraffic = term == nil
+	if connCtx.cfg.isHTTPPort(dst) {
+		connCtx.startHTTP()
+	}
+	connCtx.start()
+	if term == nil {
+		go connCtx.connect(dial)
+		return
+	}
+	connCtx.attach(conn)
+	term.start(connCtx)
 	return
 }
+
+// dialTimeout 优先使用集群上的超时，其次是listener上的，都没有配置时使用默认值
+func (p *Proxy) dialTimeout(clusterTimeout time.Duration) time.Duration {
+	if clusterTimeout > 0 {
+		return clusterTimeout
+	}
+	if d := p.current().connectTimeout; d > 0 {
+		return d
+	}
+	return defaultConnectTimeout
+}
+
+// dialReason 连接上游失败对应的关闭原因
+func dialReason(err error) CloseReason {
+	var ne net.Error
+	switch {
+	case errors.Is(err, errMTLS):
+		return CloseMTLSError
+	case errors.As(err, &ne) && ne.Timeout():
+		return CloseConnectTimeout
+	default:
+		return CloseConnectError
+	}
+}
+
+func (p *Proxy) observeDialFailure(dst string, reason CloseReason) {
+	metrics.DialFailures.WithLabelValues(p.listener, string(p.mode), dst, string(reason)).Inc()
+}
+
+func (p *Proxy) dialFailed(c gnet.Conn, dst string, err error, dialStart time.Time) CloseReason {
+	reason := dialReason(err)
+	p.observeDialFailure(dst, reason)
+	p.rejected(c, dst, reason, dialStart, time.Since(dialStart))
+	return reason
+}
+
+// rejected 连接在开始转发之前被关闭时，记录关闭原因和访问日志
+func (p *Proxy) rejected(c gnet.Conn, dst string, reason CloseReason, start time.Time, connectTime time.Duration) {
+	p.countClose(reason)
+	p.accessLog.Log(accesslog.Entry{
+		Downstream:  c.RemoteAddr().String(),
+		OriginalDst: dst,
+		Direction:   p.listener,
+		Mode:        string(p.mode),
+		StartTime:   start,
+		Duration:    time.Since(start),
+		ConnectTime: connectTime,
+		Reason:      string(reason),
+	})
+}
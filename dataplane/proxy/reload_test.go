@@ -0,0 +1,56 @@
+package proxy_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/SMALL-head/zmesh/dataplane/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloadKeepsExistingConnections(t *testing.T) {
+	oldAddr, oldRelease := startUpstream(t)
+	defer close(oldRelease)
+	newAddr, newRelease := startUpstream(t)
+	defer close(newRelease)
+
+	p, addr := serveProxyOutbound(t,
+		proxy.WithUpstream(proxy.NewUpstream("old", time.Second, proxy.Endpoint{Addr: oldAddr})),
+	)
+	existing := dialEcho(t, addr)
+	defer existing.Close()
+
+	require.Error(t, p.Reload(proxy.WithUpstream(nil)), "proxy mode requires an upstream")
+	require.NoError(t, p.Reload(
+		proxy.WithUpstream(proxy.NewUpstream("new", time.Second, proxy.Endpoint{Addr: newAddr})),
+		proxy.WithIdleTimeout(200*time.Millisecond),
+	))
+
+	// 新连接使用新的上游和空闲超时
+	fresh := dialEcho(t, addr)
+	defer fresh.Close()
+	require.Eventually(t, func() bool {
+		for _, c := range p.Connections() {
+			if c.Downstream == fresh.LocalAddr().String() {
+				return c.OriginalDst == newAddr
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err := fresh.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	// 已有连接仍然连着旧的上游，不受新的空闲超时影响
+	time.Sleep(300 * time.Millisecond)
+	msg := []byte("still old")
+	_, err = existing.Write(msg)
+	require.NoError(t, err)
+	_, err = io.ReadFull(existing, make([]byte, len(msg)))
+	require.NoError(t, err)
+	for _, c := range p.Connections() {
+		if c.Downstream == existing.LocalAddr().String() {
+			require.Equal(t, oldAddr, c.OriginalDst)
+		}
+	}
+}
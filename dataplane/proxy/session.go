@@ -0,0 +1,587 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/SMALL-head/zmesh/dataplane/accesslog"
+	"github.com/SMALL-head/zmesh/dataplane/http1"
+	"github.com/SMALL-head/zmesh/dataplane/sniff"
+	"github.com/panjf2000/gnet/v2"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultHighWatermark = 1 << 20   // 1MiB
+	defaultLowWatermark  = 256 << 10 // 256KiB
+
+	readBufferSize     = 32 << 10
+	drainCheckInterval = 10 * time.Millisecond
+)
+
+var errWriterClosed = errors.New("upstream writer closed")
+
+// ConnContext 每个下游连接的上下文，以指针形式保存在gnet.Conn的Context中。
+//
+// 两个方向各自独立结束：下游发来FIN时，gnet会直接关闭它持有的fd，
+// 因此这里额外dup一份下游fd，用于在gnet关闭之后继续回传上游的数据，以及向下游单独发送FIN(shutdown SHUT_WR)。
+// 两个方向都结束后才真正关闭上游连接和dup出来的fd
+type ConnContext struct {
+	p              *Proxy
+	cfg            *settings // 连接建立时生效的配置，热更新不影响已有连接
+	c              gnet.Conn
+	downstreamAddr string
+	destAddr       string
+	conn           net.Conn // 上游连接，attach之前为nil
+	downstream     *os.File // dup出来的下游fd，由ConnContext自己负责关闭
+	writer         *upstreamWriter
+	metrics        connMetrics
+	rxBytes        atomic.Int64
+	txBytes        atomic.Int64
+
+	// 上游 -> 下游方向同样受高低水位限制，指的是gnet中下游连接的outbound buffer
+	high, low int
+
+	startTime    time.Time     // 下游连接建立的时间，包含连接上游的耗时
+	connectTime  time.Duration // 连接上游的耗时，连接上游之后在lock下更新
+	lastActive   atomic.Int64  // 最近一次任一方向有数据的时间(UnixNano)
+	idleTimer    *time.Timer
+	maxDurTimer  *time.Timer
+	closeReason  CloseReason
+	reasonLocker sync.Mutex
+
+	// 协议识别：没有terminator时在OnTraffic中识别，识别完成之前下游的数据留在gnet中；
+	// 有terminator时由terminator在连接应用之前识别
+	detecting  atomic.Bool
+	protocol   sniff.Result // 在lock下读写
+	sniffTimer *time.Timer
+	// HTTP/1.1解析，见http.go。tapTraffic为true时在OnTraffic和pipeToDownstream中解析，否则由terminator解析
+	http       atomic.Pointer[http1.Codec]
+	tapTraffic bool
+
+	lock        sync.Mutex
+	finished    int  // 已经转发完FIN的方向数
+	released    bool // release之后不再attach上游连接
+	gnetClosed  chan struct{}
+	aborted     chan struct{}
+	gnetOnce    sync.Once
+	abortOnce   sync.Once
+	releaseOnce sync.Once
+}
+
+// newConnContext 上游连接在attach时传入，在此之前下游的数据缓存在upstreamWriter中
+func newConnContext(p *Proxy, c gnet.Conn, destAddr string) (*ConnContext, error) {
+	fd, err := c.Dup()
+	if err != nil {
+		return nil, err
+	}
+	cc := &ConnContext{
+		p:              p,
+		cfg:            p.current(),
+		c:              c,
+		downstreamAddr: c.RemoteAddr().String(),
+		startTime:      time.Now(),
+		destAddr:       destAddr,
+		downstream:     os.NewFile(uintptr(fd), "downstream"),
+		gnetClosed:     make(chan struct{}),
+		aborted:        make(chan struct{}),
+	}
+	cc.writer = newUpstreamWriter(c, cc.cfg.highWatermark, cc.cfg.lowWatermark, cc.finish, func() {
+		cc.abort(CloseUpstreamError)
+	})
+	cc.high, cc.low = cc.writer.high, cc.writer.low
+	return cc, nil
+}
+
+// start 开始接收下游数据并启动超时检查，需要在c.SetContext之后调用，上游连接建立之后再调用attach
+func (cc *ConnContext) start() {
+	cc.metrics = cc.p.connOpened(cc.destAddr)
+	cc.p.trackConn(cc)
+	cc.touch()
+	cc.lock.Lock()
+	if d := cc.cfg.idleTimeout; d > 0 {
+		cc.idleTimer = time.AfterFunc(d, cc.checkIdle)
+	}
+	if d := cc.cfg.maxConnectionDuration; d > 0 {
+		cc.maxDurTimer = time.AfterFunc(d, func() {
+			logrus.Infof("[ConnContext] - connection to %s reached max duration %s", cc.destAddr, d)
+			cc.abort(CloseMaxDuration)
+		})
+	}
+	if cc.detecting.Load() {
+		cc.sniffTimer = time.AfterFunc(cc.cfg.detectTimeout(), func() {
+			if cc.stopDetecting("timed out") {
+				_ = cc.c.Wake(nil)
+			}
+		})
+	}
+	cc.lock.Unlock()
+}
+
+// attach 上游连接建立之后启动两个方向的转发协程。连接已经释放时返回false，由调用方关闭conn
+func (cc *ConnContext) attach(conn net.Conn) bool {
+	cc.lock.Lock()
+	if cc.released {
+		cc.lock.Unlock()
+		return false
+	}
+	cc.conn = conn
+	cc.writer.conn = conn
+	cc.lock.Unlock()
+	go cc.writer.run()
+	go cc.pipeToDownstream()
+	return true
+}
+
+// connect 在单独的协程中连接上游，不阻塞event-loop，失败时中止连接
+func (cc *ConnContext) connect(dial func() (net.Conn, error)) {
+	start := time.Now()
+	conn, err := dial()
+	if err != nil {
+		reason := dialReason(err)
+		cc.p.observeDialFailure(cc.destAddr, reason)
+		logrus.Errorf("[ConnContext] - failed to connect to %s: %v, reason: %s", cc.destAddr, err, reason)
+		cc.abort(reason)
+		return
+	}
+	connectTime := time.Since(start)
+	cc.p.observeDial(cc.destAddr, connectTime)
+	cc.setConnectTime(connectTime)
+	if !cc.attach(conn) {
+		// 连接上游期间下游已经关闭
+		_ = conn.Close()
+	}
+}
+
+// setConnectTime 连接上游之后记录耗时
+func (cc *ConnContext) setConnectTime(d time.Duration) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	cc.connectTime = d
+}
+
+// touch 记录一次数据活动，用于空闲超时判断
+func (cc *ConnContext) touch() {
+	cc.lastActive.Store(time.Now().UnixNano())
+}
+
+func (cc *ConnContext) checkIdle() {
+	idle := time.Since(time.Unix(0, cc.lastActive.Load()))
+	if remain := cc.cfg.idleTimeout - idle; remain > 0 {
+		cc.lock.Lock()
+		cc.idleTimer.Reset(remain)
+		cc.lock.Unlock()
+		return
+	}
+	logrus.Infof("[ConnContext] - connection to %s idle for %s, closing", cc.destAddr, idle)
+	cc.abort(CloseIdleTimeout)
+}
+
+// setReason 记录关闭原因，以最先发生的为准
+func (cc *ConnContext) setReason(reason CloseReason) {
+	cc.reasonLocker.Lock()
+	defer cc.reasonLocker.Unlock()
+	if cc.closeReason == "" {
+		cc.closeReason = reason
+	}
+}
+
+// onClose 在OnClose中调用。err为EOF说明下游只是关闭了写端，
+// 把已缓冲的数据写完后向上游转发FIN，其余情况直接中止整个连接
+func (cc *ConnContext) onClose(err error) {
+	cc.gnetOnce.Do(func() { close(cc.gnetClosed) })
+	if errors.Is(err, io.EOF) {
+		cc.flush()
+		cc.writer.CloseWrite()
+		return
+	}
+	if err != nil {
+		cc.abort(CloseDownstreamReset)
+		return
+	}
+	cc.abort(CloseLocal)
+}
+
+// flush 下游关闭写端时，把等待识别协议或者背压暂停期间留在gnet中的数据交给upstreamWriter
+func (cc *ConnContext) flush() {
+	if cc.detecting.Load() && !cc.detect(cc.c) {
+		cc.stopDetecting("downstream closed")
+	}
+	n := cc.c.InboundBuffered()
+	if n == 0 {
+		return
+	}
+	data, err := cc.c.Next(n)
+	if err == nil {
+		if cc.tapTraffic {
+			cc.tapRequest(data)
+		}
+		err = cc.writer.Write(data)
+	}
+	if err != nil {
+		logrus.Errorf("[ConnContext] - failed to flush data from %s: %v", cc.downstreamAddr, err)
+		return
+	}
+	cc.metrics.received.Add(float64(n))
+	cc.rxBytes.Add(int64(n))
+}
+
+// abort 立即关闭两端，不再等待缓冲中的数据
+func (cc *ConnContext) abort(reason CloseReason) {
+	cc.setReason(reason)
+	cc.abortOnce.Do(func() {
+		close(cc.aborted)
+		cc.writer.abort()
+		cc.release()
+		_ = cc.c.Close()
+	})
+}
+
+// finish 某个方向已经转发完FIN，两个方向都结束后释放连接
+func (cc *ConnContext) finish() {
+	cc.lock.Lock()
+	cc.finished++
+	done := cc.finished == 2
+	cc.lock.Unlock()
+	if done {
+		cc.setReason(CloseNormal)
+		cc.release()
+		_ = cc.c.Close()
+	}
+}
+
+func (cc *ConnContext) release() {
+	cc.releaseOnce.Do(func() {
+		cc.lock.Lock()
+		if cc.idleTimer != nil {
+			cc.idleTimer.Stop()
+		}
+		if cc.maxDurTimer != nil {
+			cc.maxDurTimer.Stop()
+		}
+		if cc.sniffTimer != nil {
+			cc.sniffTimer.Stop()
+		}
+		connectTime, protocol, conn := cc.connectTime, cc.protocol, cc.conn
+		cc.released = true
+		cc.lock.Unlock()
+		if conn != nil {
+			_ = conn.Close()
+		}
+		_ = cc.downstream.Close()
+
+		if codec := cc.http.Load(); codec != nil {
+			codec.Close()
+		}
+
+		cc.reasonLocker.Lock()
+		reason := cc.closeReason
+		cc.reasonLocker.Unlock()
+		cc.p.untrackConn(cc)
+		cc.p.connClosed(reason)
+		duration := time.Since(cc.startTime)
+		logrus.Debugf("[ConnContext] - connection to %s released after %s, reason: %s",
+			cc.destAddr, duration.Truncate(time.Millisecond), reason)
+		cc.p.accessLog.Log(accesslog.Entry{
+			Downstream:    cc.downstreamAddr,
+			OriginalDst:   cc.destAddr,
+			Direction:     cc.p.listener,
+			Mode:          string(cc.p.mode),
+			StartTime:     cc.startTime,
+			Duration:      duration,
+			BytesReceived: cc.rxBytes.Load(),
+			BytesSent:     cc.txBytes.Load(),
+			ConnectTime:   connectTime,
+			Reason:        string(reason),
+			Protocol:      string(protocol.Protocol),
+			SNI:           protocol.SNI,
+		})
+	})
+}
+
+// pipeToDownstream 上游 -> 下游方向。
+// gnet未关闭时数据只通过gnet.Conn.AsyncWrite交给event-loop写出，不直接操作gnet持有的fd，
+// 每次写入都要等待回调确认，下游outbound buffer超过高水位时等待其降到低水位以下再继续读上游
+func (cc *ConnContext) pipeToDownstream() {
+	buf := make([]byte, readBufferSize)
+	for {
+		n, err := cc.conn.Read(buf)
+		if n > 0 {
+			cc.touch()
+			if cc.stopDetecting("upstream sent data first") {
+				_ = cc.c.Wake(nil)
+			}
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			if cc.tapTraffic {
+				cc.tapResponse(data)
+			}
+			if werr := cc.writeDownstream(data); werr != nil {
+				cc.abortOnError("failed to write data to downstream", werr, CloseDownstreamError)
+				return
+			}
+			cc.metrics.sent.Add(float64(n))
+			cc.txBytes.Add(int64(n))
+		}
+		if err == io.EOF {
+			// 上游关闭了写端，等数据全部写出后向下游转发FIN
+			if serr := cc.shutdownDownstream(); serr != nil {
+				cc.abortOnError("failed to shutdown downstream", serr, CloseDownstreamError)
+				return
+			}
+			logrus.Debugf("[pipeToDownstream] - connection to %s half closed", cc.destAddr)
+			cc.finish()
+			return
+		}
+		if err != nil {
+			cc.abortOnError("failed to read data from upstream", err, CloseUpstreamError)
+			return
+		}
+	}
+}
+
+func (cc *ConnContext) abortOnError(msg string, err error, reason CloseReason) {
+	select {
+	case <-cc.aborted:
+	default:
+		logrus.Errorf("[pipeToDownstream] - %s %s: %v", msg, cc.destAddr, err)
+		cc.abort(reason)
+	}
+}
+
+func (cc *ConnContext) writeDownstream(data []byte) error {
+	select {
+	case <-cc.gnetClosed:
+		_, err := cc.downstream.Write(data)
+		return err
+	default:
+	}
+
+	ack := make(chan error, 1)
+	err := cc.c.AsyncWrite(data, func(c gnet.Conn, err error) error {
+		if err != nil || c.OutboundBuffered() <= cc.high {
+			ack <- err
+			return nil
+		}
+		cc.waitDrained(cc.low, ack)
+		return nil
+	})
+	if err == nil {
+		select {
+		case err = <-ack:
+		case <-cc.aborted:
+			return net.ErrClosed
+		}
+	}
+	if errors.Is(err, net.ErrClosed) {
+		// gnet在这次写入之前就已经关闭(下游半关闭)，改走dup的fd
+		select {
+		case <-cc.gnetClosed:
+			_, err = cc.downstream.Write(data)
+		case <-cc.aborted:
+		}
+	}
+	return err
+}
+
+// shutdownDownstream 向下游发送FIN，需要先等gnet outbound buffer中的数据全部写出
+func (cc *ConnContext) shutdownDownstream() error {
+	select {
+	case <-cc.gnetClosed:
+	default:
+		ack := make(chan error, 1)
+		cc.waitDrained(0, ack)
+		select {
+		case err := <-ack:
+			if err != nil {
+				return err
+			}
+		case <-cc.aborted:
+			return net.ErrClosed
+		}
+	}
+
+	rc, err := cc.downstream.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err = rc.Control(func(fd uintptr) {
+		serr = syscall.Shutdown(int(fd), syscall.SHUT_WR)
+	}); err != nil {
+		return err
+	}
+	if errors.Is(serr, syscall.ENOTCONN) {
+		// 下游已经彻底断开，无需再发送FIN
+		return nil
+	}
+	return serr
+}
+
+// waitDrained 在event-loop上检查下游的outbound buffer，降到threshold以下后确认，否则定时重试
+func (cc *ConnContext) waitDrained(threshold int, ack chan<- error) {
+	err := cc.c.EventLoop().Execute(context.Background(), gnet.RunnableFunc(func(context.Context) error {
+		if cc.c.Context() != cc {
+			// 连接已经被gnet释放，剩余数据已在关闭时尽量写出
+			ack <- nil
+			return nil
+		}
+		if cc.c.OutboundBuffered() <= threshold {
+			ack <- nil
+			return nil
+		}
+		time.AfterFunc(drainCheckInterval, func() { cc.waitDrained(threshold, ack) })
+		return nil
+	}))
+	if err != nil {
+		ack <- err
+	}
+}
+
+// upstreamWriter 下游 -> 上游方向的写协程。
+// OnTraffic运行在gnet的event-loop上，不能直接调用阻塞的net.Conn.Write，
+// 因此数据先拷贝到这里的缓冲中，由单独的协程写给上游，写协程在上游连接建立之后才启动。
+// 缓冲超过高水位时OnTraffic不再从gnet.Conn中取数据，等写协程将缓冲降到低水位以下后再通过Wake恢复读取
+type upstreamWriter struct {
+	c       gnet.Conn
+	conn    net.Conn // attach时设置，之后才启动run
+	high    int
+	low     int
+	onDone  func() // 向上游转发FIN之后调用
+	onError func() // 写上游失败时调用
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	bufs    net.Buffers
+	pending int
+	paused  bool
+	eof     bool // 下游不会再有数据
+	aborted bool
+	err     error
+}
+
+func newUpstreamWriter(c gnet.Conn, high, low int, onDone, onError func()) *upstreamWriter {
+	if high <= 0 {
+		high = defaultHighWatermark
+	}
+	if low <= 0 || low > high {
+		low = min(defaultLowWatermark, high/2)
+	}
+	w := &upstreamWriter{c: c, high: high, low: low, onDone: onDone, onError: onError}
+	w.cond = sync.NewCond(&w.lock)
+	return w
+}
+
+// Full 缓冲是否已达到高水位，达到时标记为暂停，等待写协程唤醒
+func (w *upstreamWriter) Full() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.pending >= w.high {
+		w.paused = true
+	}
+	return w.paused
+}
+
+// Write 拷贝data并交给写协程，data来自gnet的Next，不能跨协程持有
+func (w *upstreamWriter) Write(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	buf := make([]byte, len(data))
+	copy(buf, data)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	if w.eof || w.aborted {
+		return errWriterClosed
+	}
+	w.bufs = append(w.bufs, buf)
+	w.pending += len(buf)
+	w.cond.Signal()
+	return nil
+}
+
+func (w *upstreamWriter) run() {
+	for {
+		w.lock.Lock()
+		for len(w.bufs) == 0 && !w.eof && !w.aborted {
+			w.cond.Wait()
+		}
+		if w.aborted {
+			w.lock.Unlock()
+			return
+		}
+		if len(w.bufs) == 0 && w.eof {
+			w.lock.Unlock()
+			w.closeWrite()
+			return
+		}
+		bufs := w.bufs
+		w.bufs = nil
+		w.lock.Unlock()
+
+		n, err := bufs.WriteTo(w.conn)
+
+		w.lock.Lock()
+		w.pending -= int(n)
+		if err != nil {
+			w.err = err
+			aborted := w.aborted
+			w.lock.Unlock()
+			if !aborted {
+				logrus.Errorf("[upstreamWriter] - failed to write data to upstream %s: %v", w.conn.RemoteAddr(), err)
+				w.onError()
+			}
+			return
+		}
+		resume := w.paused && w.pending <= w.low
+		if resume {
+			w.paused = false
+		}
+		w.lock.Unlock()
+
+		if resume {
+			// 触发一次OnTraffic，把暂停期间堆积在gnet中的数据取出来
+			_ = w.c.Wake(nil)
+		}
+	}
+}
+
+// closeWrite 只关闭上游连接的写端，上游仍可继续回传数据
+func (w *upstreamWriter) closeWrite() {
+	if cw, ok := w.conn.(interface{ CloseWrite() error }); ok {
+		if err := cw.CloseWrite(); err != nil {
+			logrus.Errorf("[upstreamWriter] - failed to close write half of %s: %v", w.conn.RemoteAddr(), err)
+		}
+	} else {
+		_ = w.conn.Close()
+	}
+	w.onDone()
+}
+
+// CloseWrite 下游已发送FIN，已缓冲的数据写完后向上游转发FIN
+func (w *upstreamWriter) CloseWrite() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.eof = true
+	w.cond.Signal()
+}
+
+// abort 丢弃缓冲中的数据并让写协程退出
+func (w *upstreamWriter) abort() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.aborted = true
+	w.bufs = nil
+	w.cond.Signal()
+}
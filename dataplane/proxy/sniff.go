@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/SMALL-head/zmesh/dataplane/metrics"
+	"github.com/SMALL-head/zmesh/dataplane/sniff"
+	"github.com/panjf2000/gnet/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultSniffTimeout 等待下游发来足够识别协议的数据的默认时间，超时的按unknown处理(如服务端先发送数据的协议)
+const defaultSniffTimeout = 100 * time.Millisecond
+
+// WithSniffTimeout 设置识别协议时等待下游数据的时间，为0时使用默认值
+func WithSniffTimeout(d time.Duration) Option {
+	return func(p *Proxy) {
+		p.settings.sniffTimeout = d
+	}
+}
+
+func (s *settings) detectTimeout() time.Duration {
+	if s.sniffTimeout > 0 {
+		return s.sniffTimeout
+	}
+	return defaultSniffTimeout
+}
+
+// detect 在OnTraffic中识别协议。数据不足时返回false，数据留在gnet的inbound buffer中，
+// 等下一次OnTraffic、超时或者上游先发来数据后再转发
+func (cc *ConnContext) detect(c gnet.Conn) bool {
+	b, _ := c.Peek(0)
+	res, ok := sniff.Detect(b)
+	if !ok {
+		return false
+	}
+	cc.setProtocol(res)
+	return true
+}
+
+// stopDetecting 超时、上游先发来数据或者下游关闭写端时不再等待，按已经收到的数据识别，
+// 返回true时调用方需要唤醒OnTraffic转发留在gnet中的数据
+func (cc *ConnContext) stopDetecting(why string) bool {
+	if !cc.detecting.Load() {
+		return false
+	}
+	logrus.Debugf("[ConnContext] - stop detecting protocol of connection from %s: %s", cc.downstreamAddr, why)
+	cc.setProtocol(sniff.Result{Protocol: sniff.Unknown})
+	return true
+}
+
+// setProtocol 记录识别出的协议，只有第一次生效
+func (cc *ConnContext) setProtocol(res sniff.Result) {
+	cc.lock.Lock()
+	if cc.protocol.Protocol != "" {
+		cc.lock.Unlock()
+		return
+	}
+	cc.protocol = res
+	if cc.sniffTimer != nil {
+		cc.sniffTimer.Stop()
+	}
+	cc.lock.Unlock()
+	if res.Protocol == sniff.HTTP1 {
+		cc.startHTTP()
+	}
+	cc.detecting.Store(false)
+
+	metrics.ProtocolDetections.WithLabelValues(cc.p.listener, string(cc.p.mode), string(res.Protocol)).Inc()
+	if res.SNI != "" {
+		logrus.Debugf("[ConnContext] - connection from %s to %s detected as %s, sni: %s", cc.downstreamAddr, cc.destAddr, res.Protocol, res.SNI)
+	} else {
+		logrus.Debugf("[ConnContext] - connection from %s to %s detected as %s", cc.downstreamAddr, cc.destAddr, res.Protocol)
+	}
+}
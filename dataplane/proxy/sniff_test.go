@@ -0,0 +1,171 @@
+package proxy_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/SMALL-head/zmesh/dataplane/accesslog"
+	"github.com/SMALL-head/zmesh/dataplane/metrics"
+	"github.com/SMALL-head/zmesh/dataplane/mtls"
+	"github.com/SMALL-head/zmesh/dataplane/proxy"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// recordClientHello 录下客户端发出的ClientHello
+func recordClientHello(t *testing.T, serverName string) []byte {
+	c, s := net.Pipe()
+	defer s.Close()
+	go func() {
+		_ = tls.Client(c, &tls.Config{ServerName: serverName}).Handshake()
+		c.Close()
+	}()
+	buf := make([]byte, 16<<10)
+	n, err := s.Read(buf)
+	require.NoError(t, err)
+	return buf[:n]
+}
+
+// startGreetingUpstream 先发送问候，之后原样回显的上游
+func startGreetingUpstream(t *testing.T, greeting string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = conn.Write([]byte(greeting))
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestProtocolDetection(t *testing.T) {
+	var buf syncBuffer
+	al, err := accesslog.NewWithWriter(accesslog.FormatJSON, &buf)
+	require.NoError(t, err)
+	upstreamAddr, _ := startCountingUpstream(t)
+	outbound := startProxyOutbound(t, upstreamTo(upstreamAddr), proxy.WithAccessLog(al), proxy.WithSniffTimeout(50*time.Millisecond))
+	http1 := metrics.ProtocolDetections.WithLabelValues("outbound", string(proxy.ProxyMode), "http1")
+	before := testutil.ToFloat64(http1)
+
+	for _, c := range []struct {
+		name     string
+		data     string
+		protocol string
+		sni      string
+	}{
+		{"http1", "GET /reviews HTTP/1.1\r\nHost: reviews\r\n\r\n", "http1", ""},
+		{"http2", "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", "http2", ""},
+		{"tls", string(recordClientHello(t, "reviews.default")), "tls", "reviews.default"},
+		// 数据不足以识别，超时之后照常转发
+		{"timeout", "GE", "unknown", ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", outbound)
+			require.NoError(t, err)
+			require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+			downstream := conn.LocalAddr().String()
+			_, err = conn.Write([]byte(c.data))
+			require.NoError(t, err)
+			echo := make([]byte, len(c.data))
+			_, err = io.ReadFull(conn, echo)
+			require.NoError(t, err)
+			require.Equal(t, c.data, string(echo))
+			conn.Close()
+
+			require.Eventually(t, func() bool {
+				entries := buf.entries(func(m map[string]any) bool { return m["downstream"] == downstream })
+				return len(entries) == 1 && entries[0]["protocol"] == c.protocol && entries[0]["sni"] == c.sni
+			}, 5*time.Second, 10*time.Millisecond)
+		})
+	}
+	require.Equal(t, before+1, testutil.ToFloat64(http1))
+}
+
+func TestProtocolDetectionDoesNotHoldData(t *testing.T) {
+	// 上游先发送数据，或者下游关闭写端时，不再等待超时
+	outbound := startProxyOutbound(t, upstreamTo(startGreetingUpstream(t, "220 ready\r\n")), proxy.WithSniffTimeout(time.Minute))
+	conn, err := net.Dial("tcp", outbound)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	greeting := make([]byte, len("220 ready\r\n"))
+	_, err = io.ReadFull(conn, greeting)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("GE"))
+	require.NoError(t, err)
+	echo := make([]byte, 2)
+	_, err = io.ReadFull(conn, echo)
+	require.NoError(t, err)
+	require.Equal(t, "GE", string(echo))
+
+	upstreamAddr, _ := startCountingUpstream(t)
+	outbound = startProxyOutbound(t, upstreamTo(upstreamAddr), proxy.WithSniffTimeout(time.Minute))
+	conn, err = net.Dial("tcp", outbound)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Write([]byte("GE"))
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "GE", string(data))
+}
+
+func TestProtocolDetectionBehindTerminator(t *testing.T) {
+	// 终结mTLS时不等待识别就连接应用，服务端先发送数据的协议不会等到超时
+	creds := testCredentials(t)
+	_, inbound := serveProxyInbound(t, upstreamTo(startGreetingUpstream(t, "220 ready\r\n")),
+		proxy.WithMTLS(mtls.ModePermissive, creds), proxy.WithSniffTimeout(time.Minute))
+	conn, err := net.Dial("tcp", inbound)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	greeting := make([]byte, len("220 ready\r\n"))
+	_, err = io.ReadFull(conn, greeting)
+	require.NoError(t, err)
+	require.Equal(t, "220 ready\r\n", string(greeting))
+
+	// 边转发边识别，识别出HTTP之后已经转发的数据也会被解析
+	var buf syncBuffer
+	al, err := accesslog.NewWithWriter(accesslog.FormatJSON, &buf)
+	require.NoError(t, err)
+	_, inbound = serveProxyInbound(t, upstreamTo(startHTTPUpstream(t)),
+		proxy.WithMTLS(mtls.ModePermissive, creds), proxy.WithAccessLog(al), proxy.WithSniffTimeout(time.Minute))
+	outbound := startProxyOutbound(t, upstreamTo(inbound), proxy.WithMTLS(mtls.ModePermissive, creds))
+	conn, err = net.Dial("tcp", outbound)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Write([]byte("GET /re"))
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	_, err = conn.Write([]byte("views HTTP/1.1\r\nHost: reviews\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Eventually(t, func() bool {
+		for _, e := range buf.entries(func(m map[string]any) bool { return m["msg"] == "request" }) {
+			if e["path"] == "/reviews" && e["status"] == float64(200) {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SMALL-head/zmesh/dataplane/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CloseReason 连接被关闭的原因
+type CloseReason string
+
+const (
+	CloseNormal          CloseReason = "normal"           // 两个方向都正常转发完FIN
+	CloseDownstreamReset CloseReason = "downstream_reset" // 下游异常断开
+	CloseDownstreamError CloseReason = "downstream_error" // 写下游失败
+	CloseUpstreamError   CloseReason = "upstream_error"   // 读写上游失败
+	CloseConnectError    CloseReason = "connect_error"    // 连接上游失败
+	CloseConnectTimeout  CloseReason = "connect_timeout"  // 连接上游超时
+	CloseIdleTimeout     CloseReason = "idle_timeout"
+	CloseMaxDuration     CloseReason = "max_duration"
+	CloseLocal           CloseReason = "local_close" // 由本地主动关闭，例如engine停止
+	CloseMTLSError       CloseReason = "mtls_error"  // mTLS握手失败，或strict模式下拒绝明文连接
+	CloseDenied          CloseReason = "denied"      // 被授权策略拒绝
+)
+
+// closeStats 按关闭原因统计连接数
+type closeStats struct {
+	counters sync.Map // CloseReason -> *atomic.Int64
+}
+
+func (s *closeStats) inc(reason CloseReason) {
+	v, _ := s.counters.LoadOrStore(reason, &atomic.Int64{})
+	v.(*atomic.Int64).Add(1)
+}
+
+func (s *closeStats) snapshot() map[CloseReason]int64 {
+	m := make(map[CloseReason]int64)
+	s.counters.Range(func(k, v any) bool {
+		m[k.(CloseReason)] = v.(*atomic.Int64).Load()
+		return true
+	})
+	return m
+}
+
+// CloseReasonCounts 返回当前listener按关闭原因统计的连接数
+func (p *Proxy) CloseReasonCounts() map[CloseReason]int64 {
+	return p.closeStats.snapshot()
+}
+
+// connMetrics 连接建立时取好带label的指标，避免在数据路径上反复查找
+type connMetrics struct {
+	received prometheus.Counter
+	sent     prometheus.Counter
+}
+
+func (p *Proxy) observeDial(dst string, d time.Duration) {
+	metrics.DialLatency.WithLabelValues(p.listener, string(p.mode), dst).Observe(d.Seconds())
+}
+
+// connOpened 下游连接开始转发时调用，此时上游还没有连接，之后连接上游失败的连接同样计入
+func (p *Proxy) connOpened(dst string) connMetrics {
+	metrics.TotalConnections.WithLabelValues(p.listener, string(p.mode), dst).Inc()
+	metrics.ActiveConnections.WithLabelValues(p.listener, string(p.mode)).Inc()
+	return connMetrics{
+		received: metrics.BytesReceived.WithLabelValues(p.listener, string(p.mode), dst),
+		sent:     metrics.BytesSent.WithLabelValues(p.listener, string(p.mode), dst),
+	}
+}
+
+// connClosed 连接释放时调用
+func (p *Proxy) connClosed(reason CloseReason) {
+	metrics.ActiveConnections.WithLabelValues(p.listener, string(p.mode)).Dec()
+	p.countClose(reason)
+}
+
+func (p *Proxy) countClose(reason CloseReason) {
+	p.closeStats.inc(reason)
+	metrics.ClosedConnections.WithLabelValues(p.listener, string(p.mode), string(reason)).Inc()
+}
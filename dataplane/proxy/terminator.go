@@ -0,0 +1,340 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/SMALL-head/zmesh/dataplane/authz"
+	"github.com/SMALL-head/zmesh/dataplane/http1"
+	"github.com/SMALL-head/zmesh/dataplane/sniff"
+	"github.com/sirupsen/logrus"
+)
+
+// requestLineTimeout 需要按HTTP请求授权时等待第一个完整请求行的时间，超时的连接被拒绝
+const requestLineTimeout = 10 * time.Second
+
+// terminator inbound需要先看到下游的数据才能连接应用时使用：终结mTLS，以及按对端身份或HTTP请求授权，
+// 协议识别也在这里对去掉mTLS之后的数据进行。
+// ConnContext仍然把下游的原始字节写给一个socketpair，另一端在这里完成识别和授权之后再连接应用并互相转发，
+// 因此背压、半关闭和统计都沿用ConnContext的逻辑
+type terminator struct {
+	p      *Proxy
+	raw    *net.UnixConn // socketpair中由terminator读写的一端
+	dial   func() (net.Conn, error)
+	policy *authz.Policy // 需要在这里授权时不为nil
+}
+
+// needsTerminator inbound终结mTLS，或者授权需要对端身份、HTTP请求时，连接应用要等到看到下游的数据之后
+func (p *Proxy) needsTerminator(policy *authz.Policy) bool {
+	if p.listener != "inbound" {
+		return false
+	}
+	return p.mtls != nil || (policy != nil && (policy.NeedsPrincipal() || policy.NeedsHTTP()))
+}
+
+// newTerminator 返回交给ConnContext的socketpair一端以及terminator，terminator需要在ConnContext启动后调用start
+func (p *Proxy) newTerminator(dial func() (net.Conn, error), policy *authz.Policy) (net.Conn, *terminator, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	conns := make([]*net.UnixConn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "terminator")
+		c, err := net.FileConn(f)
+		_ = f.Close()
+		if err != nil {
+			for _, c := range conns {
+				if c != nil {
+					_ = c.Close()
+				}
+			}
+			if i == 0 {
+				_ = syscall.Close(fds[1])
+			}
+			return nil, nil, err
+		}
+		conns[i] = c.(*net.UnixConn)
+	}
+	return conns[0], &terminator{p: p, raw: conns[1], dial: dial, policy: policy}, nil
+}
+
+func (t *terminator) start(cc *ConnContext) {
+	if t != nil {
+		go t.run(cc)
+	}
+}
+
+// close ConnContext没有启动时释放terminator持有的连接
+func (t *terminator) close() {
+	if t != nil {
+		_ = t.raw.Close()
+	}
+}
+
+func (t *terminator) run(cc *ConnContext) {
+	down, peer, err := t.accept(cc.destAddr)
+	if err != nil {
+		reason := acceptReason(err)
+		if reason == CloseMTLSError {
+			logrus.Errorf("[terminator] - rejecting connection from %s: %s", cc.downstreamAddr, err)
+		} else {
+			// 握手或识别完成之前下游就已经关闭
+			logrus.Debugf("[terminator] - connection from %s closed before detection: %s", cc.downstreamAddr, err)
+		}
+		t.close()
+		cc.abort(reason)
+		return
+	}
+	var req authz.Request
+	needsHTTP := false
+	if t.policy != nil {
+		req = newAuthzRequest(cc.downstreamAddr, cc.destAddr)
+		req.Principal = peer
+		needsHTTP = t.policy.NeedsHTTPFor(req)
+	}
+	if needsHTTP {
+		// 有HTTP条件的规则可能命中时不能在识别超时后按TCP授权，一直等到第一个请求行完整，
+		// 超时或者不是HTTP/1.x的连接被拒绝
+		r := bufio.NewReaderSize(down, sniff.MaxBytes)
+		_ = down.SetReadDeadline(time.Now().Add(requestLineTimeout))
+		res := sniff.Peek(r)
+		_ = down.SetReadDeadline(time.Time{})
+		down = &bufferedConn{Conn: down, r: r}
+		cc.setProtocol(res)
+		switch {
+		case res.Protocol == sniff.HTTP1:
+			req.HTTP, req.Method, req.Path = true, res.Method, res.Path
+		case t.p.authorizeNotHTTP(t.policy, string(res.Protocol), cc.downstreamAddr, cc.destAddr):
+			// audit模式下按TCP继续
+			needsHTTP = false
+		default:
+			_ = down.Close()
+			cc.abort(CloseDenied)
+			return
+		}
+	}
+	if t.policy != nil && !t.p.authorize(t.policy, req, cc.downstreamAddr, cc.destAddr) {
+		_ = down.Close()
+		cc.abort(CloseDenied)
+		return
+	}
+
+	dialStart := time.Now()
+	app, err := t.dial()
+	if err != nil {
+		_ = down.Close()
+		reason := dialReason(err)
+		t.p.observeDialFailure(cc.destAddr, reason)
+		logrus.Errorf("[terminator] - failed to connect to %s: %v, reason: %s", cc.destAddr, err, reason)
+		cc.abort(reason)
+		return
+	}
+	connectTime := time.Since(dialStart)
+	t.p.observeDial(cc.destAddr, connectTime)
+	cc.setConnectTime(connectTime)
+	if needsHTTP {
+		// 之后的每个请求都在转发之前授权
+		cc.startHTTP()
+		codec := cc.http.Load()
+		down = &tapConn{Conn: down, tap: t.authorizeRequests(cc, codec, req)}
+		app = &tapConn{Conn: app, tap: func(b []byte) error { cc.tapResponse(b); return nil }}
+	} else {
+		// 不需要按HTTP授权时不等待识别，在转发的同时识别，避免服务端先发送数据的协议每次都等到超时
+		sn := newSniffer(cc)
+		down = &tapConn{Conn: down, tap: sn.request}
+		app = &tapConn{Conn: app, tap: sn.response}
+	}
+	splice(down, app)
+}
+
+// authorizeRequests 第一个请求在连接应用之前已经授权过，keep-alive和pipelining的后续请求在转发之前逐个授权，
+// 被拒绝或者无法解析时返回错误，splice随之关闭连接
+func (t *terminator) authorizeRequests(cc *ConnContext, codec *http1.Codec, req authz.Request) func([]byte) error {
+	first := true
+	codec.OnRequest(func(ex http1.Exchange) error {
+		if first {
+			first = false
+			return nil
+		}
+		req.Method, req.Path = ex.Method, ex.Path
+		if !t.p.authorize(t.policy, req, cc.downstreamAddr, cc.destAddr) {
+			return errDenied
+		}
+		return nil
+	})
+	return func(b []byte) error {
+		err := codec.Request(b)
+		if err == nil {
+			// 响应方向解析出错之后也无法再找出请求的边界
+			err = codec.Err()
+		}
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, errDenied) {
+			logrus.Warnf("[terminator] - closing connection from %s to %s, cannot authorize http request: %v", cc.downstreamAddr, cc.destAddr, err)
+		}
+		cc.abort(CloseDenied)
+		return err
+	}
+}
+
+// acceptReason accept失败对应的关闭原因，下游在握手完成之前关闭或断开不算mTLS错误
+func acceptReason(err error) CloseReason {
+	switch {
+	case errors.Is(err, io.EOF):
+		return CloseNormal
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE), errors.Is(err, net.ErrClosed):
+		return CloseDownstreamReset
+	default:
+		return CloseMTLSError
+	}
+}
+
+// sniffer 在转发下游数据的同时识别协议，识别出HTTP/1.x之后把已经转发的数据补给HTTP解析。
+// 应用先发来数据、超时或者数据达到sniff.MaxBytes时按已有的数据识别
+type sniffer struct {
+	cc   *ConnContext
+	lock sync.Mutex
+	buf  []byte
+	done bool
+}
+
+func newSniffer(cc *ConnContext) *sniffer {
+	s := &sniffer{cc: cc}
+	// 与OnTraffic中的识别一样，定时器在识别完成或连接释放时停止
+	cc.lock.Lock()
+	if !cc.released {
+		cc.sniffTimer = time.AfterFunc(cc.cfg.detectTimeout(), func() { s.stop("timed out") })
+	}
+	cc.lock.Unlock()
+	return s
+}
+
+// request 下游 -> 应用方向读出的数据
+func (s *sniffer) request(b []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.done {
+		s.cc.tapRequest(b)
+		return nil
+	}
+	// 目的端口配置为HTTP时识别之前就已经开始解析
+	parsing := s.cc.http.Load() != nil
+	if parsing {
+		s.cc.tapRequest(b)
+	}
+	s.buf = append(s.buf, b...)
+	res, ok := sniff.Detect(s.buf)
+	if !ok && len(s.buf) < sniff.MaxBytes {
+		return nil
+	}
+	if !ok {
+		res = sniff.Result{Protocol: sniff.Unknown}
+	}
+	s.finish(res)
+	if !parsing {
+		s.cc.tapRequest(s.buf)
+	}
+	s.buf = nil
+	return nil
+}
+
+// response 应用 -> 下游方向读出的数据
+func (s *sniffer) response(b []byte) error {
+	s.stop("upstream sent data first")
+	s.cc.tapResponse(b)
+	return nil
+}
+
+// stop 不再等待更多的数据，按Unknown处理
+func (s *sniffer) stop(why string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.done {
+		return
+	}
+	logrus.Debugf("[terminator] - stop detecting protocol of connection from %s: %s", s.cc.downstreamAddr, why)
+	s.finish(sniff.Result{Protocol: sniff.Unknown})
+	s.buf = nil
+}
+
+func (s *sniffer) finish(res sniff.Result) {
+	s.done = true
+	s.cc.setProtocol(res)
+}
+
+// bufferedConn 识别协议时预读的数据仍从bufio中读出
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("half close is not supported")
+}
+
+// tapConn 读出的数据先交给tap再返回，terminator转发去掉mTLS之后的数据时用于HTTP解析和逐个请求授权，
+// tap返回错误时丢弃读出的数据并返回该错误
+type tapConn struct {
+	net.Conn
+	tap func([]byte) error
+}
+
+func (c *tapConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if tapErr := c.tap(b[:n]); tapErr != nil {
+			return 0, tapErr
+		}
+	}
+	return n, err
+}
+
+func (c *tapConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("half close is not supported")
+}
+
+// splice 在两个连接之间双向转发，一个方向读到EOF后只关闭对端的写端，两个方向都结束或任一方向出错后关闭两个连接
+func splice(a, b net.Conn) {
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			_ = a.Close()
+			_ = b.Close()
+		})
+	}
+	var wg sync.WaitGroup
+	pipe := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, err := io.Copy(dst, src)
+		if err == nil || errors.Is(err, io.ErrUnexpectedEOF) {
+			if cw, ok := dst.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+				return
+			}
+		}
+		closeBoth()
+	}
+	wg.Add(2)
+	go pipe(a, b)
+	go pipe(b, a)
+	wg.Wait()
+	closeBoth()
+}
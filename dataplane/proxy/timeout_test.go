@@ -0,0 +1,88 @@
+package proxy_test
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/SMALL-head/zmesh/dataplane/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	upstreamAddr, release := startUpstream(t)
+	defer close(release)
+	p, addr := serveProxyOutbound(t,
+		proxy.WithUpstream(proxy.NewUpstream("test", time.Second, proxy.Endpoint{Addr: upstreamAddr})),
+		proxy.WithIdleTimeout(300*time.Millisecond),
+	)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	// 有数据往来时不会被关闭
+	for i := 0; i < 4; i++ {
+		_, err = conn.Write([]byte("e"))
+		require.NoError(t, err)
+		_, err = io.ReadFull(conn, make([]byte, 1))
+		require.NoError(t, err)
+		time.Sleep(150 * time.Millisecond)
+	}
+
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+	require.Less(t, time.Since(start), 2*time.Second)
+	require.Eventually(t, func() bool {
+		return p.CloseReasonCounts()[proxy.CloseIdleTimeout] >= 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMaxConnectionDuration(t *testing.T) {
+	upstreamAddr, release := startUpstream(t)
+	defer close(release)
+	p, addr := serveProxyOutbound(t,
+		proxy.WithUpstream(proxy.NewUpstream("test", time.Second, proxy.Endpoint{Addr: upstreamAddr})),
+		proxy.WithMaxConnectionDuration(500*time.Millisecond),
+	)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	start := time.Now()
+	var readErr error
+	for readErr == nil {
+		if _, err := conn.Write([]byte("e")); err != nil {
+			break
+		}
+		_, readErr = io.ReadFull(conn, make([]byte, 1))
+		time.Sleep(50 * time.Millisecond)
+	}
+	require.Less(t, time.Since(start), 2*time.Second)
+	require.Eventually(t, func() bool {
+		return p.CloseReasonCounts()[proxy.CloseMaxDuration] >= 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestConnectError(t *testing.T) {
+	// 取一个空闲端口作为不可达的上游
+	deadAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(freePort(t)))
+	p, addr := serveProxyOutbound(t,
+		proxy.WithUpstream(proxy.NewUpstream("dead", 0, proxy.Endpoint{Addr: deadAddr})),
+		proxy.WithConnectTimeout(200*time.Millisecond),
+	)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.GreaterOrEqual(t, p.CloseReasonCounts()[proxy.CloseConnectError], int64(1))
+}
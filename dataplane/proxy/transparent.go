@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+	"golang.org/x/sys/unix"
+)
+
+// WithTransparent 配合TPROXY拦截使用：监听socket设置IP_TRANSPARENT，原始目的地址直接取连接的本地地址，
+// sidecar模式下以客户端地址作为源地址连接应用并打上mark，应用的回包经策略路由回到proxy。
+// 需要CAP_NET_ADMIN，只能在启动时设置
+func WithTransparent(mark int) Option {
+	return func(p *Proxy) {
+		p.transparent = true
+		p.tproxyMark = mark
+	}
+}
+
+// setTransparent 按socket的地址族设置IP_TRANSPARENT或IPV6_TRANSPARENT
+func setTransparent(fd int) error {
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return err
+	}
+	if _, ok := sa.(*syscall.SockaddrInet6); ok {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, unix.IPV6_TRANSPARENT, 1); err != nil {
+			return fmt.Errorf("setting IPV6_TRANSPARENT: %w", err)
+		}
+		return nil
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TRANSPARENT, 1); err != nil {
+		return fmt.Errorf("setting IP_TRANSPARENT: %w", err)
+	}
+	return nil
+}
+
+// setListenerTransparent gnet没有提供设置监听socket选项的入口，这里dup一份监听fd来设置，
+// TPROXY只在查找socket时检查该标志，监听之后再设置同样生效
+func setListenerTransparent(eng gnet.Engine) error {
+	fd, err := eng.Dup()
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	return setTransparent(fd)
+}
+
+// originalDst REDIRECT改写了目的地址，需要从conntrack查询；TPROXY不修改数据包，连接的本地地址就是原始目的地址
+func (p *Proxy) originalDst(c gnet.Conn) (netip.AddrPort, error) {
+	if !p.transparent {
+		return getOriginDst(c.Fd())
+	}
+	addr, ok := c.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("unexpected local address %v", c.LocalAddr())
+	}
+	dst := addr.AddrPort()
+	dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	// 直接连到监听端口的连接没有经过TPROXY，转发出去会连回自己
+	if int(dst.Port()) == p.Port {
+		return netip.AddrPort{}, fmt.Errorf("connection to %s was not intercepted by tproxy", dst)
+	}
+	return dst, nil
+}
+
+// upstreamDialer 透明模式下以下游的客户端地址作为源地址，并打上tproxy的mark使应用的回包能回到proxy
+func (p *Proxy) upstreamDialer(c gnet.Conn, timeout time.Duration) net.Dialer {
+	if !p.transparent {
+		return p.dialer(timeout)
+	}
+	d := net.Dialer{Timeout: timeout}
+	src, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return p.dialer(timeout)
+	}
+	d.LocalAddr = &net.TCPAddr{IP: src.IP, Zone: src.Zone}
+	mark := p.tproxyMark
+	d.Control = func(network, address string, rc syscall.RawConn) error {
+		return control(rc, func(fd int) error {
+			if err := setTransparent(fd); err != nil {
+				return err
+			}
+			return setMark(fd, mark)
+		})
+	}
+	return d
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const defaultConnectTimeout = 5 * time.Second
+
+var ErrNoEndpoint = errors.New("upstream has no endpoint")
+
+type Endpoint struct {
+	Addr   string
+	Weight int
+}
+
+// Upstream proxy模式下转发的目标集群，按权重做平滑轮询(与nginx的smooth weighted round-robin一致)
+type Upstream struct {
+	Name           string
+	ConnectTimeout time.Duration
+
+	lock      sync.Mutex
+	endpoints []*weightedEndpoint
+}
+
+type weightedEndpoint struct {
+	Endpoint
+	current int
+}
+
+func NewUpstream(name string, connectTimeout time.Duration, endpoints ...Endpoint) *Upstream {
+	u := &Upstream{
+		Name:           name,
+		ConnectTimeout: connectTimeout,
+	}
+	for _, e := range endpoints {
+		if e.Weight <= 0 {
+			e.Weight = 1
+		}
+		u.endpoints = append(u.endpoints, &weightedEndpoint{Endpoint: e})
+	}
+	return u
+}
+
+// Pick 选出下一个要连接的地址
+func (u *Upstream) Pick() (string, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if len(u.endpoints) == 0 {
+		return "", ErrNoEndpoint
+	}
+
+	total := 0
+	var best *weightedEndpoint
+	for _, e := range u.endpoints {
+		e.current += e.Weight
+		total += e.Weight
+		if best == nil || e.current > best.current {
+			best = e
+		}
+	}
+	best.current -= total
+	return best.Addr, nil
+}
@@ -0,0 +1,28 @@
+package proxy_test
+
+import (
+	"testing"
+
+	"github.com/SMALL-head/zmesh/dataplane/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamPickWeighted(t *testing.T) {
+	u := proxy.NewUpstream("test", 0,
+		proxy.Endpoint{Addr: "a:1", Weight: 5},
+		proxy.Endpoint{Addr: "b:1", Weight: 1},
+		proxy.Endpoint{Addr: "c:1", Weight: 1},
+	)
+	count := map[string]int{}
+	for i := 0; i < 70; i++ {
+		addr, err := u.Pick()
+		require.NoError(t, err)
+		count[addr]++
+	}
+	require.Equal(t, 50, count["a:1"])
+	require.Equal(t, 10, count["b:1"])
+	require.Equal(t, 10, count["c:1"])
+
+	_, err := proxy.NewUpstream("empty", 0).Pick()
+	require.ErrorIs(t, err, proxy.ErrNoEndpoint)
+}
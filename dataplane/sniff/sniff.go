@@ -0,0 +1,151 @@
+// Package sniff 根据客户端最先发送的数据识别连接的应用层协议：HTTP/1.x、prior knowledge的明文HTTP/2、
+// TLS(以及ClientHello中的SNI)，其余的都视为无法识别的TCP
+package sniff
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/SMALL-head/zmesh/dataplane/mtls"
+)
+
+type Protocol string
+
+const (
+	HTTP1   Protocol = "http1"
+	HTTP2   Protocol = "http2" // prior knowledge，以连接前言开头的明文HTTP/2
+	TLS     Protocol = "tls"
+	Unknown Protocol = "unknown"
+)
+
+const (
+	// MaxBytes 识别最多需要的数据量，能放下一个完整的TLS记录。超过后仍无法确定的按Unknown处理
+	MaxBytes = 20 << 10
+	// maxRequestLine HTTP/1.x请求行的最大长度
+	maxRequestLine = 8 << 10
+	maxMethodLen   = 20
+)
+
+// http2Preface HTTP/2客户端的连接前言
+var http2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// Result 识别的结果
+type Result struct {
+	Protocol Protocol
+	SNI      string // TLS ClientHello中的server name
+	// HTTP/1.x连接上第一个请求的方法和路径
+	Method string
+	Path   string
+}
+
+// Detect 根据连接开头的数据识别协议。数据不足以确定时返回false，调用方应在读到更多数据后重试，
+// 读取超时或连接关闭时按Unknown处理。数据达到MaxBytes时总能确定
+func Detect(b []byte) (Result, bool) {
+	if len(b) == 0 {
+		return Result{}, false
+	}
+	if mtls.IsHandshake(b[0]) {
+		return detectTLS(b)
+	}
+	if n := min(len(b), len(http2Preface)); bytes.Equal(b[:n], http2Preface[:n]) {
+		if n < len(http2Preface) {
+			return Result{}, false
+		}
+		return Result{Protocol: HTTP2}, true
+	}
+	return detectHTTP1(b)
+}
+
+func detectTLS(b []byte) (Result, bool) {
+	if len(b) > 1 && b[1] != 3 {
+		// 记录层的主版本号总是3
+		return Result{Protocol: Unknown}, true
+	}
+	hello, err := mtls.PeekClientHello(bufio.NewReaderSize(bytes.NewReader(b), MaxBytes))
+	switch {
+	case err == nil:
+		return Result{Protocol: TLS, SNI: hello.ServerName}, true
+	case errors.Is(err, io.EOF) && len(b) < MaxBytes:
+		return Result{}, false
+	default:
+		// 以TLS握手记录开头但ClientHello无法解析
+		return Result{Protocol: TLS}, true
+	}
+}
+
+func detectHTTP1(b []byte) (Result, bool) {
+	method, _, found := bytes.Cut(b, []byte(" "))
+	if len(method) == 0 || len(method) > maxMethodLen || !isMethod(method) {
+		return Result{Protocol: Unknown}, true
+	}
+	if !found {
+		return Result{}, false
+	}
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		if len(b) < maxRequestLine {
+			return Result{}, false
+		}
+		return Result{Protocol: Unknown}, true
+	}
+	m, path, ok := parseRequestLine(b[:i+1])
+	if !ok {
+		return Result{Protocol: Unknown}, true
+	}
+	return Result{Protocol: HTTP1, Method: m, Path: path}, true
+}
+
+// isMethod 方法只由大写字母、-和_组成，如GET、M-SEARCH
+func isMethod(b []byte) bool {
+	for _, c := range b {
+		if (c < 'A' || c > 'Z') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseRequestLine 解析"GET /path HTTP/1.1"，absolute-form的请求只取路径部分，CONNECT的目标是host:port
+func parseRequestLine(line []byte) (method, target string, ok bool) {
+	parts := strings.Split(strings.TrimRight(string(line), "\r\n"), " ")
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "HTTP/1.") {
+		return "", "", false
+	}
+	method, target = parts[0], parts[1]
+	if target == "*" || (method == "CONNECT" && target != "") {
+		// OPTIONS * HTTP/1.1
+		return method, target, true
+	}
+	if !strings.HasPrefix(target, "/") {
+		u, err := url.Parse(target)
+		if err != nil || u.Host == "" {
+			return "", "", false
+		}
+		target = u.RequestURI()
+	}
+	return method, target, true
+}
+
+// Peek 从r中预读数据直到能够识别协议，不消费数据，r的缓冲区不能小于MaxBytes。
+// 读取出错(如超过调用方设置的deadline)时按Unknown处理，之后仍可以从r中读出已经预读的数据
+func Peek(r *bufio.Reader) Result {
+	if _, err := r.Peek(1); err != nil {
+		return Result{Protocol: Unknown}
+	}
+	for {
+		b, _ := r.Peek(r.Buffered())
+		if res, ok := Detect(b); ok {
+			return res
+		}
+		if len(b) >= r.Size() {
+			return Result{Protocol: Unknown}
+		}
+		if _, err := r.Peek(len(b) + 1); err != nil {
+			return Result{Protocol: Unknown}
+		}
+	}
+}
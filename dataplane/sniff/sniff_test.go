@@ -0,0 +1,86 @@
+package sniff_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SMALL-head/zmesh/dataplane/sniff"
+	"github.com/stretchr/testify/require"
+)
+
+// clientHello 录下客户端发出的ClientHello
+func clientHello(t *testing.T, serverName string) []byte {
+	c, s := net.Pipe()
+	defer s.Close()
+	go func() {
+		_ = tls.Client(c, &tls.Config{ServerName: serverName}).Handshake()
+		c.Close()
+	}()
+	buf := make([]byte, 16<<10)
+	n, err := s.Read(buf)
+	require.NoError(t, err)
+	return buf[:n]
+}
+
+func TestDetect(t *testing.T) {
+	hello := clientHello(t, "reviews.default")
+	for _, c := range []struct {
+		name string
+		data string
+		want sniff.Result
+		ok   bool
+	}{
+		{"empty", "", sniff.Result{}, false},
+		{"http1", "GET /api?id=1 HTTP/1.1\r\nHost: reviews\r\n\r\n", sniff.Result{Protocol: sniff.HTTP1, Method: "GET", Path: "/api?id=1"}, true},
+		{"absolute form", "POST http://reviews:8080/api HTTP/1.0\r\n", sniff.Result{Protocol: sniff.HTTP1, Method: "POST", Path: "/api"}, true},
+		{"connect", "CONNECT reviews:443 HTTP/1.1\r\n", sniff.Result{Protocol: sniff.HTTP1, Method: "CONNECT", Path: "reviews:443"}, true},
+		{"partial method", "GE", sniff.Result{}, false},
+		{"partial request line", "GET /api HTTP/1.", sniff.Result{}, false},
+		{"not a request line", "GET key\r\n", sniff.Result{Protocol: sniff.Unknown}, true},
+		{"lowercase", "hello world\n", sniff.Result{Protocol: sniff.Unknown}, true},
+		{"http2", "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n\x00\x00", sniff.Result{Protocol: sniff.HTTP2}, true},
+		{"partial http2 preface", "PRI * HTTP/2.0\r\n", sniff.Result{}, false},
+		{"tls", string(hello), sniff.Result{Protocol: sniff.TLS, SNI: "reviews.default"}, true},
+		{"partial tls", string(hello[:20]), sniff.Result{}, false},
+		{"binary", "\x16\x01\x00", sniff.Result{Protocol: sniff.Unknown}, true},
+		{"mysql", "\x4a\x00\x00\x00\x0a", sniff.Result{Protocol: sniff.Unknown}, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			res, ok := sniff.Detect([]byte(c.data))
+			require.Equal(t, c.ok, ok)
+			require.Equal(t, c.want, res)
+		})
+	}
+
+	// 达到MaxBytes时总能确定
+	res, ok := sniff.Detect([]byte("GET /" + strings.Repeat("a", sniff.MaxBytes)))
+	require.True(t, ok)
+	require.Equal(t, sniff.Unknown, res.Protocol)
+}
+
+func TestPeek(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	go func() {
+		// 请求行分多次到达
+		for _, part := range []string{"GET /re", "views HTTP/1.1\r\n\r\n"} {
+			_, _ = c.Write([]byte(part))
+		}
+	}()
+	r := bufio.NewReaderSize(s, sniff.MaxBytes)
+	require.Equal(t, sniff.Result{Protocol: sniff.HTTP1, Method: "GET", Path: "/reviews"}, sniff.Peek(r))
+	// 数据没有被消费
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "GET /reviews HTTP/1.1\r\n", line)
+
+	// 服务端先发送数据的协议等到deadline后按Unknown处理
+	require.NoError(t, s.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	r = bufio.NewReaderSize(s, sniff.MaxBytes)
+	require.Equal(t, sniff.Result{Protocol: sniff.Unknown}, sniff.Peek(r))
+}